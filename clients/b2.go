@@ -0,0 +1,400 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	b2AuthorizeURL  = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+	b2APIPath       = "/b2api/v2"
+	b2InfoHeaderPfx = "X-Bz-Info-"
+)
+
+// B2Authorization is the result of the b2_authorize_account call
+type B2Authorization struct {
+	AccountID          string `json:"accountId"`
+	AuthorizationToken string `json:"authorizationToken"`
+	APIURL             string `json:"apiUrl"`
+	DownloadURL        string `json:"downloadUrl"`
+}
+
+// B2File describes a file (version) stored in B2
+type B2File struct {
+	FileID          string            `json:"fileId"`
+	FileName        string            `json:"fileName"`
+	Action          string            `json:"action"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentType     string            `json:"contentType"`
+	ContentSha1     string            `json:"contentSha1"`
+	FileInfo        map[string]string `json:"fileInfo"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+}
+
+// ErrB2BucketNotFound is returned by BucketID when the account has no bucket with the given name
+var ErrB2BucketNotFound = errors.New("B2 bucket not found")
+
+// B2Client talks to the native Backblaze B2 API. Authorization is done lazily on the first call and
+// refreshed whenever the API reports the token as expired.
+type B2Client struct {
+	// AuthorizeURL of the b2_authorize_account endpoint, overridable for tests
+	AuthorizeURL string
+	HTTPClient   *http.Client
+
+	keyID  string
+	appKey string
+
+	mu        sync.Mutex
+	auth      *B2Authorization
+	bucketIDs map[string]string
+}
+
+func NewB2Client(keyID, appKey string) *B2Client {
+	return &B2Client{
+		AuthorizeURL: b2AuthorizeURL,
+		keyID:        keyID,
+		appKey:       appKey,
+		bucketIDs:    map[string]string{},
+	}
+}
+
+// Authorize returns the current account authorization, calling b2_authorize_account if needed
+func (c *B2Client) Authorize(ctx context.Context) (*B2Authorization, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth != nil {
+		return c.auth, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.AuthorizeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.keyID, c.appKey)
+	if UserAgent != "" {
+		req.Header.Set("User-Agent", UserAgent)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	var auth B2Authorization
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return nil, err
+	}
+	c.auth = &auth
+	return c.auth, nil
+}
+
+func (c *B2Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *B2Client) resetAuth(auth *B2Authorization) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth == auth {
+		c.auth = nil
+	}
+}
+
+// apiCall calls a JSON API endpoint, authorizing again once if the token got expired
+func (c *B2Client) apiCall(ctx context.Context, endpoint string, input, output interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	for try := 0; ; try++ {
+		auth, err := c.Authorize(ctx)
+		if err != nil {
+			return err
+		}
+		client := BaseClient{
+			Client:  c.httpClient(),
+			BaseUrl: auth.APIURL + b2APIPath,
+		}
+		err = client.DoRequest(ctx, Request{
+			Method:      "POST",
+			URL:         "/" + endpoint,
+			Body:        bytes.NewReader(body),
+			ContentType: jsonMimeType,
+			Headers:     map[string]string{"Authorization": auth.AuthorizationToken},
+		}, output)
+		var statusErr *HTTPStatusError
+		if try == 0 && errors.As(err, &statusErr) && statusErr.Status == http.StatusUnauthorized {
+			c.resetAuth(auth)
+			continue
+		}
+		return err
+	}
+}
+
+// BucketID returns the ID of the bucket with the given name
+func (c *B2Client) BucketID(ctx context.Context, bucketName string) (string, error) {
+	c.mu.Lock()
+	id, ok := c.bucketIDs[bucketName]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	auth, err := c.Authorize(ctx)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Buckets []struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"buckets"`
+	}
+	err = c.apiCall(ctx, "b2_list_buckets", map[string]string{
+		"accountId":  auth.AccountID,
+		"bucketName": bucketName,
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+	for _, b := range res.Buckets {
+		if b.BucketName == bucketName {
+			c.mu.Lock()
+			c.bucketIDs[bucketName] = b.BucketID
+			c.mu.Unlock()
+			return b.BucketID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrB2BucketNotFound, bucketName)
+}
+
+// UploadFile uploads the data of the given size and SHA1 using the b2_get_upload_url flow
+func (c *B2Client) UploadFile(ctx context.Context, bucketID, fileName, contentType string, info map[string]string, data io.Reader, size int64, sha1Hex string) (*B2File, error) {
+	var uploadURL struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	if err := c.apiCall(ctx, "b2_get_upload_url", map[string]string{"bucketId": bucketID}, &uploadURL); err != nil {
+		return nil, err
+	}
+	if contentType == "" {
+		contentType = "b2/x-auto"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL.UploadURL, data)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", uploadURL.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", B2EscapeFileName(fileName))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Bz-Content-Sha1", sha1Hex)
+	for k, v := range info {
+		req.Header.Set(b2InfoHeaderPfx+k, url.QueryEscape(v))
+	}
+	if UserAgent != "" {
+		req.Header.Set("User-Agent", UserAgent)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	var file B2File
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// DownloadURL returns the URL to download the file by name
+func (c *B2Client) DownloadURL(ctx context.Context, bucketName, fileName string) (string, error) {
+	auth, err := c.Authorize(ctx)
+	if err != nil {
+		return "", err
+	}
+	return auth.DownloadURL + "/file/" + B2EscapeFileName(bucketName) + "/" + B2EscapeFileName(fileName), nil
+}
+
+// DownloadFile downloads the file by name. The byteRange is the value of the HTTP Range header,
+// empty to download the whole file. Non 2xx responses are returned as *HTTPStatusError.
+func (c *B2Client) DownloadFile(ctx context.Context, bucketName, fileName, byteRange string) (*http.Response, error) {
+	for try := 0; ; try++ {
+		auth, err := c.Authorize(ctx)
+		if err != nil {
+			return nil, err
+		}
+		downloadURL, err := c.DownloadURL(ctx, bucketName, fileName)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		if UserAgent != "" {
+			req.Header.Set("User-Agent", UserAgent)
+		}
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 300 {
+			err = statusError(resp)
+			resp.Body.Close()
+			if try == 0 && resp.StatusCode == http.StatusUnauthorized {
+				c.resetAuth(auth)
+				continue
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// ListFileNames lists the files with the given prefix, starting at startFileName. Returns the name
+// to start the next page at, empty if there are no more files.
+func (c *B2Client) ListFileNames(ctx context.Context, bucketID, prefix, delimiter, startFileName string, maxFileCount int) ([]B2File, string, error) {
+	input := map[string]interface{}{
+		"bucketId":     bucketID,
+		"prefix":       prefix,
+		"maxFileCount": maxFileCount,
+	}
+	if delimiter != "" {
+		input["delimiter"] = delimiter
+	}
+	if startFileName != "" {
+		input["startFileName"] = startFileName
+	}
+	var res struct {
+		Files        []B2File `json:"files"`
+		NextFileName *string  `json:"nextFileName"`
+	}
+	if err := c.apiCall(ctx, "b2_list_file_names", input, &res); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if res.NextFileName != nil {
+		next = *res.NextFileName
+	}
+	return res.Files, next, nil
+}
+
+// ListFileVersions lists all the versions of the files with the given prefix, starting at
+// startFileName and startFileID. Returns where to start the next page, empty if there are no more.
+func (c *B2Client) ListFileVersions(ctx context.Context, bucketID, prefix, startFileName, startFileID string, maxFileCount int) ([]B2File, string, string, error) {
+	input := map[string]interface{}{
+		"bucketId":     bucketID,
+		"prefix":       prefix,
+		"maxFileCount": maxFileCount,
+	}
+	if startFileName != "" {
+		input["startFileName"] = startFileName
+	}
+	if startFileID != "" {
+		input["startFileId"] = startFileID
+	}
+	var res struct {
+		Files        []B2File `json:"files"`
+		NextFileName *string  `json:"nextFileName"`
+		NextFileID   *string  `json:"nextFileId"`
+	}
+	if err := c.apiCall(ctx, "b2_list_file_versions", input, &res); err != nil {
+		return nil, "", "", err
+	}
+	nextName, nextID := "", ""
+	if res.NextFileName != nil {
+		nextName = *res.NextFileName
+	}
+	if res.NextFileID != nil {
+		nextID = *res.NextFileID
+	}
+	return res.Files, nextName, nextID, nil
+}
+
+// DeleteFileVersion deletes a single version of a file
+func (c *B2Client) DeleteFileVersion(ctx context.Context, fileName, fileID string) error {
+	return c.apiCall(ctx, "b2_delete_file_version", map[string]string{
+		"fileName": fileName,
+		"fileId":   fileID,
+	}, nil)
+}
+
+// GetDownloadAuthorization returns a token allowing to download files with the given prefix
+// from a private bucket, valid for the given duration.
+func (c *B2Client) GetDownloadAuthorization(ctx context.Context, bucketID, fileNamePrefix string, valid time.Duration) (string, error) {
+	var res struct {
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	err := c.apiCall(ctx, "b2_get_download_authorization", map[string]interface{}{
+		"bucketId":               bucketID,
+		"fileNamePrefix":         fileNamePrefix,
+		"validDurationInSeconds": int64(valid / time.Second),
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.AuthorizationToken, nil
+}
+
+// B2FileInfo extracts the custom file info from the headers of a download response
+func B2FileInfo(header http.Header) map[string]string {
+	var info map[string]string
+	for k, v := range header {
+		if len(v) == 0 || !strings.HasPrefix(k, b2InfoHeaderPfx) {
+			continue
+		}
+		if info == nil {
+			info = make(map[string]string)
+		}
+		value, err := url.QueryUnescape(v[0])
+		if err != nil {
+			value = v[0]
+		}
+		info[strings.ToLower(strings.TrimPrefix(k, b2InfoHeaderPfx))] = value
+	}
+	return info
+}
+
+// B2UploadTime parses the upload timestamp header of a download response
+func B2UploadTime(header http.Header) time.Time {
+	ms, err := strconv.ParseInt(header.Get("X-Bz-Upload-Timestamp"), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// B2EscapeFileName percent-encodes the file name, keeping the path separators
+func B2EscapeFileName(name string) string {
+	return strings.ReplaceAll(url.PathEscape(name), "%2F", "/")
+}
+
+func statusError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return &HTTPStatusError{resp.StatusCode, string(body)}
+}
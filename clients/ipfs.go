@@ -6,14 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"strings"
+	"net/url"
 	"time"
 )
 
 const (
 	pinataBaseUrl = "https://api.pinata.cloud"
 	jsonMimeType  = "application/json"
-	pinataOptions = `{"cidVersion":1}`
 )
 
 type PinInfo struct {
@@ -31,40 +30,66 @@ type PinList struct {
 	Pins  []PinInfo `json:"rows"`
 }
 
+// PinOptions organize a pinned file in the Pinata dashboard
+type PinOptions struct {
+	// KeyValues are added to the metadata keyvalues the client was created with, searchable in the
+	// pin list
+	KeyValues map[string]string
+	// GroupID is the id of the Pinata group the pin is added to. Empty means no group.
+	GroupID string
+	// CIDVersion is the version of the CID of the pin, 0 or 1. Nil means Pinata's default.
+	CIDVersion *int
+	// Regions are the regions the content is replicated to. Empty means the account's default
+	// pin policy.
+	Regions []PinRegion
+}
+
+// PinRegion is a region of a Pinata pin policy, with the number of replicas desired in it
+type PinRegion struct {
+	ID                      string `json:"id"`
+	DesiredReplicationCount int    `json:"desiredReplicationCount"`
+}
+
 type IPFS interface {
-	PinContent(ctx context.Context, name, contentType string, data io.Reader) (cid string, metadata interface{}, err error)
+	PinContent(ctx context.Context, name, contentType string, data io.Reader, opts PinOptions) (cid string, metadata interface{}, err error)
 	Unpin(ctx context.Context, cid string) error
 	List(ctx context.Context, pageSize, pageOffset int, cid string) (*PinList, int, error)
+	// FindPin returns a pinned file with the given metadata keyvalue, or nil if there's none
+	FindPin(ctx context.Context, key, value string) (*PinInfo, error)
+	// TestAuthentication checks that the credentials are accepted
+	TestAuthentication(ctx context.Context) error
 }
 
 func NewPinataClientJWT(jwt string, filesMetadata map[string]string) IPFS {
-	return &pinataClient{
-		BaseClient: BaseClient{
-			BaseUrl: pinataBaseUrl,
-			BaseHeaders: map[string]string{
-				"Authorization": "Bearer " + jwt,
-			},
-		},
-		filesMetadata: marshalFilesMetadata(filesMetadata),
-	}
+	return NewPinataClient(pinataBaseUrl, "", jwt, filesMetadata)
 }
 
 func NewPinataClientAPIKey(apiKey, apiSecret string, filesMetadata map[string]string) IPFS {
+	return NewPinataClient(pinataBaseUrl, apiKey, apiSecret, filesMetadata)
+}
+
+// NewPinataClient creates a client of the Pinata API at baseUrl. The secret is a JWT when apiKey
+// is empty.
+func NewPinataClient(baseUrl, apiKey, secret string, filesMetadata map[string]string) IPFS {
+	headers := map[string]string{"Authorization": "Bearer " + secret}
+	if apiKey != "" {
+		headers = map[string]string{
+			"pinata_api_key":        apiKey,
+			"pinata_secret_api_key": secret,
+		}
+	}
 	return &pinataClient{
 		BaseClient: BaseClient{
-			BaseUrl: pinataBaseUrl,
-			BaseHeaders: map[string]string{
-				"pinata_api_key":        apiKey,
-				"pinata_secret_api_key": apiSecret,
-			},
+			BaseUrl:     baseUrl,
+			BaseHeaders: headers,
 		},
-		filesMetadata: marshalFilesMetadata(filesMetadata),
+		filesMetadata: filesMetadata,
 	}
 }
 
 type pinataClient struct {
 	BaseClient
-	filesMetadata []byte
+	filesMetadata map[string]string
 }
 
 type uploadResponse struct {
@@ -74,19 +99,33 @@ type uploadResponse struct {
 	IsDuplicate bool      `json:"isDuplicate"`
 }
 
-func (p *pinataClient) PinContent(ctx context.Context, filename, fileContentType string, data io.Reader) (string, interface{}, error) {
+func (p *pinataClient) PinContent(ctx context.Context, filename, fileContentType string, data io.Reader, opts PinOptions) (string, interface{}, error) {
+	options := map[string]interface{}{}
+	if opts.CIDVersion != nil {
+		options["cidVersion"] = *opts.CIDVersion
+	}
+	if opts.GroupID != "" {
+		options["groupId"] = opts.GroupID
+	}
+	if len(opts.Regions) > 0 {
+		options["customPinPolicy"] = map[string]interface{}{"regions": opts.Regions}
+	}
+	pinataOptions, err := json.Marshal(options)
+	if err != nil {
+		return "", nil, err
+	}
 	parts := []part{
 		{"file", filename, fileContentType, data},
-		{"pinataOptions", "", jsonMimeType, strings.NewReader(pinataOptions)},
+		{"pinataOptions", "", jsonMimeType, bytes.NewReader(pinataOptions)},
 	}
-	if p.filesMetadata != nil {
-		parts = append(parts, part{"pinataMetadata", "", jsonMimeType, bytes.NewReader(p.filesMetadata)})
+	if metadata := marshalFilesMetadata(p.filesMetadata, opts.KeyValues); metadata != nil {
+		parts = append(parts, part{"pinataMetadata", "", jsonMimeType, bytes.NewReader(metadata)})
 	}
 	body, contentType := multipartBody(parts)
 	defer body.Close()
 
 	var res *uploadResponse
-	err := p.DoRequest(ctx, Request{
+	err = p.DoRequest(ctx, Request{
 		Method:      "POST",
 		URL:         "/pinning/pinFileToIPFS",
 		Body:        body,
@@ -125,7 +164,43 @@ func (p *pinataClient) List(ctx context.Context, pageSize, pageOffset int, cid s
 	return pl, next, err
 }
 
-func marshalFilesMetadata(keyvalues map[string]string) []byte {
+func (p *pinataClient) FindPin(ctx context.Context, key, value string) (*PinInfo, error) {
+	filter, err := json.Marshal(map[string]interface{}{
+		key: map[string]string{"value": value, "op": "eq"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var pl *PinList
+	err = p.DoRequest(ctx, Request{
+		Method: "GET",
+		URL:    "/data/pinList?status=pinned&pageLimit=1&metadata[keyvalues]=" + url.QueryEscape(string(filter)),
+	}, &pl)
+	if err != nil {
+		return nil, err
+	}
+	if len(pl.Pins) == 0 {
+		return nil, nil
+	}
+	return &pl.Pins[0], nil
+}
+
+func (p *pinataClient) TestAuthentication(ctx context.Context) error {
+	return p.DoRequest(ctx, Request{
+		Method: "GET",
+		URL:    "/data/testAuthentication",
+	}, nil)
+}
+
+// marshalFilesMetadata merges the keyvalues into the pinataMetadata of a pin, the later ones
+// taking precedence. Returns nil if there are none.
+func marshalFilesMetadata(keyvaluesList ...map[string]string) []byte {
+	keyvalues := map[string]string{}
+	for _, kvs := range keyvaluesList {
+		for k, v := range kvs {
+			keyvalues[k] = v
+		}
+	}
 	if len(keyvalues) == 0 {
 		return nil
 	}
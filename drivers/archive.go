@@ -0,0 +1,173 @@
+package drivers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+)
+
+// ArchiveFormat is the format of the archives imported by ImportArchive
+type ArchiveFormat string
+
+const (
+	ArchiveTar     ArchiveFormat = "tar"
+	ArchiveTarGzip ArchiveFormat = "tar.gz"
+	ArchiveZip     ArchiveFormat = "zip"
+)
+
+// archiveImportWorkers is the number of files of an archive saved in parallel
+const archiveImportWorkers = 4
+
+// ImportArchive saves the files of a tar or zip archive under the prefix, at their path in the
+// archive, with the content type of their extension. The files are read one by one and saved in
+// parallel while the next ones are read, so only the files being saved are held in memory. A zip
+// archive can only be read from its end, so r is read to memory first unless it is an io.ReaderAt
+// with a Size method, like a bytes.Reader. Directories, links and the other special entries are
+// skipped. Returns the number of files saved, and the error of the first file failed, after which
+// the rest of the archive is not imported.
+func ImportArchive(ctx context.Context, sess OSSession, prefix string, r io.Reader, format ArchiveFormat) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tasks := make(chan *saveTask)
+	resCh := make(chan *saveResult)
+	var wg sync.WaitGroup
+	for i := 0; i < archiveImportWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			saveWorker(ctx, tasks, resCh)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(resCh)
+	}()
+
+	var (
+		saved  int
+		failed error
+		done   = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for res := range resCh {
+			if res.err != nil && failed == nil {
+				failed = res.err
+				cancel()
+			} else if res.err == nil {
+				saved++
+			}
+		}
+	}()
+
+	index := 0
+	err := readArchive(r, format, func(name string, data io.Reader) error {
+		buf, err := ioutil.ReadAll(data)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		file := FileToSave{Name: objectKey(prefix, name), Data: buf}
+		if contentType, err := TypeByExtension(path.Ext(name)); err == nil {
+			file.Fields = &FileProperties{ContentType: contentType}
+		}
+		select {
+		case tasks <- &saveTask{sess: sess, file: file, index: index}:
+			index++
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(tasks)
+	<-done
+	if failed != nil {
+		return saved, fmt.Errorf("failed to import the archive: %w", failed)
+	}
+	if err != nil {
+		return saved, fmt.Errorf("failed to import the archive: %w", err)
+	}
+	return saved, nil
+}
+
+// readArchive calls fn with the path and the data of each regular file of the archive, in order
+func readArchive(r io.Reader, format ArchiveFormat, fn func(name string, data io.Reader) error) error {
+	switch format {
+	case ArchiveTarGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return readTar(gz, fn)
+	case ArchiveTar:
+		return readTar(r, fn)
+	case ArchiveZip:
+		return readZip(r, fn)
+	}
+	return fmt.Errorf("unsupported archive format %q", format)
+}
+
+func readTar(r io.Reader, fn func(name string, data io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err := fn(archivePath(hdr.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+func readZip(r io.Reader, fn func(name string, data io.Reader) error) error {
+	ra, ok := r.(interface {
+		io.ReaderAt
+		Size() int64
+	})
+	if !ok {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		ra = bytes.NewReader(data)
+	}
+	zr, err := zip.NewReader(ra, ra.Size())
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(archivePath(f.Name), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivePath returns the path of an archive entry relative to the root of the archive, so that
+// the absolute paths and the ".." elements can't reach out of the prefix
+func archivePath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
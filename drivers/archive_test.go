@@ -0,0 +1,115 @@
+package drivers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportArchive(t *testing.T) {
+	files := map[string][]byte{
+		"index.m3u8":          []byte("#EXTM3U"),
+		"video/0.ts":          bytes.Repeat([]byte{1}, 100000),
+		"video/1.ts":          bytes.Repeat([]byte{2}, 1000),
+		"../outside/meta.bin": {0, 1, 2},
+	}
+	names := []string{"index.m3u8", "video/0.ts", "video/1.ts", "../outside/meta.bin"}
+	imported := map[string]string{
+		"index.m3u8":          "sess/rec/index.m3u8",
+		"video/0.ts":          "sess/rec/video/0.ts",
+		"video/1.ts":          "sess/rec/video/1.ts",
+		"../outside/meta.bin": "sess/rec/outside/meta.bin",
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "video/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))}))
+		_, err := tw.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "link.ts", Typeflag: tar.TypeSymlink, Linkname: "video/0.ts"}))
+	require.NoError(t, tw.Close())
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	_, err := gw.Write(tarBuf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	_, err = zw.Create("video/")
+	require.NoError(t, err)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	tests := []struct {
+		name    string
+		format  ArchiveFormat
+		archive func() io.Reader
+	}{
+		{name: "tar", format: ArchiveTar, archive: func() io.Reader { return bytes.NewReader(tarBuf.Bytes()) }},
+		{name: "tar.gz", format: ArchiveTarGzip, archive: func() io.Reader { return bytes.NewReader(gzBuf.Bytes()) }},
+		{name: "zip", format: ArchiveZip, archive: func() io.Reader { return bytes.NewReader(zipBuf.Bytes()) }},
+		// without ReaderAt, read to memory first
+		{name: "zip stream", format: ArchiveZip, archive: func() io.Reader { return io.MultiReader(bytes.NewReader(zipBuf.Bytes())) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			sess := NewMemoryDriver(nil).NewSession("sess")
+			saved, err := ImportArchive(context.Background(), sess, "rec/", tt.archive(), tt.format)
+			require.NoError(err)
+			require.Equal(len(files), saved)
+
+			for name, data := range files {
+				fi, err := sess.ReadData(context.Background(), imported[name])
+				require.NoError(err)
+				got, err := io.ReadAll(fi.Body)
+				require.NoError(err)
+				require.Equal(data, got, name)
+			}
+			fi, err := sess.ReadData(context.Background(), "sess/rec/index.m3u8")
+			require.NoError(err)
+			require.Equal("application/x-mpegurl", fi.ContentType)
+		})
+	}
+
+	_, err = ImportArchive(context.Background(), NewMemoryDriver(nil).NewSession(""), "", bytes.NewReader(tarBuf.Bytes()), "rar")
+	require.ErrorContains(t, err, `unsupported archive format "rar"`)
+}
+
+func TestImportArchiveSaveError(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"0.ts", "1.ts", "2.ts", "3.ts", "4.ts", "5.ts"} {
+		require.NoError(tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1}))
+		_, err := tw.Write([]byte{0})
+		require.NoError(err)
+	}
+	require.NoError(tw.Close())
+
+	saveErr := errors.New("save failed")
+	sess := NewMockOSSession()
+	sess.On("SaveData", "1.ts", mock.Anything, mock.Anything, mock.Anything).Return("", saveErr)
+	sess.On("SaveData", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("", nil)
+	saved, err := ImportArchive(context.Background(), sess, "", &buf, ArchiveTar)
+	require.ErrorIs(err, saveErr)
+	require.Less(saved, 6)
+}
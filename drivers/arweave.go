@@ -0,0 +1,347 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	arweaveGatewayURL = "https://arweave.net"
+	// arweaveDefaultSaveTimeout is used on save ops when no custom timeout is provided. Arweave
+	// transactions take a while to be accepted by the gateway.
+	arweaveDefaultSaveTimeout = 5 * time.Minute
+	// arweaveManifestContentType makes the gateways resolve the paths of a published manifest
+	arweaveManifestContentType = "application/x.arweave-manifest+json"
+)
+
+// arweaveTxID matches the base64url encoded SHA-256 ids of Arweave transactions
+var arweaveTxID = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// ArweaveOS stores files permanently in Arweave. Each SaveData posts a data transaction signed with
+// the wallet, and Publish posts a path manifest of the files saved since the last Publish, so that
+// they can be accessed by name under the ar:// URL of the manifest. The stored data is immutable,
+// so listing, deleting and renaming files is not supported.
+type ArweaveOS struct {
+	walletPath string
+	prefix     string
+	gatewayURL string
+
+	// CommandTimeout limits the time each of the arkb commands run by SaveData and Publish can take,
+	// the command is killed when it runs longer. Zero means the commands are only limited by the
+	// context of the call.
+	CommandTimeout time.Duration
+	// Uploader posts the transactions. Nil means the arkb CLI, run with the wallet of the driver.
+	Uploader ArweaveUploader
+
+	files     map[string]string
+	filesLock sync.Mutex
+}
+
+// ArweaveUploader posts data transactions to Arweave on behalf of the Arweave driver
+type ArweaveUploader interface {
+	// Upload posts the file at filePath as a data transaction with the given Content-Type tag and
+	// returns the id of the transaction
+	Upload(ctx context.Context, filePath, contentType string) (string, error)
+}
+
+var _ OSSession = (*ArweaveSession)(nil)
+
+type ArweaveSession struct {
+	os *ArweaveOS
+}
+
+// NewArweaveDriver creates the driver posting the transactions signed with the JWK wallet file at
+// walletPath. The names of the saved files are prefixed with prefix in the published manifest.
+// Empty gatewayURL means https://arweave.net.
+func NewArweaveDriver(walletPath, prefix, gatewayURL string) *ArweaveOS {
+	return &ArweaveOS{
+		walletPath: walletPath,
+		prefix:     strings.Trim(prefix, "/"),
+		gatewayURL: strings.TrimSuffix(gatewayURL, "/"),
+		files:      map[string]string{},
+	}
+}
+
+func (ostore *ArweaveOS) NewSession(filename string) OSSession {
+	if filename != "" {
+		return nil
+	}
+	return &ArweaveSession{os: ostore}
+}
+
+func (ostore *ArweaveOS) UriSchemes() []string {
+	return []string{"ar"}
+}
+
+func (ostore *ArweaveOS) Description() string {
+	return "Arweave permanent storage driver."
+}
+
+// Publish posts the path manifest of the files saved since the last Publish and returns its ar://
+// URL. The files can be read from the gateways under the manifest transaction, e.g.
+// https://arweave.net/<manifest id>/<prefix>/<name>.
+func (ostore *ArweaveOS) Publish(ctx context.Context) (string, error) {
+	ostore.filesLock.Lock()
+	defer ostore.filesLock.Unlock()
+	if len(ostore.files) == 0 {
+		return "", errors.New("no files saved to publish")
+	}
+	paths := map[string]map[string]string{}
+	for name, txID := range ostore.files {
+		paths[name] = map[string]string{"id": txID}
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"manifest": "arweave/paths",
+		"version":  "0.1.0",
+		"paths":    paths,
+	})
+	if err != nil {
+		return "", err
+	}
+	filePath, err := toFile(bytes.NewReader(manifest))
+	if err != nil {
+		return "", err
+	}
+	defer deleteFile(filePath)
+	txID, err := ostore.uploader().Upload(ctx, filePath, arweaveManifestContentType)
+	if err != nil {
+		return "", err
+	}
+	ostore.files = map[string]string{}
+	return "ar://" + txID, nil
+}
+
+// HealthCheck checks that the wallet file is readable and the gateway is reachable
+func (ostore *ArweaveOS) HealthCheck(ctx context.Context) error {
+	if _, err := os.Stat(ostore.walletPath); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("wallet %s: %w", ostore.walletPath, ErrNotExist)
+	} else if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", ostore.gateway()+"/info", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return healthCheckError("arweave gateway", 0, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return healthCheckError("arweave gateway", resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status))
+	}
+	return nil
+}
+
+// Shutdown drops the files which were not published yet
+func (ostore *ArweaveOS) Shutdown(ctx context.Context) error {
+	ostore.filesLock.Lock()
+	if len(ostore.files) > 0 {
+		Log.Infof("Dropping unpublished Arweave files files=%d", len(ostore.files))
+	}
+	ostore.files = map[string]string{}
+	ostore.filesLock.Unlock()
+	return nil
+}
+
+func (ostore *ArweaveOS) gateway() string {
+	if ostore.gatewayURL == "" {
+		return arweaveGatewayURL
+	}
+	return ostore.gatewayURL
+}
+
+func (ostore *ArweaveOS) uploader() ArweaveUploader {
+	if ostore.Uploader != nil {
+		return ostore.Uploader
+	}
+	return arkbCLI{os: ostore}
+}
+
+// arkbCLI is the default ArweaveUploader running the arkb CLI
+type arkbCLI struct {
+	os *ArweaveOS
+}
+
+func (cli arkbCLI) Upload(ctx context.Context, filePath, contentType string) (string, error) {
+	ctx, cancel := commandContext(ctx, cli.os.CommandTimeout)
+	defer cancel()
+	args := []string{"deploy", filePath, "--wallet", cli.os.walletPath, "--gateway", cli.os.gateway(),
+		"--content-type", contentType, "--auto-confirm", "--no-bundle", "--no-colors"}
+	out, err := exec.CommandContext(ctx, "arkb", args...).CombinedOutput()
+	if err != nil {
+		return "", commandError(ctx, "arkb deploy", out, err)
+	}
+	return parseArweaveTxID(out)
+}
+
+// parseArweaveTxID finds the id of the posted transaction in the output of 'arkb deploy', which
+// prints it as the last path segment of the gateway URL of the file
+func parseArweaveTxID(out []byte) (string, error) {
+	words := strings.Fields(string(out))
+	for i := len(words) - 1; i >= 0; i-- {
+		word := strings.TrimRight(words[i], "/.")
+		if txID := word[strings.LastIndex(word, "/")+1:]; arweaveTxID.MatchString(txID) {
+			return txID, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find transaction id in the output: %s", string(out))
+}
+
+func (session *ArweaveSession) OS() OSDriver {
+	return session.os
+}
+
+func (session *ArweaveSession) EndSession() {
+	// no op
+}
+
+// SaveData posts the data as a transaction and returns its ar:// URL. The file is added to the
+// manifest posted by Publish under its name.
+func (session *ArweaveSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("arweave", time.Now(), counter, &err)
+	ctx, cancel := withSaveTimeout(ctx, timeout, arweaveDefaultSaveTimeout)
+	defer cancel()
+
+	data, _ = withMaxBytes(data, fields)
+	data, contentType, err := peekContentType(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if fields != nil && fields.ContentType != "" {
+		contentType = fields.ContentType
+	}
+	data, checksum := withChecksum(data)
+	filePath, err := toFile(data)
+	if err != nil {
+		return nil, err
+	}
+	defer deleteFile(filePath)
+
+	txID, err := session.os.uploader().Upload(ctx, filePath, contentType)
+	if err != nil {
+		return nil, err
+	}
+	session.os.filesLock.Lock()
+	session.os.files[path.Join(session.os.prefix, name)] = txID
+	session.os.filesLock.Unlock()
+	return &SaveDataOutput{
+		URL:               "ar://" + txID,
+		Checksum:          checksum(),
+		ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+	}, nil
+}
+
+// ReadData reads the data of the transaction from the gateway. The name is the transaction id, or
+// the ar:// URL returned by SaveData.
+func (session *ArweaveSession) ReadData(ctx context.Context, name string) (res *FileInfoReader, err error) {
+	defer recordRead("arweave", time.Now(), &res, &err)
+	return session.readData(ctx, name, "")
+}
+
+func (session *ArweaveSession) ReadDataRange(ctx context.Context, name, byteRange string) (res *FileInfoReader, err error) {
+	defer recordRead("arweave", time.Now(), &res, &err)
+	return session.readData(ctx, name, byteRange)
+}
+
+func (session *ArweaveSession) readData(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	txID := strings.TrimPrefix(name, "ar://")
+	req, err := http.NewRequestWithContext(ctx, "GET", session.os.gateway()+"/"+txID, nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotExist
+	} else if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to read Arweave transaction: %s", resp.Status)
+	}
+	res := &FileInfoReader{
+		FileInfo:      FileInfo{Name: name},
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentRange:  resp.Header.Get("Content-Range"),
+		ContentLength: resp.ContentLength,
+		Body:          resp.Body,
+	}
+	if size, ok := contentRangeSize(res.ContentRange); ok {
+		res.Size = &size
+	} else if res.ContentRange == "" && resp.ContentLength >= 0 {
+		res.Size = &resp.ContentLength
+	}
+	return res, nil
+}
+
+func (session *ArweaveSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (session *ArweaveSession) DeleteFile(ctx context.Context, name string) error {
+	return ErrNotSupported
+}
+
+func (session *ArweaveSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (session *ArweaveSession) Rename(ctx context.Context, oldName, newName string) error {
+	return ErrNotSupported
+}
+
+func (session *ArweaveSession) Presign(name string, expire time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (session *ArweaveSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+// PublicURL returns the URL of a transaction id returned by SaveData
+func (session *ArweaveSession) PublicURL(name string) (string, error) {
+	return "ar://" + strings.TrimPrefix(name, "ar://"), nil
+}
+
+func (session *ArweaveSession) ObjectURI(name string) (string, error) {
+	return "", ErrNotSupported
+}
+
+// ReadSeeker reads the ranges of the file from the gateway
+func (session *ArweaveSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return newRangeReadSeeker(ctx, session, name)
+}
+
+func (session *ArweaveSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, session, name, srcPath, fields)
+}
+
+func (session *ArweaveSession) IsExternal() bool {
+	return false
+}
+
+func (session *ArweaveSession) IsOwn(url string) bool {
+	return strings.HasPrefix(url, "ar://")
+}
+
+func (session *ArweaveSession) GetInfo() *OSInfo {
+	return nil
+}
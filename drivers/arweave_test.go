@@ -0,0 +1,162 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	arweaveTx1 = "bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U"
+	arweaveTx2 = "hKMMPNh_emBf8v_at1tFzNYACisyMQNcKzeeE1QE9p8"
+)
+
+type fakeArweaveUploader struct {
+	uploads      map[string][]byte
+	contentTypes []string
+}
+
+func (u *fakeArweaveUploader) Upload(ctx context.Context, filePath, contentType string) (string, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	txID := arweaveTx1
+	if len(u.uploads) > 0 {
+		txID = arweaveTx2
+	}
+	u.uploads[txID] = data
+	u.contentTypes = append(u.contentTypes, contentType)
+	return txID, nil
+}
+
+func TestArweaveSaveAndPublish(t *testing.T) {
+	require := require.New(t)
+	uploader := &fakeArweaveUploader{uploads: map[string][]byte{}}
+	drv := NewArweaveDriver("wallet.json", "/video/hls/", "")
+	drv.Uploader = uploader
+	sess := drv.NewSession("")
+
+	out, err := sess.SaveData(context.Background(), "index.m3u8", strings.NewReader("#EXTM3U"), nil, 0)
+	require.NoError(err)
+	require.Equal("ar://"+arweaveTx1, out.URL)
+	require.NotEmpty(out.Checksum)
+	require.Equal([]byte("#EXTM3U"), uploader.uploads[arweaveTx1])
+
+	url, err := drv.Publish(context.Background())
+	require.NoError(err)
+	require.Equal("ar://"+arweaveTx2, url)
+	require.Equal([]string{"application/x-mpegurl", arweaveManifestContentType}, uploader.contentTypes)
+	var manifest struct {
+		Manifest string
+		Paths    map[string]map[string]string
+	}
+	require.NoError(json.Unmarshal(uploader.uploads[arweaveTx2], &manifest))
+	require.Equal("arweave/paths", manifest.Manifest)
+	require.Equal(map[string]map[string]string{"video/hls/index.m3u8": {"id": arweaveTx1}}, manifest.Paths)
+
+	// the published files are not published again
+	_, err = drv.Publish(context.Background())
+	require.Error(err)
+
+	_, err = sess.ListFiles(context.Background(), "", "")
+	require.ErrorIs(err, ErrNotSupported)
+	require.ErrorIs(sess.DeleteFile(context.Background(), arweaveTx1), ErrNotSupported)
+}
+
+func TestArweaveArkbUploader(t *testing.T) {
+	require := require.New(t)
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	args := filepath.Join(t.TempDir(), "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\necho 'Uploading...'\necho 'https://arweave.example.com/%s'\n", args, arweaveTx1)
+	require.NoError(os.WriteFile(filepath.Join(bin, "arkb"), []byte(script), 0755))
+
+	drv := NewArweaveDriver("/keys/wallet.json", "", "https://arweave.example.com/")
+	out, err := drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal("ar://"+arweaveTx1, out.URL)
+	called, err := os.ReadFile(args)
+	require.NoError(err)
+	require.Contains(string(called), "--wallet /keys/wallet.json --gateway https://arweave.example.com --content-type video/mp2t")
+
+	require.NoError(os.WriteFile(filepath.Join(bin, "arkb"), []byte("#!/bin/sh\necho 'Insufficient balance'\nexit 1\n"), 0755))
+	_, err = drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "Insufficient balance")
+}
+
+func TestArweaveReadData(t *testing.T) {
+	require := require.New(t)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/info" {
+			fmt.Fprint(w, `{"network":"arweave.N.1"}`)
+			return
+		}
+		if r.URL.Path != "/"+arweaveTx1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("segment"))
+	}))
+	defer gateway.Close()
+	wallet := filepath.Join(t.TempDir(), "wallet.json")
+	require.NoError(os.WriteFile(wallet, []byte("{}"), 0600))
+	drv := NewArweaveDriver(wallet, "", gateway.URL)
+	sess := drv.NewSession("")
+
+	res, err := sess.ReadData(context.Background(), "ar://"+arweaveTx1)
+	require.NoError(err)
+	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal("video/mp2t", res.ContentType)
+
+	res, err = sess.ReadDataRange(context.Background(), arweaveTx1, "bytes=1-3")
+	require.NoError(err)
+	data, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	require.Equal("egm", string(data))
+	require.Equal(int64(7), *res.Size)
+
+	_, err = sess.ReadData(context.Background(), arweaveTx2)
+	require.ErrorIs(err, ErrNotExist)
+
+	require.NoError(drv.HealthCheck(context.Background()))
+	require.ErrorIs(NewArweaveDriver("missing.json", "", gateway.URL).HealthCheck(context.Background()), ErrNotExist)
+}
+
+func TestArweaveURL(t *testing.T) {
+	require := require.New(t)
+	driver, err := ParseOSURL("ar://%2Fkeys%2Fwallet.json@/video/hls?gateway=https://ar-io.dev", false)
+	require.NoError(err)
+	drv, ok := driver.(*ArweaveOS)
+	require.True(ok)
+	require.Equal("/keys/wallet.json", drv.walletPath)
+	require.Equal("video/hls", drv.prefix)
+	require.Equal("https://ar-io.dev", drv.gateway())
+
+	_, err = ParseOSURL("ar:///video/hls", false)
+	require.Error(err)
+}
+
+func TestParseArweaveTxID(t *testing.T) {
+	require := require.New(t)
+	txID, err := parseArweaveTxID([]byte("ID: " + arweaveTx1 + "\nFiles deployed! Visit https://arweave.net/" + arweaveTx2 + " to access.\n"))
+	require.NoError(err)
+	require.Equal(arweaveTx2, txID)
+	_, err = parseArweaveTxID([]byte("Insufficient balance"))
+	require.Error(err)
+}
@@ -0,0 +1,405 @@
+package drivers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/livepeer/go-tools/clients"
+)
+
+const (
+	// b2ListPageSize is the number of files requested per b2_list_file_names call
+	b2ListPageSize = 1000
+	// b2MaxPresignDuration is the longest validity B2 accepts for download authorizations
+	b2MaxPresignDuration = 7 * 24 * time.Hour
+)
+
+var _ OSSession = (*b2Session)(nil)
+
+// B2OS is the Backblaze B2 driver using the native B2 API. The application key must have access to
+// the bucket. Files are uploaded with a single request, so the size of a file is limited to 5GB.
+type B2OS struct {
+	bucket    string
+	keyPrefix string
+	keyID     string
+	appKey    string
+	client    *clients.B2Client
+}
+
+type b2Session struct {
+	os     *B2OS
+	bucket string
+	key    string
+	client *clients.B2Client
+}
+
+func NewB2Driver(keyID, appKey, bucket, keyPrefix string) *B2OS {
+	client := clients.NewB2Client(keyID, appKey)
+	client.HTTPClient = httpClient()
+	return &B2OS{
+		bucket:    bucket,
+		keyPrefix: keyPrefix,
+		keyID:     keyID,
+		appKey:    appKey,
+		client:    client,
+	}
+}
+
+func (ostore *B2OS) NewSession(path string) OSSession {
+	return &b2Session{
+		os:     ostore,
+		bucket: ostore.bucket,
+		key:    ostore.keyPrefix + path,
+		client: ostore.client,
+	}
+}
+
+func (ostore *B2OS) UriSchemes() []string {
+	return []string{"b2"}
+}
+
+func (ostore *B2OS) Description() string {
+	return "Backblaze B2 storage."
+}
+
+func (ostore *B2OS) Publish(ctx context.Context) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (ostore *B2OS) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// HealthCheck checks that B2 accepts the application key and the bucket exists
+func (ostore *B2OS) HealthCheck(ctx context.Context) error {
+	_, err := ostore.client.BucketID(ctx, ostore.bucket)
+	if err == nil {
+		return nil
+	}
+	target := "b2 bucket " + ostore.bucket
+	if errors.Is(err, clients.ErrB2BucketNotFound) {
+		return fmt.Errorf("%s: %w", target, ErrNotExist)
+	}
+	status := 0
+	var statusErr *clients.HTTPStatusError
+	if errors.As(err, &statusErr) {
+		status = statusErr.Status
+	}
+	return healthCheckError(target, status, err)
+}
+
+// String describes the driver with the application key masked, so it's safe to log
+func (ostore *B2OS) String() string {
+	return fmt.Sprintf("B2OS{bucket: %s, keyPrefix: %s, keyID: %s, appKey: %s}",
+		ostore.bucket, ostore.keyPrefix, ostore.keyID, redactSecret(ostore.appKey))
+}
+
+func (session *b2Session) OS() OSDriver {
+	return session.os
+}
+
+func (session *b2Session) IsExternal() bool {
+	return true
+}
+
+func (session *b2Session) EndSession() {
+}
+
+func (session *b2Session) GetInfo() *OSInfo {
+	return nil
+}
+
+func (session *b2Session) IsOwn(url string) bool {
+	return strings.Contains(url, "/file/"+session.bucket+"/")
+}
+
+// fullName returns the name of the file in the bucket
+// TODO: Remove the compat once legacy clients stop sending the full path
+func (session *b2Session) fullName(name string) string {
+	if session.key != "" && !strings.HasPrefix(name, session.key+"/") {
+		return objectKey(session.key, name)
+	}
+	return objectKey("", name)
+}
+
+type b2PageInfo struct {
+	files       []FileInfo
+	directories []string
+	ctx         context.Context
+	client      *clients.B2Client
+	bucketID    string
+	prefix      string
+	delim       string
+	nextName    string
+}
+
+func (b2pi *b2PageInfo) Files() []FileInfo {
+	return b2pi.files
+}
+func (b2pi *b2PageInfo) Directories() []string {
+	return b2pi.directories
+}
+func (b2pi *b2PageInfo) HasNextPage() bool {
+	return b2pi.nextName != ""
+}
+func (b2pi *b2PageInfo) NextPage() (PageInfo, error) {
+	if b2pi.nextName == "" {
+		return nil, ErrNoNextPage
+	}
+	next := &b2PageInfo{
+		ctx:      b2pi.ctx,
+		client:   b2pi.client,
+		bucketID: b2pi.bucketID,
+		prefix:   b2pi.prefix,
+		delim:    b2pi.delim,
+	}
+	if err := next.listFiles(b2pi.nextName); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (b2pi *b2PageInfo) listFiles(startFileName string) error {
+	files, nextName, err := b2pi.client.ListFileNames(b2pi.ctx, b2pi.bucketID, b2pi.prefix, b2pi.delim, startFileName, b2ListPageSize)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Action == "folder" {
+			b2pi.directories = append(b2pi.directories, f.FileName)
+			continue
+		}
+		b2pi.files = append(b2pi.files, FileInfo{
+			Name:         f.FileName,
+			ETag:         f.ContentSha1,
+			LastModified: time.UnixMilli(f.UploadTimestamp),
+			Size:         &f.ContentLength,
+		})
+	}
+	b2pi.nextName = nextName
+	return nil
+}
+
+func (session *b2Session) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	bucketID, err := session.client.BucketID(ctx, session.bucket)
+	if err != nil {
+		return nil, err
+	}
+	pi := &b2PageInfo{
+		ctx:      ctx,
+		client:   session.client,
+		bucketID: bucketID,
+		prefix:   listingPrefix(session.fullName(prefix), prefix),
+		delim:    delim,
+	}
+	if err := pi.listFiles(""); err != nil {
+		return nil, err
+	}
+	return pi, nil
+}
+
+func (session *b2Session) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return session.ReadDataRange(ctx, name, "")
+}
+
+func (session *b2Session) ReadDataRange(ctx context.Context, name, byteRange string) (res *FileInfoReader, err error) {
+	defer recordRead("b2", time.Now(), &res, &err)
+	name = session.fullName(name)
+	resp, err := session.client.DownloadFile(ctx, session.bucket, name, byteRange)
+	var statusErr *clients.HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.Status == http.StatusNotFound {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	res = &FileInfoReader{
+		FileInfo: FileInfo{
+			Name:         name,
+			ETag:         resp.Header.Get("X-Bz-Content-Sha1"),
+			LastModified: clients.B2UploadTime(resp.Header),
+		},
+		Body:         resp.Body,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ContentRange: resp.Header.Get("Content-Range"),
+		Metadata:     clients.B2FileInfo(resp.Header),
+	}
+	if resp.ContentLength >= 0 {
+		size := resp.ContentLength
+		res.Size = &size
+		res.ContentLength = resp.ContentLength
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		res.Size = nil
+		if size, ok := contentRangeSize(res.ContentRange); ok {
+			res.Size = &size
+		}
+	} else {
+		res.ContentRange = ""
+	}
+	return res, nil
+}
+
+func (session *b2Session) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("b2", time.Now(), counter, &err)
+	bucketID, err := session.client.BucketID(ctx, session.bucket)
+	if err != nil {
+		return nil, err
+	}
+	fileName := objectKey(session.key, name)
+	data, contentType, err := peekContentType(name, data)
+	if err != nil {
+		return nil, err
+	}
+	var info map[string]string
+	if fields != nil {
+		if fields.ContentType != "" {
+			contentType = fields.ContentType
+		}
+		info = make(map[string]string, len(fields.Metadata)+1)
+		for k, v := range fields.Metadata {
+			info[k] = v
+		}
+		if fields.CacheControl != "" {
+			info["b2-cache-control"] = fields.CacheControl
+		}
+	}
+
+	// B2 needs the size and SHA1 of the data before the upload starts, so spool it to disk first
+	file, err := os.CreateTemp(TempDir, "b2-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	hash := sha1.New()
+	data, _ = withMaxBytes(data, fields)
+	body, checksum := withChecksum(data)
+	size, err := io.Copy(io.MultiWriter(file, hash), body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withSaveTimeout(ctx, timeout, defaultSaveTimeout)
+	defer cancel()
+	_, err = session.client.UploadFile(ctx, bucketID, fileName, contentType, info, file, size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return nil, err
+	}
+	url, err := session.client.DownloadURL(ctx, session.bucket, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &SaveDataOutput{
+		URL:               url,
+		Checksum:          checksum(),
+		ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+	}, nil
+}
+
+func (session *b2Session) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return listedPrefixSize(ctx, session, prefix)
+}
+
+func (session *b2Session) Rename(ctx context.Context, oldName, newName string) error {
+	return ErrNotSupported
+}
+
+// DeleteFile deletes all the versions of the file
+func (session *b2Session) DeleteFile(ctx context.Context, name string) (err error) {
+	defer recordDelete("b2", time.Now(), &err)
+	bucketID, err := session.client.BucketID(ctx, session.bucket)
+	if err != nil {
+		return err
+	}
+	name = session.fullName(name)
+	deleted := 0
+	startName, startID := name, ""
+	for {
+		files, nextName, nextID, err := session.client.ListFileVersions(ctx, bucketID, name, startName, startID, b2ListPageSize)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.FileName != name {
+				continue
+			}
+			if err := session.client.DeleteFileVersion(ctx, f.FileName, f.FileID); err != nil {
+				return err
+			}
+			deleted++
+		}
+		if nextName != name {
+			break
+		}
+		startName, startID = nextName, nextID
+	}
+	if deleted == 0 {
+		return ErrNotExist
+	}
+	return nil
+}
+
+// Presign returns a download URL carrying a B2 download authorization token for the file
+func (session *b2Session) Presign(name string, expire time.Duration) (string, error) {
+	if expire > b2MaxPresignDuration {
+		expire = b2MaxPresignDuration
+	}
+	if expire < time.Second {
+		expire = time.Second
+	}
+	ctx := context.Background()
+	bucketID, err := session.client.BucketID(ctx, session.bucket)
+	if err != nil {
+		return "", err
+	}
+	fileName := objectKey(session.key, name)
+	token, err := session.client.GetDownloadAuthorization(ctx, bucketID, fileName, expire)
+	if err != nil {
+		return "", err
+	}
+	url, err := session.client.DownloadURL(ctx, session.bucket, fileName)
+	if err != nil {
+		return "", err
+	}
+	return url + "?Authorization=" + token, nil
+}
+
+func (session *b2Session) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (session *b2Session) PublicURL(name string) (string, error) {
+	return session.client.DownloadURL(context.Background(), session.bucket, objectKey(session.key, name))
+}
+
+// ObjectURI returns the OS URL of the bucket with the key of the file as the key prefix
+func (session *b2Session) ObjectURI(name string) (string, error) {
+	u := &url.URL{
+		Scheme: "b2",
+		User:   url.UserPassword(session.os.keyID, session.os.appKey),
+		Host:   session.bucket,
+		Path:   "/" + objectKey(session.key, name),
+	}
+	return u.String(), nil
+}
+
+func (session *b2Session) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return newRangeReadSeeker(ctx, session, name)
+}
+
+func (session *b2Session) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, session, name, srcPath, fields)
+}
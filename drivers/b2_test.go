@@ -0,0 +1,204 @@
+package drivers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type b2StubFile struct {
+	id          string
+	data        []byte
+	contentType string
+	info        map[string]string
+}
+
+// b2Stub is a minimal in-memory implementation of the B2 API endpoints used by the driver
+type b2Stub struct {
+	mu     sync.Mutex
+	files  map[string]*b2StubFile
+	nextID int
+	srv    *httptest.Server
+}
+
+func newB2Stub(t *testing.T) *b2Stub {
+	stub := &b2Stub{files: map[string]*b2StubFile{}}
+	stub.srv = httptest.NewServer(http.HandlerFunc(stub.handle))
+	t.Cleanup(stub.srv.Close)
+	return stub
+}
+
+func (stub *b2Stub) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (stub *b2Stub) handle(w http.ResponseWriter, r *http.Request) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	var input map[string]interface{}
+	if r.Method == "POST" && r.Header.Get("Content-Type") == "application/json" {
+		json.NewDecoder(r.Body).Decode(&input)
+	}
+	switch {
+	case r.URL.Path == "/b2api/v2/b2_authorize_account":
+		user, pass, _ := r.BasicAuth()
+		if user != "keyid" || pass != "appkey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		stub.writeJSON(w, map[string]string{
+			"accountId":          "account",
+			"authorizationToken": "token",
+			"apiUrl":             stub.srv.URL,
+			"downloadUrl":        stub.srv.URL,
+		})
+	case r.Header.Get("Authorization") != "token":
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.URL.Path == "/b2api/v2/b2_list_buckets":
+		stub.writeJSON(w, map[string]interface{}{
+			"buckets": []map[string]string{{"bucketId": "bucket-id", "bucketName": "bucket"}},
+		})
+	case r.URL.Path == "/b2api/v2/b2_get_upload_url":
+		stub.writeJSON(w, map[string]string{"uploadUrl": stub.srv.URL + "/upload", "authorizationToken": "token"})
+	case r.URL.Path == "/upload":
+		data, _ := io.ReadAll(r.Body)
+		sum := sha1.Sum(data)
+		if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name, _ := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+		info := map[string]string{}
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Bz-Info-") {
+				info[k] = r.Header.Get(k)
+			}
+		}
+		stub.nextID++
+		id := fmt.Sprintf("id-%d", stub.nextID)
+		stub.files[name] = &b2StubFile{id: id, data: data, contentType: r.Header.Get("Content-Type"), info: info}
+		stub.writeJSON(w, map[string]string{"fileId": id, "fileName": name})
+	case strings.HasPrefix(r.URL.Path, "/file/bucket/"):
+		f, ok := stub.files[strings.TrimPrefix(r.URL.Path, "/file/bucket/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.contentType)
+		w.Header().Set("X-Bz-Upload-Timestamp", "1700000000000")
+		for k, v := range f.info {
+			w.Header().Set(k, v)
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(f.data)))
+	case r.URL.Path == "/b2api/v2/b2_list_file_names" || r.URL.Path == "/b2api/v2/b2_list_file_versions":
+		prefix, _ := input["prefix"].(string)
+		var files []map[string]interface{}
+		for name, f := range stub.files {
+			if strings.HasPrefix(name, prefix) {
+				files = append(files, map[string]interface{}{
+					"fileId": f.id, "fileName": name, "action": "upload", "contentLength": len(f.data),
+				})
+			}
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i]["fileName"].(string) < files[j]["fileName"].(string) })
+		stub.writeJSON(w, map[string]interface{}{"files": files})
+	case r.URL.Path == "/b2api/v2/b2_delete_file_version":
+		name := input["fileName"].(string)
+		if f, ok := stub.files[name]; !ok || f.id != input["fileId"] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(stub.files, name)
+		stub.writeJSON(w, input)
+	case r.URL.Path == "/b2api/v2/b2_get_download_authorization":
+		stub.writeJSON(w, map[string]string{"authorizationToken": "download-" + input["fileNamePrefix"].(string)})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestB2OS(stub *b2Stub) *B2OS {
+	os := NewB2Driver("keyid", "appkey", "bucket", "prefix/")
+	os.client.AuthorizeURL = stub.srv.URL + "/b2api/v2/b2_authorize_account"
+	return os
+}
+
+func TestB2SaveReadDelete(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+	stub := newB2Stub(t)
+	sess := newTestB2OS(stub).NewSession("sess")
+
+	props := &FileProperties{ContentType: "video/mp2t", Metadata: map[string]string{"foo": "bar baz"}}
+	out, err := sess.SaveData(ctx, "dir/1.ts", strings.NewReader("segment data"), props, 0)
+	require.NoError(err)
+	assert.Equal(stub.srv.URL+"/file/bucket/prefix/sess/dir/1.ts", out.URL)
+	assert.Equal(ChecksumAlgorithmSHA256, out.ChecksumAlgorithm)
+	assert.True(sess.IsOwn(out.URL))
+
+	fi, err := sess.ReadData(ctx, "dir/1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	fi.Body.Close()
+	assert.NoError(err)
+	assert.Equal("segment data", string(data))
+	assert.Equal("prefix/sess/dir/1.ts", fi.Name)
+	assert.Equal("video/mp2t", fi.ContentType)
+	assert.Equal(map[string]string{"foo": "bar baz"}, fi.Metadata)
+	assert.Equal(int64(12), *fi.Size)
+	assert.Equal(time.UnixMilli(1700000000000), fi.LastModified)
+
+	fi, err = sess.ReadDataRange(ctx, "dir/1.ts", "bytes=0-6")
+	require.NoError(err)
+	data, _ = io.ReadAll(fi.Body)
+	fi.Body.Close()
+	assert.Equal("segment", string(data))
+	assert.Equal("bytes 0-6/12", fi.ContentRange)
+	assert.Equal(int64(12), *fi.Size)
+	assert.Equal(int64(7), fi.ContentLength)
+
+	pi, err := sess.ListFiles(ctx, "dir/", "/")
+	require.NoError(err)
+	assert.False(pi.HasNextPage())
+	require.Len(pi.Files(), 1)
+	assert.Equal("prefix/sess/dir/1.ts", pi.Files()[0].Name)
+
+	presigned, err := sess.Presign("dir/1.ts", time.Hour)
+	assert.NoError(err)
+	assert.Equal(stub.srv.URL+"/file/bucket/prefix/sess/dir/1.ts?Authorization=download-prefix/sess/dir/1.ts", presigned)
+
+	assert.NoError(sess.DeleteFile(ctx, "dir/1.ts"))
+	_, err = sess.ReadData(ctx, "dir/1.ts")
+	assert.ErrorIs(err, ErrNotExist)
+	assert.ErrorIs(sess.DeleteFile(ctx, "dir/1.ts"), ErrNotExist)
+}
+
+func TestB2HealthCheck(t *testing.T) {
+	require := require.New(t)
+	stub := newB2Stub(t)
+	require.NoError(newTestB2OS(stub).HealthCheck(context.Background()))
+
+	missing := NewB2Driver("keyid", "appkey", "missing", "")
+	missing.client.AuthorizeURL = stub.srv.URL + "/b2api/v2/b2_authorize_account"
+	require.ErrorIs(missing.HealthCheck(context.Background()), ErrNotExist)
+
+	badKey := NewB2Driver("keyid", "wrong", "bucket", "")
+	badKey.client.AuthorizeURL = stub.srv.URL + "/b2api/v2/b2_authorize_account"
+	require.ErrorIs(badKey.HealthCheck(context.Background()), ErrUnauthorized)
+}
@@ -0,0 +1,183 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrSessionClosed is returned by the SaveData of a BufferingSession after its Close
+var ErrSessionClosed = fmt.Errorf("the session is closed")
+
+// BufferingSession makes SaveData return as soon as the data is buffered in memory, saving the
+// files to the wrapped session in the background, concurrently. The saves of the same file are
+// done in order, and a save still waiting for the previous one of the same file is replaced by a
+// newer one, so bursts of rewrites like playlist updates cost a single request.
+//
+// The returned SaveDataOutput only has the PublicURL and checksum of the file, as the wrapped
+// session may not have saved it yet. The errors of the background saves are returned by the next
+// SaveData, Flush or Close. Reads go to the wrapped session, so they only see the files once
+// flushed.
+type BufferingSession struct {
+	OSSession
+	maxInFlightBytes int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// files are the files being saved, with the next save of each
+	files         map[string]*bufferedFile
+	inFlightBytes int64
+	err           error
+	failed        int
+	closed        bool
+}
+
+type bufferedFile struct {
+	next *bufferedSave
+}
+
+type bufferedSave struct {
+	name    string
+	data    []byte
+	fields  *FileProperties
+	timeout time.Duration
+}
+
+var _ OSSession = (*BufferingSession)(nil)
+
+// NewBufferingSession wraps the session to save the files in the background, holding up to
+// maxInFlightBytes of buffered data. SaveData blocks while the limit is reached, unless nothing
+// else is in flight.
+func NewBufferingSession(inner OSSession, maxInFlightBytes int64) *BufferingSession {
+	bs := &BufferingSession{
+		OSSession:        inner,
+		maxInFlightBytes: maxInFlightBytes,
+		files:            make(map[string]*bufferedFile),
+	}
+	bs.cond = sync.NewCond(&bs.mu)
+	return bs
+}
+
+func (bs *BufferingSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	if err := bs.takeErr(); err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	save := &bufferedSave{name: name, data: buf, fields: fields, timeout: timeout}
+
+	bs.mu.Lock()
+	for !bs.closed && bs.inFlightBytes > 0 && bs.inFlightBytes+int64(len(buf)) > bs.maxInFlightBytes {
+		bs.cond.Wait()
+	}
+	if bs.closed {
+		bs.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	bs.inFlightBytes += int64(len(buf))
+	if file, ok := bs.files[name]; ok {
+		if file.next != nil {
+			// the waiting save is superseded before it started
+			bs.inFlightBytes -= int64(len(file.next.data))
+		}
+		file.next = save
+	} else {
+		bs.files[name] = &bufferedFile{}
+		go bs.flush(save)
+	}
+	bs.mu.Unlock()
+
+	out := &SaveDataOutput{ChecksumAlgorithm: ChecksumAlgorithmSHA256}
+	if url, err := bs.OSSession.PublicURL(name); err == nil {
+		out.URL = url
+	}
+	sum := sha256.Sum256(buf)
+	out.Checksum = hex.EncodeToString(sum[:])
+	return out, nil
+}
+
+func (bs *BufferingSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, bs, name, srcPath, fields)
+}
+
+// flush saves the file to the wrapped session, then its next saves queued meanwhile
+func (bs *BufferingSession) flush(save *bufferedSave) {
+	for save != nil {
+		_, err := bs.OSSession.SaveData(context.Background(), save.name, bytes.NewReader(save.data), save.fields, save.timeout)
+
+		bs.mu.Lock()
+		if err != nil {
+			if bs.err == nil {
+				bs.err = fmt.Errorf("failed to save %s: %w", save.name, err)
+			}
+			bs.failed++
+		}
+		bs.inFlightBytes -= int64(len(save.data))
+		name := save.name
+		save, bs.files[name].next = bs.files[name].next, nil
+		if save == nil {
+			delete(bs.files, name)
+		}
+		bs.cond.Broadcast()
+		bs.mu.Unlock()
+	}
+}
+
+// Flush waits for all the buffered files to be saved. Returns the errors of the saves failed
+// since the last error returned.
+func (bs *BufferingSession) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		bs.mu.Lock()
+		for len(bs.files) > 0 {
+			bs.cond.Wait()
+		}
+		bs.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return bs.takeErr()
+}
+
+// Close flushes the buffered files and makes the later SaveData calls fail with ErrSessionClosed
+func (bs *BufferingSession) Close(ctx context.Context) error {
+	bs.mu.Lock()
+	bs.closed = true
+	bs.cond.Broadcast()
+	bs.mu.Unlock()
+	return bs.Flush(ctx)
+}
+
+// EndSession flushes the buffered files before ending the wrapped session
+func (bs *BufferingSession) EndSession() {
+	_ = bs.Close(context.Background())
+	bs.OSSession.EndSession()
+}
+
+// takeErr returns the error of the first failed save and the number of failures since the last
+// call, resetting them
+func (bs *BufferingSession) takeErr() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	err, failed := bs.err, bs.failed
+	bs.err, bs.failed = nil, 0
+	if failed > 1 {
+		return fmt.Errorf("%d buffered saves failed, the first one: %w", failed, err)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gatedSession blocks the saves until the gate is opened, recording the saved data in order
+type gatedSession struct {
+	*FakeOSSession
+	gate  chan struct{}
+	mu    sync.Mutex
+	saved []string
+}
+
+func (s *gatedSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	<-s.gate
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.saved = append(s.saved, name+"="+string(buf))
+	s.mu.Unlock()
+	return s.FakeOSSession.SaveData(ctx, name, strings.NewReader(string(buf)), fields, timeout)
+}
+
+func TestBufferingSessionOrdering(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	inner := &gatedSession{FakeOSSession: NewFakeOSSession(), gate: make(chan struct{})}
+	sess := NewBufferingSession(inner, 1024)
+
+	for _, playlist := range []string{"v1", "v2", "v3"} {
+		out, err := sess.SaveData(ctx, "index.m3u8", strings.NewReader(playlist), nil, 0)
+		require.NoError(err)
+		require.Equal("fake://index.m3u8", out.URL)
+		require.NotEmpty(out.Checksum)
+	}
+	_, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+
+	close(inner.gate)
+	require.NoError(sess.Flush(ctx))
+	// v2 is superseded while waiting for v1 to be saved
+	require.Contains(inner.saved, "1.ts=segment")
+	require.Equal([]string{"index.m3u8=v1", "index.m3u8=v3"}, withPrefix(inner.saved, "index.m3u8"))
+	require.Equal(map[string][]byte{"index.m3u8": []byte("v3"), "1.ts": []byte("segment")}, inner.Files())
+
+	require.NoError(sess.Close(ctx))
+	_, err = sess.SaveData(ctx, "2.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorIs(err, ErrSessionClosed)
+}
+
+func withPrefix(list []string, prefix string) []string {
+	var res []string
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func TestBufferingSessionErrors(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	inner := NewFakeOSSession()
+	sess := NewBufferingSession(inner, 1024)
+	errFail := errors.New("injected failure")
+	inner.FailOn("1.ts", errFail)
+	inner.FailOn("2.ts", errFail)
+
+	_, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	err = sess.Flush(ctx)
+	require.ErrorIs(err, errFail)
+	require.ErrorContains(err, "1.ts")
+	require.NoError(sess.Flush(ctx))
+
+	// the failures are returned by the next call
+	_, err = sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	_, err = sess.SaveData(ctx, "2.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Eventually(func() bool {
+		_, err = sess.SaveData(ctx, "3.ts", strings.NewReader("segment"), nil, 0)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	require.ErrorIs(err, errFail)
+	require.ErrorContains(err, "2 buffered saves failed")
+
+	_, err = sess.SaveData(ctx, "3.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.NoError(sess.Close(ctx))
+	require.Equal([]byte("segment"), inner.Files()["3.ts"])
+}
+
+func TestBufferingSessionInFlightBytes(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	inner := &gatedSession{FakeOSSession: NewFakeOSSession(), gate: make(chan struct{})}
+	sess := NewBufferingSession(inner, 10)
+
+	_, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	saved := make(chan error)
+	go func() {
+		_, err := sess.SaveData(ctx, "2.ts", strings.NewReader("segment"), nil, 0)
+		saved <- err
+	}()
+	select {
+	case <-saved:
+		require.Fail("SaveData returned over the in-flight bytes limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(inner.gate)
+	require.NoError(<-saved)
+	require.NoError(sess.Flush(ctx))
+	require.Len(inner.Files(), 2)
+
+	// a cancelled flush returns without waiting
+	inner.gate = make(chan struct{})
+	_, err = sess.SaveData(ctx, "3.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(sess.Flush(cancelled), context.Canceled)
+	close(inner.gate)
+	require.NoError(sess.Flush(ctx))
+}
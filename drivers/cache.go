@@ -0,0 +1,163 @@
+package drivers
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// CachingSession caches the files read with ReadData from the wrapped session in memory, evicting
+// the least recently read ones when their total size would exceed the limit. Files saved, deleted
+// or renamed through the CachingSession are dropped from the cache, but changes made by other
+// sessions are not noticed, so it suits files which don't change once written, like init
+// segments, or which are only written through it. Ranges are read from the wrapped session.
+type CachingSession struct {
+	OSSession
+	maxBytes int64
+
+	mu    sync.Mutex
+	lru   *list.List
+	files map[string]*list.Element
+	size  int64
+	// version is incremented on each invalidation, for the reads started before it not to cache
+	// stale data
+	version uint64
+}
+
+type cachedFile struct {
+	name string
+	info FileInfoReader
+	data []byte
+}
+
+var _ OSSession = (*CachingSession)(nil)
+
+// NewCachingSession wraps the session to cache up to maxBytes of the files read with ReadData
+func NewCachingSession(inner OSSession, maxBytes int64) *CachingSession {
+	return &CachingSession{
+		OSSession: inner,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		files:     make(map[string]*list.Element),
+	}
+}
+
+func (cs *CachingSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	cs.mu.Lock()
+	if elem, ok := cs.files[name]; ok {
+		cs.lru.MoveToFront(elem)
+		cached := elem.Value.(*cachedFile)
+		cs.mu.Unlock()
+		res := cached.info
+		res.Metadata = copyMetadata(cached.info.Metadata)
+		res.Body = ioutil.NopCloser(bytes.NewReader(cached.data))
+		return &res, nil
+	}
+	version := cs.version
+	cs.mu.Unlock()
+
+	res, err := cs.OSSession.ReadData(ctx, name)
+	if err != nil || (res.Size != nil && *res.Size > cs.maxBytes) {
+		return res, err
+	}
+	// read one more byte than fits, to tell the files too big to cache without a known size
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, cs.maxBytes+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if int64(len(data)) > cs.maxBytes {
+		res.Body = &prefixedReadCloser{Reader: io.MultiReader(bytes.NewReader(data), res.Body), Closer: res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+	info := *res
+	info.Body = nil
+	info.Metadata = copyMetadata(res.Metadata)
+	cs.add(name, version, &cachedFile{name: name, info: info, data: data})
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return res, nil
+}
+
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// add caches the file unless the cache was invalidated since version, evicting the least recently
+// read files to make room for it
+func (cs *CachingSession) add(name string, version uint64, file *cachedFile) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.version != version {
+		return
+	}
+	if elem, ok := cs.files[name]; ok {
+		cs.remove(elem)
+	}
+	for cs.size+int64(len(file.data)) > cs.maxBytes && cs.lru.Len() > 0 {
+		cs.remove(cs.lru.Back())
+	}
+	cs.files[name] = cs.lru.PushFront(file)
+	cs.size += int64(len(file.data))
+}
+
+func (cs *CachingSession) remove(elem *list.Element) {
+	file := cs.lru.Remove(elem).(*cachedFile)
+	delete(cs.files, file.name)
+	cs.size -= int64(len(file.data))
+}
+
+// invalidate drops the files from the cache
+func (cs *CachingSession) invalidate(names ...string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.version++
+	for _, name := range names {
+		if elem, ok := cs.files[name]; ok {
+			cs.remove(elem)
+		}
+	}
+}
+
+func (cs *CachingSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	defer cs.invalidate(name)
+	return cs.OSSession.SaveData(ctx, name, data, fields, timeout)
+}
+
+func (cs *CachingSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	defer cs.invalidate(name)
+	return cs.OSSession.SaveFile(ctx, name, srcPath, fields)
+}
+
+func (cs *CachingSession) DeleteFile(ctx context.Context, name string) error {
+	defer cs.invalidate(name)
+	return cs.OSSession.DeleteFile(ctx, name)
+}
+
+func (cs *CachingSession) Rename(ctx context.Context, oldName, newName string) error {
+	defer cs.invalidate(oldName, newName)
+	return cs.OSSession.Rename(ctx, oldName, newName)
+}
+
+// CachedBytes returns the total size of the cached files
+func (cs *CachingSession) CachedBytes() int64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.size
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	return copied
+}
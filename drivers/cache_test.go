@@ -0,0 +1,103 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingSession counts the ReadData calls reaching the wrapped session
+type countingSession struct {
+	OSSession
+	reads int
+}
+
+func (s *countingSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	s.reads++
+	return s.OSSession.ReadData(ctx, name)
+}
+
+func TestCachingSession(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	inner := &countingSession{OSSession: NewFakeOSSession()}
+	sess := NewCachingSession(inner, 10)
+	read := func(name string) string {
+		data, _, err := ReadFile(ctx, sess, name)
+		require.NoError(err)
+		return string(data)
+	}
+	save := func(name, data string) {
+		_, err := sess.SaveData(ctx, name, strings.NewReader(data), nil, 0)
+		require.NoError(err)
+	}
+
+	save("init.mp4", "init")
+	require.Equal("init", read("init.mp4"))
+	require.Equal("init", read("init.mp4"))
+	require.Equal(1, inner.reads)
+	require.Equal(int64(4), sess.CachedBytes())
+
+	// saving the file drops it from the cache
+	save("init.mp4", "init2")
+	require.Equal("init2", read("init.mp4"))
+	require.Equal(2, inner.reads)
+
+	// the least recently read file is evicted
+	save("a.m3u8", "aaa")
+	save("b.m3u8", "bbb")
+	read("a.m3u8")
+	read("init.mp4")
+	read("b.m3u8")
+	require.Equal(4, inner.reads)
+	require.Equal(int64(8), sess.CachedBytes())
+	read("init.mp4")
+	read("b.m3u8")
+	require.Equal(4, inner.reads)
+	read("a.m3u8")
+	require.Equal(5, inner.reads)
+	read("b.m3u8")
+	require.Equal(5, inner.reads)
+	read("init.mp4")
+	require.Equal(6, inner.reads)
+
+	// files bigger than the cache are read through
+	save("big.ts", "0123456789abc")
+	require.Equal("0123456789abc", read("big.ts"))
+	require.Equal("0123456789abc", read("big.ts"))
+	require.Equal(8, inner.reads)
+
+	require.NoError(sess.DeleteFile(ctx, "a.m3u8"))
+	_, err := sess.ReadData(ctx, "a.m3u8")
+	require.ErrorIs(err, ErrNotExist)
+	require.NoError(sess.Rename(ctx, "b.m3u8", "c.m3u8"))
+	_, err = sess.ReadData(ctx, "b.m3u8")
+	require.ErrorIs(err, ErrNotExist)
+}
+
+func TestCachingSessionReadError(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	inner := NewFakeOSSession()
+	sess := NewCachingSession(inner, 100)
+	_, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+
+	errFail := errors.New("injected failure")
+	inner.FailOn("1.ts", errFail)
+	_, err = sess.ReadData(ctx, "1.ts")
+	require.ErrorIs(err, errFail)
+	require.Zero(sess.CachedBytes())
+
+	inner.FailOn("1.ts", nil)
+	res, err := sess.ReadData(ctx, "1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal(int64(7), sess.CachedBytes())
+}
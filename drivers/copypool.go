@@ -0,0 +1,85 @@
+package drivers
+
+import (
+	"context"
+)
+
+type copyResult struct {
+	index int
+	out   *SaveDataOutput
+	err   error
+}
+
+type copyTask struct {
+	src      OSSession
+	dst      OSSession
+	fileName string
+	index    int
+}
+
+func copyWorker(ctx context.Context, tasks chan *copyTask, resCh chan *copyResult) {
+	for task := range tasks {
+		res := &copyResult{
+			index: task.index,
+		}
+		if err := ctx.Err(); err != nil {
+			res.err = err
+		} else {
+			res.out, res.err = copyFile(ctx, task.src, task.dst, task.fileName)
+		}
+		resCh <- res
+	}
+}
+
+// copyFile streams a single file from src to dst, carrying over content type
+// and metadata reported by the source driver
+func copyFile(ctx context.Context, src, dst OSSession, name string) (*SaveDataOutput, error) {
+	fi, err := src.ReadData(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Body.Close()
+	var fields *FileProperties
+	if fi.ContentType != "" || len(fi.Metadata) > 0 {
+		fields = &FileProperties{
+			Metadata:    fi.Metadata,
+			ContentType: fi.ContentType,
+		}
+	}
+	return dst.SaveData(ctx, name, fi.Body, fields, 0)
+}
+
+// CopyFiles copies files from src session to dst session in parallel, using specified number of jobs.
+// Returned slices are indexed the same as filesNames: the output of each successful copy and the
+// error of each failed one.
+func CopyFiles(ctx context.Context, src, dst OSSession, filesNames []string, workers int) ([]*SaveDataOutput, []error) {
+	workersToStart := workers
+	if len(filesNames) < workers {
+		workersToStart = len(filesNames)
+	}
+	if workersToStart < 1 {
+		workersToStart = 1
+	}
+	resCh := make(chan *copyResult, len(filesNames))
+	tasks := make(chan *copyTask, len(filesNames))
+	for i, fn := range filesNames {
+		tasks <- &copyTask{
+			src:      src,
+			dst:      dst,
+			fileName: fn,
+			index:    i,
+		}
+	}
+	close(tasks)
+	for i := 0; i < workersToStart; i++ {
+		go copyWorker(ctx, tasks, resCh)
+	}
+	outs := make([]*SaveDataOutput, len(filesNames))
+	errs := make([]error, len(filesNames))
+	for i := 0; i < len(filesNames); i++ {
+		res := <-resCh
+		outs[res.index] = res.out
+		errs[res.index] = res.err
+	}
+	return outs, errs
+}
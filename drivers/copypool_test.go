@@ -0,0 +1,72 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCopyFilesBetweenSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	srcURI, _ := url.Parse(srcDir)
+	dstURI, _ := url.Parse(dstDir)
+	src := NewFSDriver(srcURI).NewSession("")
+	dst := NewFSDriver(dstURI).NewSession("")
+
+	assert.NoError(os.MkdirAll(filepath.Join(srcDir, "rec"), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(srcDir, "rec", "1.ts"), []byte("segment 1"), 0644))
+	assert.NoError(os.WriteFile(filepath.Join(srcDir, "rec", "2.ts"), []byte("segment 2"), 0644))
+
+	outs, errs := CopyFiles(context.Background(), src, dst, []string{"rec/1.ts", "rec/missing.ts", "rec/2.ts"}, 2)
+	assert.Len(outs, 3)
+	assert.Len(errs, 3)
+
+	assert.NoError(errs[0])
+	assert.Equal(filepath.Join(dstDir, "rec", "1.ts"), outs[0].URL)
+	data, err := os.ReadFile(filepath.Join(dstDir, "rec", "1.ts"))
+	assert.NoError(err)
+	assert.Equal("segment 1", string(data))
+
+	assert.ErrorIs(errs[1], ErrNotExist)
+	assert.Nil(outs[1])
+
+	assert.NoError(errs[2])
+	data, err = os.ReadFile(filepath.Join(dstDir, "rec", "2.ts"))
+	assert.NoError(err)
+	assert.Equal("segment 2", string(data))
+}
+
+func TestCopyFilesPreservesProperties(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := &MockOSSession{}
+	fi := testFileInfoReader("f1", "body 1")
+	fi.ContentType = "video/mp2t"
+	fi.Metadata = map[string]string{"foo": "bar"}
+	src.On("ReadData", ctx, "f1").Return(fi, nil)
+	src.On("ReadData", ctx, "f2").Return(nil, errors.New("ReadData error"))
+
+	dst := &MockOSSession{}
+	fields := &FileProperties{ContentType: "video/mp2t", Metadata: map[string]string{"foo": "bar"}}
+	dst.On("SaveData", "f1", mock.Anything, fields, time.Duration(0)).Return("dst/f1", nil).Once()
+
+	outs, errs := CopyFiles(ctx, src, dst, []string{"f1", "f2"}, 4)
+	assert.NoError(errs[0])
+	assert.Equal("dst/f1", outs[0].URL)
+	if assert.Error(errs[1]) {
+		assert.Equal("ReadData error", errs[1].Error())
+	}
+	dst.AssertExpectations(t)
+}
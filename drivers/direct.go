@@ -0,0 +1,194 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// directSession uploads the files to an HTTP endpoint negotiated by another node, which handed it
+// over as the DirectInfo of an OSInfo_DIRECT OSInfo. It is the generic counterpart of the S3 POST
+// policy sessions: the uploading node gets no credentials beyond what the endpoint accepts.
+type directSession struct {
+	info *DirectOSInfo
+}
+
+var _ OSSession = (*directSession)(nil)
+
+func newDirectSession(info *DirectOSInfo) OSSession {
+	if info == nil || info.URL == "" {
+		return nil
+	}
+	return &directSession{info: info}
+}
+
+func (session *directSession) OS() OSDriver {
+	return nil
+}
+
+func (session *directSession) EndSession() {
+	// no op
+}
+
+// SaveData uploads the file to the URL of the file under the negotiated URL. The returned URL is
+// the Location of the response, if the endpoint sets one.
+func (session *directSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("direct", time.Now(), counter, &err)
+	ctx, cancel := withSaveTimeout(ctx, timeout, defaultSaveTimeout)
+	defer cancel()
+
+	data, limiter := withMaxBytes(data, fields)
+	data, contentType, err := peekContentType(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if fields != nil && fields.ContentType != "" {
+		contentType = fields.ContentType
+	}
+	body, checksum := withChecksum(data)
+	fileURL := session.fileURL(name)
+	var req *http.Request
+	if strings.EqualFold(session.info.Method, "POST") {
+		req, err = session.newPostRequest(ctx, name, contentType, body)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "PUT", fileURL, body)
+		if err == nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range session.info.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, limiter.tooLarge(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("failed to upload file to %s: %s %s", fileURL, resp.Status, string(respBody))
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		fileURL = location
+	}
+	return &SaveDataOutput{
+		URL:               fileURL,
+		Checksum:          checksum(),
+		ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+	}, nil
+}
+
+// newPostRequest streams the data as the "file" part of a multipart form posted to the negotiated
+// URL, after the negotiated form fields and the name of the file
+func (session *directSession) newPostRequest(ctx context.Context, name, contentType string, data io.Reader) (*http.Request, error) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		err := writeMultipart(writer, session.info.Fields, name, data)
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, "POST", session.info.URL, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req, nil
+}
+
+func writeMultipart(writer *multipart.Writer, fields map[string]string, name string, data io.Reader) error {
+	for k, v := range fields {
+		if err := writer.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	if err := writer.WriteField("name", name); err != nil {
+		return err
+	}
+	part, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(part, data); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func (session *directSession) fileURL(name string) string {
+	return strings.TrimSuffix(session.info.URL, "/") + "/" + strings.TrimPrefix(name, "/")
+}
+
+func (session *directSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (session *directSession) DeleteFile(ctx context.Context, name string) error {
+	return ErrNotSupported
+}
+
+func (session *directSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (session *directSession) Rename(ctx context.Context, oldName, newName string) error {
+	return ErrNotSupported
+}
+
+func (session *directSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return nil, ErrNotSupported
+}
+
+func (session *directSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	return nil, ErrNotSupported
+}
+
+func (session *directSession) Presign(name string, expire time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (session *directSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (session *directSession) PublicURL(name string) (string, error) {
+	return session.fileURL(name), nil
+}
+
+func (session *directSession) ObjectURI(name string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (session *directSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+func (session *directSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, session, name, srcPath, fields)
+}
+
+func (session *directSession) IsExternal() bool {
+	return true
+}
+
+func (session *directSession) IsOwn(url string) bool {
+	return strings.HasPrefix(url, session.info.URL)
+}
+
+// GetInfo carries the headers and form fields of the upload, which may authorize it, so it should
+// only be handed to trusted nodes
+func (session *directSession) GetInfo() *OSInfo {
+	return &OSInfo{
+		StorageType: OSInfo_DIRECT,
+		DirectInfo:  session.info,
+	}
+}
@@ -0,0 +1,73 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectSessionRoundTrip(t *testing.T) {
+	require := require.New(t)
+	uploaded := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			data, _ := io.ReadAll(r.Body)
+			uploaded[r.URL.Path] = r.Header.Get("Content-Type") + "=" + string(data)
+		case "POST":
+			require.NoError(r.ParseMultipartForm(1024 * 1024))
+			file, _, err := r.FormFile("file")
+			require.NoError(err)
+			data, _ := io.ReadAll(file)
+			uploaded[r.FormValue("stream")+"/"+r.FormValue("name")] = string(data)
+			w.Header().Set("Location", "https://cdn.example.com/"+r.FormValue("name"))
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+
+	info := &OSInfo{
+		StorageType: OSInfo_DIRECT,
+		DirectInfo: &DirectOSInfo{
+			URL:     srv.URL + "/upload/",
+			Headers: map[string]string{"Authorization": "Bearer token"},
+		},
+	}
+	// the info is handed over to the uploading node serialized
+	serialized, err := json.Marshal(info)
+	require.NoError(err)
+	var received OSInfo
+	require.NoError(json.Unmarshal(serialized, &received))
+	sess := NewSession(&received)
+	require.NotNil(sess)
+	require.Equal(info, sess.GetInfo())
+
+	out, err := sess.SaveData(context.Background(), "hls/1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal(srv.URL+"/upload/hls/1.ts", out.URL)
+	require.NotEmpty(out.Checksum)
+	require.Equal(map[string]string{"/upload/hls/1.ts": "video/mp2t=segment"}, uploaded)
+
+	info.DirectInfo.Method = "POST"
+	info.DirectInfo.Fields = map[string]string{"stream": "abc"}
+	out, err = NewSession(info).SaveData(context.Background(), "2.ts", strings.NewReader("segment 2"), nil, 0)
+	require.NoError(err)
+	require.Equal("https://cdn.example.com/2.ts", out.URL)
+	require.Equal("segment 2", uploaded["abc/2.ts"])
+
+	info.DirectInfo.Headers = nil
+	_, err = NewSession(info).SaveData(context.Background(), "3.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "403")
+
+	require.Nil(NewSession(&OSInfo{StorageType: OSInfo_DIRECT}))
+}
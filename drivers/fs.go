@@ -2,11 +2,17 @@ package drivers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -16,16 +22,34 @@ type FSOS struct {
 	baseURI  *url.URL
 	sessions map[string]*FSSession
 	lock     sync.RWMutex
+
+	// ServeURL is the URL the base directory is served at, e.g. by a local HTTP server. When set,
+	// Presign returns the URLs of the files under it instead of file:// URLs. Set by StartServer.
+	ServeURL *url.URL
+	server   *http.Server
+
+	// WriteBufferSize is the size of the buffer SaveData copies the data to the file with. Larger
+	// buffers need fewer syscalls for large files. Zero means the default of 128KB.
+	WriteBufferSize int
+	// PruneEmptyDirs makes DeleteFile remove the parent directories left empty by deleting the file,
+	// up to the directory of the session, which is kept. A file saved concurrently in a removed
+	// directory fails to be created.
+	PruneEmptyDirs bool
+}
+
+// defaultFSWriteBufferSize is the size of the SaveData copy buffer when WriteBufferSize isn't set
+const defaultFSWriteBufferSize = 128 * 1024
+
+// fsync flushes the file, or directory, to disk. Overridden in tests.
+var fsync = func(file *os.File) error {
+	return file.Sync()
 }
 
 var _ OSSession = (*FSSession)(nil)
 
 type FSSession struct {
-	os     *FSOS
-	path   string
-	ended  bool
-	dCache map[string]*dataCache
-	dLock  sync.RWMutex
+	os   *FSOS
+	path string
 }
 
 func NewFSDriver(baseURI *url.URL) *FSOS {
@@ -43,10 +67,8 @@ func (ostore *FSOS) NewSession(path string) OSSession {
 		return session
 	}
 	session := &FSSession{
-		os:     ostore,
-		path:   path,
-		dCache: make(map[string]*dataCache),
-		dLock:  sync.RWMutex{},
+		os:   ostore,
+		path: path,
 	}
 	ostore.sessions[path] = session
 	return session
@@ -62,30 +84,111 @@ func (ostore *FSOS) GetSession(path string) *FSSession {
 }
 
 func (ostore *FSOS) UriSchemes() []string {
-	return []string{""}
+	return []string{"", "file"}
 }
 
 func (ostore *FSOS) Description() string {
 	return "File system driver."
 }
 
+// Publish has nothing to publish, the files are readable as soon as they are saved. It returns the
+// URL the base directory is served at, or its file:// URL, so that callers publishing to W3S in
+// production can run against the local file system in tests.
 func (ostore *FSOS) Publish(ctx context.Context) (string, error) {
-	return "", ErrNotSupported
+	ostore.lock.RLock()
+	serveURL := ostore.ServeURL
+	ostore.lock.RUnlock()
+	if serveURL != nil {
+		return serveURL.String(), nil
+	}
+	absPath, err := filepath.Abs(ostore.baseURI.Path)
+	if err != nil {
+		return "", err
+	}
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(absPath)}
+	return u.String(), nil
+}
+
+// HealthCheck checks that the base directory exists
+func (ostore *FSOS) HealthCheck(ctx context.Context) error {
+	dir := ostore.baseURI.Path
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("directory %s: %w", dir, ErrNotExist)
+	} else if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("directory %s: %w: %v", dir, ErrUnauthorized, err)
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// ServeHTTP serves the files under the base directory, so the driver can be mounted on an
+// existing HTTP server
+func (ostore *FSOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dir := "."
+	if ostore.baseURI != nil && ostore.baseURI.Path != "" {
+		dir = ostore.baseURI.Path
+	}
+	http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+}
+
+// StartServer starts serving the base directory over HTTP on addr, e.g. "localhost:0" for a random
+// port, and sets ServeURL so that Presign returns fetchable http:// URLs. Meant for local
+// development and tests, the server is stopped by Shutdown.
+func (ostore *FSOS) StartServer(addr string) (*url.URL, error) {
+	ostore.lock.Lock()
+	defer ostore.lock.Unlock()
+	if ostore.server != nil {
+		return nil, errors.New("the file server is already started")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ostore.server = &http.Server{Handler: ostore}
+	go ostore.server.Serve(listener)
+	ostore.ServeURL = &url.URL{Scheme: "http", Host: listener.Addr().String()}
+	return ostore.ServeURL, nil
+}
+
+// Shutdown ends all the open sessions and stops the file server
+func (ostore *FSOS) Shutdown(ctx context.Context) error {
+	ostore.lock.Lock()
+	server := ostore.server
+	if server != nil {
+		ostore.server = nil
+		ostore.ServeURL = nil
+	}
+	ostore.lock.Unlock()
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	ostore.lock.RLock()
+	sessions := make([]*FSSession, 0, len(ostore.sessions))
+	for _, sess := range ostore.sessions {
+		sessions = append(sessions, sess)
+	}
+	ostore.lock.RUnlock()
+	for _, sess := range sessions {
+		sess.EndSession()
+	}
+	return nil
 }
 
 func (ostore *FSSession) OS() OSDriver {
 	return ostore.os
 }
 
-// EndSession clears memory cache
+// EndSession forgets the session. The files are kept on disk and can still be accessed through a
+// new session for the same path.
 func (ostore *FSSession) EndSession() {
-	ostore.dLock.Lock()
-	ostore.ended = true
-	for k := range ostore.dCache {
-		delete(ostore.dCache, k)
-	}
-	ostore.dLock.Unlock()
-
 	ostore.os.lock.Lock()
 	delete(ostore.os.sessions, ostore.path)
 	ostore.os.lock.Unlock()
@@ -96,9 +199,9 @@ func (ostore *FSSession) ListFiles(ctx context.Context, dir, delim string) (Page
 		files:       []FileInfo{},
 		directories: []string{},
 	}
-	ostore.dLock.RLock()
-	defer ostore.dLock.RUnlock()
-
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	fullPath := ostore.getAbsoluteURI(dir)
 
 	if fullPath == "" {
@@ -127,28 +230,95 @@ func (ostore *FSSession) ListFiles(ctx context.Context, dir, delim string) (Page
 	return pi, nil
 }
 
-func (ostore *FSSession) DeleteFile(ctx context.Context, name string) error {
-	return os.Remove(ostore.getAbsoluteURI(name))
+func (ostore *FSSession) DeleteFile(ctx context.Context, name string) (err error) {
+	defer recordDelete("fs", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fullPath := ostore.getAbsoluteURI(name)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	if ostore.os.PruneEmptyDirs {
+		ostore.pruneEmptyDirs(path.Dir(fullPath))
+	}
+	return nil
 }
 
-func (ostore *FSSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
-	prefix := ""
-	if ostore.os.baseURI != nil {
-		prefix += ostore.os.baseURI.String()
+// pruneEmptyDirs removes dir and its parents until one isn't empty or the directory of the session
+// is reached
+func (ostore *FSSession) pruneEmptyDirs(dir string) {
+	base := ostore.getAbsoluteURI("")
+	for {
+		rel, err := filepath.Rel(base, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return
+		}
+		// only succeeds for empty directories
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = path.Dir(dir)
 	}
-	fullPath := path.Join(prefix, name)
-	file, err := os.Open(fullPath)
-	if os.IsNotExist(err) {
-		return nil, ErrNotExist
+}
+
+// Rename moves the file with os.Rename, which is atomic within the same file system
+func (ostore *FSSession) Rename(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	oldPath, newPath := ostore.getAbsoluteURI(oldName), ostore.getAbsoluteURI(newName)
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		return ErrNotExist
 	} else if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(newPath), os.ModePerm); err != nil {
+		return err
+	}
+	err := os.Rename(oldPath, newPath)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
+
+// PrefixSize walks the directory of the prefix, summing the sizes of the files under it
+func (ostore *FSSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	root := filepath.FromSlash(ostore.getAbsoluteURI(prefix))
+	dir := root
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		dir = filepath.Dir(root)
+	}
+	var total int64
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasPrefix(file, root) {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+func (ostore *FSSession) ReadData(ctx context.Context, name string) (res *FileInfoReader, err error) {
+	defer recordRead("fs", time.Now(), &res, &err)
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	stat, err := file.Stat()
+	file, size, err := ostore.openFile(name)
 	if err != nil {
 		return nil, err
 	}
-	size := stat.Size()
-	res := &FileInfoReader{
+	res = &FileInfoReader{
 		FileInfo: FileInfo{
 			Name: name,
 			Size: &size,
@@ -162,8 +332,80 @@ func (ostore *FSSession) ReadDataRange(ctx context.Context, name, byteRange stri
 	return nil, ErrNotSupported
 }
 
+// syncFile flushes the file to disk, then its directory for the entry of a new file to be durable
+func syncFile(file *os.File, dir string) error {
+	if err := fsync(file); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", file.Name(), err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := fsync(d); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+// Presign returns the URL of the file under the ServeURL of the driver, or its file:// URL like
+// PublicURL. Local files don't need signing, so expire is ignored.
 func (ostore *FSSession) Presign(name string, expire time.Duration) (string, error) {
-	return "", ErrNotSupported
+	ostore.os.lock.RLock()
+	serveURL := ostore.os.ServeURL
+	ostore.os.lock.RUnlock()
+	if serveURL == nil {
+		return ostore.PublicURL(name)
+	}
+	u := *serveURL
+	u.Path = path.Join("/", u.Path, ostore.getAbsolutePath(name))
+	return u.String(), nil
+}
+
+func (ostore *FSSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (ostore *FSSession) PublicURL(name string) (string, error) {
+	absPath, err := filepath.Abs(ostore.getAbsoluteURI(name))
+	if err != nil {
+		return "", err
+	}
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(absPath)}
+	return u.String(), nil
+}
+
+// ObjectURI returns the file:// URL of the absolute path of the file, which is its PublicURL
+func (ostore *FSSession) ObjectURI(name string) (string, error) {
+	return ostore.PublicURL(name)
+}
+
+// ReadSeeker returns the open file
+func (ostore *FSSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return ostore.openFile(name)
+}
+
+// openFile opens the file read by ReadData, returning it with its size
+func (ostore *FSSession) openFile(name string) (*os.File, int64, error) {
+	prefix := ""
+	if ostore.os.baseURI != nil {
+		prefix += ostore.os.baseURI.String()
+	}
+	file, err := os.Open(path.Join(prefix, name))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotExist
+	} else if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
 }
 
 func (ostore *FSSession) IsExternal() bool {
@@ -178,10 +420,15 @@ func (ostore *FSSession) GetInfo() *OSInfo {
 	return nil
 }
 
-func (ostore *FSSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+func (ostore *FSSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("fs", time.Now(), counter, &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	fullPath := ostore.getAbsoluteURI(name)
 	dir, name := path.Split(fullPath)
-	err := os.MkdirAll(dir, os.ModePerm)
+	err = os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -189,36 +436,97 @@ func (ostore *FSSession) SaveData(ctx context.Context, name string, data io.Read
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 128*1024)
+	bufSize := ostore.os.WriteBufferSize
+	if bufSize <= 0 {
+		bufSize = defaultFSWriteBufferSize
+	}
+	if fields != nil && fields.SizeHint > 0 && fields.SizeHint < int64(bufSize) {
+		// one more byte than the data, for the copy to find its end with a single read
+		bufSize = int(fields.SizeHint) + 1
+	}
 	defer file.Close()
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			read, err := data.Read(buf)
-			if err != nil && err != io.EOF {
-				return nil, err
-			}
-			if read > 0 {
-				_, err = file.Write(buf[:read])
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				return &SaveDataOutput{URL: fullPath}, nil
-			}
+	defer func() {
+		// don't leave a partial file behind
+		if err != nil {
+			os.Remove(fullPath)
+		}
+	}()
+	data, _ = withMaxBytes(data, fields)
+	data, checksum := withChecksum(data)
+	// the file is wrapped to hide its ReadFrom, which would copy without the sized buffer
+	_, err = io.CopyBuffer(struct{ io.Writer }{file}, &contextReader{ctx: ctx, Reader: data}, make([]byte, bufSize))
+	if err != nil {
+		return nil, err
+	}
+	if fields != nil && fields.Durable {
+		if err = syncFile(file, path.Dir(fullPath)); err != nil {
+			return nil, err
+		}
+	}
+	return &SaveDataOutput{
+		URL:               fullPath,
+		Checksum:          checksum(),
+		ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+	}, nil
+}
+
+// SaveFile links the file at srcPath with the given name when both are on the same file system, so
+// that the data isn't copied. The file is then shared, so later writes to the source change the saved
+// file too. Falls back to copying with SaveData across file systems, and when the fields limit the
+// size or the throughput of the data.
+func (ostore *FSSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if fields != nil && (fields.MaxBytes > 0 || fields.MaxBytesPerSecond > 0) {
+		return saveFile(ctx, ostore, name, srcPath, fields)
+	}
+	src, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	fullPath := ostore.getAbsoluteURI(name)
+	if err := os.MkdirAll(path.Dir(fullPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if dst, err := os.Stat(fullPath); err == nil && os.SameFile(src, dst) {
+		return &SaveDataOutput{URL: fullPath}, nil
+	}
+	// linked under a temporary name first, for an existing file to be replaced atomically
+	tmpPath := fmt.Sprintf("%s.%d.link", fullPath, rand.Int63())
+	if err := os.Link(srcPath, tmpPath); err != nil {
+		Log.Debugf("Failed to link file, copying it src=%s dst=%s err=%v", srcPath, fullPath, err)
+		return saveFile(ctx, ostore, name, srcPath, fields)
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if fields != nil && fields.Durable {
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if err := syncFile(file, path.Dir(fullPath)); err != nil {
+			return nil, err
 		}
 	}
+	return &SaveDataOutput{URL: fullPath}, nil
+}
+
+// contextReader fails the reads with the error of the context once it is done, so that copying
+// from it stops
+type contextReader struct {
+	io.Reader
+	ctx context.Context
 }
 
-func (ostore *FSSession) getCacheForStream(streamID string) *dataCache {
-	sc, ok := ostore.dCache[streamID]
-	if !ok {
-		sc = newDataCache(dataCacheLen)
-		ostore.dCache[streamID] = sc
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return sc
+	return cr.Reader.Read(p)
 }
 
 func (ostore *FSSession) getAbsolutePath(name string) string {
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -93,3 +98,360 @@ func TestDeleteFile(t *testing.T) {
 	_, err = os.Stat(file.Name())
 	require.ErrorContains(t, err, "no such file or directory")
 }
+
+func TestDeleteFilePruneEmptyDirs(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	drv := NewFSDriver(&url.URL{Path: dir})
+	sess := drv.NewSession("recordings")
+	for _, name := range []string{"rec1/hls/1.ts", "rec2/hls/1.ts", "rec2/hls/2.ts"} {
+		_, err := sess.SaveData(context.Background(), name, bytes.NewReader([]byte("segment")), nil, 0)
+		require.NoError(err)
+	}
+
+	// without the option the directories are kept
+	require.NoError(sess.DeleteFile(context.Background(), "rec2/hls/2.ts"))
+	require.DirExists(filepath.Join(dir, "recordings/rec2/hls"))
+
+	drv.PruneEmptyDirs = true
+	require.NoError(sess.DeleteFile(context.Background(), "rec1/hls/1.ts"))
+	require.NoDirExists(filepath.Join(dir, "recordings/rec1"))
+	require.DirExists(filepath.Join(dir, "recordings/rec2/hls"))
+
+	// the directory of the session is kept even once empty
+	require.NoError(sess.DeleteFile(context.Background(), "rec2/hls/1.ts"))
+	require.NoDirExists(filepath.Join(dir, "recordings/rec2"))
+	require.DirExists(filepath.Join(dir, "recordings"))
+
+	require.Error(sess.DeleteFile(context.Background(), "rec2/hls/1.ts"))
+}
+
+func TestFsOSChecksum(t *testing.T) {
+	u, err := url.Parse(t.TempDir())
+	require.NoError(t, err)
+	sess := NewFSDriver(u).NewSession("checksum")
+
+	data := make([]byte, 300*1024)
+	rand.Read(data)
+	out, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader(data), nil, 0)
+	require.NoError(t, err)
+
+	expected := sha256.Sum256(data)
+	require.Equal(t, hex.EncodeToString(expected[:]), out.Checksum)
+	require.Equal(t, ChecksumAlgorithmSHA256, out.ChecksumAlgorithm)
+}
+
+func TestFsOSShutdown(t *testing.T) {
+	u, err := url.Parse(t.TempDir())
+	require.NoError(t, err)
+	storage := NewFSDriver(u)
+	storage.NewSession("one")
+	storage.NewSession("two")
+	require.NotNil(t, storage.GetSession("one"))
+
+	require.NoError(t, storage.Shutdown(context.Background()))
+	require.Nil(t, storage.GetSession("one"))
+	require.Nil(t, storage.GetSession("two"))
+}
+
+func TestFsOSMaxBytes(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	u, _ := url.Parse(dir)
+	sess := NewFSDriver(u).NewSession("")
+	data := bytes.Repeat([]byte("x"), 300*1024)
+
+	_, err := sess.SaveData(context.Background(), "big.ts", bytes.NewReader(data), &FileProperties{MaxBytes: 200 * 1024}, 0)
+	assert.ErrorIs(err, ErrTooLarge)
+	assert.NoFileExists(filepath.Join(dir, "big.ts"))
+
+	_, err = sess.SaveData(context.Background(), "exact.ts", bytes.NewReader(data), &FileProperties{MaxBytes: int64(len(data))}, 0)
+	assert.NoError(err)
+	saved, err := os.ReadFile(filepath.Join(dir, "exact.ts"))
+	assert.NoError(err)
+	assert.Equal(data, saved)
+}
+
+func TestFsOSHealthCheck(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	require.NoError(NewFSDriver(&url.URL{Path: dir}).HealthCheck(context.Background()))
+	require.ErrorIs(NewFSDriver(&url.URL{Path: filepath.Join(dir, "missing")}).HealthCheck(context.Background()), ErrNotExist)
+
+	file := filepath.Join(dir, "file")
+	require.NoError(os.WriteFile(file, []byte("data"), 0644))
+	require.ErrorContains(NewFSDriver(&url.URL{Path: file}).HealthCheck(context.Background()), "not a directory")
+}
+
+func TestFsOSPresign(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	drv := NewFSDriver(&url.URL{Path: dir})
+	sess := drv.NewSession("rec")
+
+	publicURL, err := sess.PublicURL("hls/1.ts")
+	require.NoError(err)
+	presigned, err := sess.Presign("hls/1.ts", time.Minute)
+	require.NoError(err)
+	require.Equal(publicURL, presigned)
+	require.Equal("file://"+filepath.ToSlash(filepath.Join(dir, "rec/hls/1.ts")), presigned)
+
+	drv.ServeURL = &url.URL{Scheme: "http", Host: "localhost:8080", Path: "/files"}
+	presigned, err = sess.Presign("hls/1.ts", time.Minute)
+	require.NoError(err)
+	require.Equal("http://localhost:8080/files/rec/hls/1.ts", presigned)
+}
+
+func TestFsOSStartServer(t *testing.T) {
+	require := require.New(t)
+	drv := NewFSDriver(&url.URL{Path: t.TempDir()})
+	sess := drv.NewSession("rec")
+	_, err := sess.SaveData(context.Background(), "hls/1.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	require.NoError(err)
+
+	serveURL, err := drv.StartServer("127.0.0.1:0")
+	require.NoError(err)
+	require.Equal("http", serveURL.Scheme)
+	_, err = drv.StartServer("127.0.0.1:0")
+	require.Error(err)
+
+	presigned, err := sess.Presign("hls/1.ts", time.Minute)
+	require.NoError(err)
+	require.Equal(serveURL.String()+"/rec/hls/1.ts", presigned)
+	resp, err := http.Get(presigned)
+	require.NoError(err)
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Equal("segment", string(data))
+
+	require.NoError(drv.Shutdown(context.Background()))
+	require.Nil(drv.ServeURL)
+	presigned, err = sess.Presign("hls/1.ts", time.Minute)
+	require.NoError(err)
+	require.Contains(presigned, "file://")
+}
+
+func TestFsOSCancelledContext(t *testing.T) {
+	require := require.New(t)
+	sess := NewFSDriver(&url.URL{Path: t.TempDir()}).NewSession("")
+	_, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = sess.SaveData(ctx, "2.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	require.ErrorIs(err, context.Canceled)
+	_, err = sess.ReadData(ctx, "1.ts")
+	require.ErrorIs(err, context.Canceled)
+	_, err = sess.ListFiles(ctx, "", "")
+	require.ErrorIs(err, context.Canceled)
+	require.ErrorIs(sess.DeleteFile(ctx, "1.ts"), context.Canceled)
+	require.Equal([]byte("segment"), readFile(sess.(*FSSession), "1.ts"))
+}
+
+func TestFsOSRename(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	sess := NewFSDriver(&url.URL{Path: dir}).NewSession("rec")
+	_, err := sess.SaveData(context.Background(), "1.ts.tmp", bytes.NewReader([]byte("segment")), nil, 0)
+	require.NoError(err)
+
+	require.NoError(sess.Rename(context.Background(), "1.ts.tmp", "hls/1.ts"))
+	data, err := os.ReadFile(filepath.Join(dir, "rec/hls/1.ts"))
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	_, err = os.Stat(filepath.Join(dir, "rec/1.ts.tmp"))
+	require.True(os.IsNotExist(err))
+
+	require.ErrorIs(sess.Rename(context.Background(), "1.ts.tmp", "hls/1.ts"), ErrNotExist)
+}
+
+func TestFsOSWriteBufferSize(t *testing.T) {
+	require := require.New(t)
+	drv := NewFSDriver(&url.URL{Path: t.TempDir()})
+	drv.WriteBufferSize = 7
+	sess := drv.NewSession("")
+	data := make([]byte, 1000)
+	rand.Read(data)
+	out, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader(data), nil, 0)
+	require.NoError(err)
+	require.Equal(data, readFile(sess.(*FSSession), "1.ts"))
+	checksum := sha256.Sum256(data)
+	require.Equal(hex.EncodeToString(checksum[:]), out.Checksum)
+}
+
+func TestFsOSSaveFile(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "transcoded.mp4")
+	require.NoError(os.WriteFile(srcPath, []byte("rendition"), 0644))
+	sess := NewFSDriver(&url.URL{Path: filepath.Join(dir, "store")}).NewSession("rec")
+	sameFile := func(name string) bool {
+		src, err := os.Stat(srcPath)
+		require.NoError(err)
+		dst, err := os.Stat(filepath.Join(dir, "store/rec", name))
+		require.NoError(err)
+		return os.SameFile(src, dst)
+	}
+
+	// on the same file system the file is linked instead of copied
+	out, err := sess.SaveFile(context.Background(), "hls/1.mp4", srcPath, nil)
+	require.NoError(err)
+	require.Equal(filepath.Join(dir, "store/rec/hls/1.mp4"), out.URL)
+	require.True(sameFile("hls/1.mp4"))
+	require.FileExists(srcPath)
+	data, err := os.ReadFile(filepath.Join(dir, "store/rec/hls/1.mp4"))
+	require.NoError(err)
+	require.Equal("rendition", string(data))
+
+	// an existing file is replaced
+	_, err = sess.SaveData(context.Background(), "hls/2.mp4", bytes.NewReader([]byte("old")), nil, 0)
+	require.NoError(err)
+	_, err = sess.SaveFile(context.Background(), "hls/2.mp4", srcPath, &FileProperties{Durable: true})
+	require.NoError(err)
+	require.True(sameFile("hls/2.mp4"))
+	_, err = sess.SaveFile(context.Background(), "hls/2.mp4", srcPath, nil)
+	require.NoError(err)
+	entries, err := os.ReadDir(filepath.Join(dir, "store/rec/hls"))
+	require.NoError(err)
+	require.Len(entries, 2)
+
+	// limiting the size needs the data to be copied
+	_, err = sess.SaveFile(context.Background(), "hls/3.mp4", srcPath, &FileProperties{MaxBytes: 100})
+	require.NoError(err)
+	require.False(sameFile("hls/3.mp4"))
+	data, err = os.ReadFile(filepath.Join(dir, "store/rec/hls/3.mp4"))
+	require.NoError(err)
+	require.Equal("rendition", string(data))
+	_, err = sess.SaveFile(context.Background(), "hls/4.mp4", srcPath, &FileProperties{MaxBytes: 5})
+	require.ErrorIs(err, ErrTooLarge)
+
+	_, err = sess.SaveFile(context.Background(), "hls/5.mp4", filepath.Join(dir, "missing.mp4"), nil)
+	require.ErrorIs(err, os.ErrNotExist)
+}
+
+func BenchmarkFsOSSaveData(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	data := make([]byte, size)
+	rand.Read(data)
+	for _, bufSize := range []int{32 * 1024, 128 * 1024, 1024 * 1024, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("buffer-%dKB", bufSize/1024), func(b *testing.B) {
+			drv := NewFSDriver(&url.URL{Path: b.TempDir()})
+			drv.WriteBufferSize = bufSize
+			sess := drv.NewSession("")
+			b.SetBytes(size)
+			for n := 0; n < b.N; n++ {
+				// a reader without WriteTo, like the body of an upload, so the buffer is used
+				if _, err := sess.SaveData(context.Background(), "1.ts", struct{ io.Reader }{bytes.NewReader(data)}, nil, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFsOSPublish(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	drv := NewFSDriver(&url.URL{Path: dir})
+	sess := drv.NewSession("rec")
+	_, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	require.NoError(err)
+
+	base, err := drv.Publish(context.Background())
+	require.NoError(err)
+	require.Equal("file://"+filepath.ToSlash(dir), base)
+	fileURL, err := sess.PublicURL("1.ts")
+	require.NoError(err)
+	require.Equal(base+"/rec/1.ts", fileURL)
+
+	drv.ServeURL = &url.URL{Scheme: "http", Host: "localhost:8080", Path: "/files"}
+	base, err = drv.Publish(context.Background())
+	require.NoError(err)
+	require.Equal("http://localhost:8080/files", base)
+}
+
+func TestFsOSDurable(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	var synced []string
+	defer func(orig func(*os.File) error) { fsync = orig }(fsync)
+	fsync = func(file *os.File) error {
+		synced = append(synced, file.Name())
+		return file.Sync()
+	}
+	sess := NewFSDriver(&url.URL{Path: dir}).NewSession("rec")
+
+	_, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	require.NoError(err)
+	require.Empty(synced)
+
+	_, err = sess.SaveData(context.Background(), "2.ts", bytes.NewReader([]byte("segment")), &FileProperties{Durable: true}, 0)
+	require.NoError(err)
+	require.Equal([]string{filepath.Join(dir, "rec/2.ts"), filepath.Join(dir, "rec")}, synced)
+
+	fsync = func(file *os.File) error {
+		return fmt.Errorf("disk failure")
+	}
+	_, err = sess.SaveData(context.Background(), "3.ts", bytes.NewReader([]byte("segment")), &FileProperties{Durable: true}, 0)
+	require.ErrorContains(err, "disk failure")
+	_, err = os.Stat(filepath.Join(dir, "rec/3.ts"))
+	require.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestFsOSPrefixSize(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	sess := NewFSDriver(&url.URL{Path: t.TempDir()}).NewSession("rec")
+	for name, size := range map[string]int{"hls/1.ts": 100, "hls/2.ts": 50, "hls/index.m3u8": 10, "10.ts": 5, "other.ts": 1} {
+		_, err := sess.SaveData(ctx, name, bytes.NewReader(make([]byte, size)), nil, 0)
+		require.NoError(err)
+	}
+
+	for prefix, expected := range map[string]int64{
+		"":         166,
+		"hls/":     160,
+		"hls":      160,
+		"hls/1":    100,
+		"1":        5,
+		"missing/": 0,
+	} {
+		size, err := sess.PrefixSize(ctx, prefix)
+		require.NoError(err, prefix)
+		require.Equal(expected, size, prefix)
+	}
+}
+
+func TestFsOSEmptyFile(t *testing.T) {
+	require := require.New(t)
+	u, err := url.Parse(t.TempDir())
+	require.NoError(err)
+	sess := NewFSDriver(u).NewSession("empty")
+	_, err = sess.SaveData(context.Background(), "1.ts", bytes.NewReader(nil), nil, 0)
+	require.NoError(err)
+
+	data, info, err := ReadFile(context.Background(), sess, "empty/1.ts")
+	require.NoError(err)
+	require.Empty(data)
+	require.Equal(int64(0), *info.Size)
+}
+
+func TestFsOSPathNormalization(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	u, err := url.Parse(dir)
+	require.NoError(err)
+	sess := NewFSDriver(u).NewSession("rec")
+	for i, name := range []string{"a//b", "a/b/", "/a/b"} {
+		out, err := sess.SaveData(context.Background(), name, bytes.NewReader([]byte{byte('0' + i)}), nil, 0)
+		require.NoError(err)
+		require.Equal(filepath.Join(dir, "rec/a/b"), out.URL)
+	}
+	for _, name := range []string{"rec//a/b", "rec/a/b/", "/rec/a/b"} {
+		data, _, err := ReadFile(context.Background(), sess, name)
+		require.NoError(err)
+		require.Equal("2", string(data))
+	}
+}
@@ -13,9 +13,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
@@ -41,6 +43,12 @@ type (
 		parsedKey *rsa.PrivateKey
 	}
 
+	// GsOS is the Google Cloud Storage driver. Without useFullAPI it only supports SaveData,
+	// uploading with a POST policy like S3OS.
+	//
+	// Without a service account key, the full API is used with the Application Default Credentials,
+	// e.g. of GOOGLE_APPLICATION_CREDENTIALS or of the GKE Workload Identity. The sessions then
+	// can't be handed over to other nodes, as there is no key to sign their POST policy with.
 	GsOS struct {
 		S3OS
 		gsSigner *gsSigner
@@ -86,7 +94,31 @@ func (ostore *GsOS) Description() string {
 	return "Google Cloud Storage"
 }
 
+// String describes the driver with the service account key masked, so it's safe to log
+func (ostore *GsOS) String() string {
+	clientEmail := ""
+	if ostore.gsSigner != nil {
+		clientEmail = ostore.gsSigner.clientEmail()
+	}
+	return fmt.Sprintf("GsOS{host: %s, bucket: %s, clientEmail: %s, key: %s}",
+		ostore.host, ostore.bucket, clientEmail, redactSecret(string(ostore.keyData)))
+}
+
+// NewGoogleDriver creates the driver of the bucket with the JSON service account key, or the
+// Application Default Credentials when keyData is empty, which requires useFullAPI
 func NewGoogleDriver(bucket, keyData string, useFullAPI bool) (OSDriver, error) {
+	if keyData == "" {
+		if !useFullAPI {
+			return nil, errors.New("GS without a service account key requires the full API")
+		}
+		return &GsOS{
+			S3OS: S3OS{
+				host:       gsHost(bucket),
+				bucket:     bucket,
+				useFullAPI: true,
+			},
+		}, nil
+	}
 	os := &GsOS{
 		S3OS: S3OS{
 			host:       gsHost(bucket),
@@ -112,16 +144,16 @@ func NewGoogleDriver(bucket, keyData string, useFullAPI bool) (OSDriver, error)
 }
 
 func (os *GsOS) NewSession(path string) OSSession {
-	var policy, signature = gsCreatePolicy(os.gsSigner, os.bucket, os.region, path)
 	sess := &s3Session{
 		host:        gsHost(os.bucket),
 		bucket:      os.bucket,
 		key:         path,
-		policy:      policy,
-		signature:   signature,
-		credential:  os.gsSigner.clientEmail(),
 		storageType: OSInfo_GOOGLE,
 	}
+	if os.gsSigner != nil {
+		sess.policy, sess.signature = gsCreatePolicy(os.gsSigner, os.bucket, os.region, path)
+		sess.credential = os.gsSigner.clientEmail()
+	}
 	sess.fields = gsGetFields(sess)
 	gs := &gsSession{
 		s3Session:  *sess,
@@ -136,9 +168,14 @@ func (os *GsOS) Publish(ctx context.Context) (string, error) {
 	return "", ErrNotSupported
 }
 
+func (os *GsOS) Shutdown(ctx context.Context) error {
+	return nil
+}
+
 func newGSSession(info *S3OSInfo) OSSession {
 	sess := &s3Session{
 		host:        info.Host,
+		bucket:      info.Bucket,
 		key:         info.Key,
 		policy:      info.Policy,
 		signature:   info.Signature,
@@ -149,12 +186,39 @@ func newGSSession(info *S3OSInfo) OSSession {
 	return sess
 }
 
+// HealthCheck checks that the bucket exists and can be accessed by getting its metadata. Not
+// supported without useFullAPI, where the driver uploads with POST policies.
+func (os *GsOS) HealthCheck(ctx context.Context) error {
+	if !os.useFullAPI {
+		return ErrNotSupported
+	}
+	sess := os.NewSession("").(*gsSession)
+	defer sess.EndSession()
+	if err := sess.createClient(); err != nil {
+		return err
+	}
+	_, err := sess.client.Bucket(os.bucket).Attrs(ctx)
+	if err == nil {
+		return nil
+	}
+	target := "gs bucket " + os.bucket
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return fmt.Errorf("%s: %w", target, ErrNotExist)
+	}
+	status := 0
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		status = apiErr.Code
+	}
+	return healthCheckError(target, status, err)
+}
+
 func (os *gsSession) OS() OSDriver {
 	return os.gos
 }
 
 func (os *gsSession) createClient() error {
-	client, err := storage.NewClient(context.Background(), option.WithCredentialsJSON(os.keyData))
+	client, err := storage.NewClient(context.Background(), os.clientOptions()...)
 	if err != nil {
 		return fmt.Errorf("Error creating GCP client err=%w", err)
 	}
@@ -162,7 +226,34 @@ func (os *gsSession) createClient() error {
 	return nil
 }
 
-func (os *gsSession) DeleteFile(ctx context.Context, name string) error {
+// clientOptions authenticate the client with the service account key, or with the Application
+// Default Credentials found by the client when there is none
+func (os *gsSession) clientOptions() []option.ClientOption {
+	if len(os.keyData) == 0 {
+		return nil
+	}
+	return []option.ClientOption{option.WithCredentialsJSON(os.keyData)}
+}
+
+// GetInfo returns nil for the sessions using the Application Default Credentials, which can't be
+// handed over without a POST policy
+func (os *gsSession) GetInfo() *OSInfo {
+	if os.gos != nil && os.gos.gsSigner == nil {
+		return nil
+	}
+	return os.s3Session.GetInfo()
+}
+
+func (os *gsSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return listedPrefixSize(ctx, os, prefix)
+}
+
+func (os *gsSession) Rename(ctx context.Context, oldName, newName string) error {
+	return ErrNotSupported
+}
+
+func (os *gsSession) DeleteFile(ctx context.Context, name string) (err error) {
+	defer recordDelete("gs", time.Now(), &err)
 	if !os.useFullAPI {
 		return ErrNotSupported
 	}
@@ -171,24 +262,27 @@ func (os *gsSession) DeleteFile(ctx context.Context, name string) error {
 			return err
 		}
 	}
-	return os.client.Bucket(os.bucket).
-		Object(os.key + "/" + name).
-		Delete(ctx)
+	key := os.fullKey(name)
+	err = os.client.Bucket(os.bucket).Object(key).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) && os.key == "" {
+		// the sessions without a key prefix used to save the files with a leading slash
+		err = os.client.Bucket(os.bucket).Object("/" + key).Delete(ctx)
+	}
+	return err
 }
 
-func (os *gsSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+func (os *gsSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("gs", time.Now(), counter, &err)
 	if os.useFullAPI {
 		if os.client == nil {
 			if err := os.createClient(); err != nil {
 				return nil, err
 			}
 		}
-		keyname := os.key + "/" + name
+		keyname := objectKey(os.key, name)
 		objh := os.client.Bucket(os.bucket).Object(keyname)
-		if timeout == 0 {
-			timeout = defaultSaveTimeout
-		}
-		ctx, cancel := context.WithTimeout(ctx, timeout)
+		ctx, cancel := withSaveTimeout(ctx, timeout, defaultSaveTimeout)
 		defer cancel()
 		wr := objh.NewWriter(ctx)
 		if fields != nil {
@@ -199,23 +293,38 @@ func (os *gsSession) SaveData(ctx context.Context, name string, data io.Reader,
 				wr.Metadata[k] = v
 			}
 		}
-		data, contentType, err := os.peekContentType(name, data)
+		headers, err := parseObjectHeaders(fields)
 		if err != nil {
 			return nil, err
 		}
-		wr.ContentType = contentType
-		_, err = io.Copy(wr, data)
-		err2 := wr.Close()
+		wr.ContentDisposition = headers.contentDisposition
+		wr.ContentLanguage = headers.contentLanguage
+		data, contentType, err := peekContentType(name, data)
 		if err != nil {
 			return nil, err
 		}
+		wr.ContentType = contentType
+		limited, limiter := withMaxBytes(data, fields)
+		body, checksum := withChecksum(limited)
+		_, err = io.Copy(wr, body)
+		if err != nil {
+			// cancel before closing the writer, otherwise the partial object would be created
+			cancel()
+			wr.Close()
+			return nil, limiter.tooLarge(err)
+		}
+		err2 := wr.Close()
 		if err2 != nil {
 			return nil, err2
 		}
 		uri := os.getAbsURL(keyname)
-		return &SaveDataOutput{URL: uri}, err
+		return &SaveDataOutput{
+			URL:               uri,
+			Checksum:          checksum(),
+			ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+		}, err
 	}
-	return os.s3Session.SaveData(ctx, name, data, fields, timeout)
+	return os.s3Session.saveData(ctx, name, data, fields, timeout)
 }
 
 type gsPageInfo struct {
@@ -281,7 +390,7 @@ func (gspi *gsPageInfo) listFiles() error {
 
 func (os *gsSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
 	if !os.useFullAPI {
-		return nil, errors.New("Not implemented")
+		return nil, ErrNotSupported
 	}
 	if os.client == nil {
 		if err := os.createClient(); err != nil {
@@ -289,7 +398,7 @@ func (os *gsSession) ListFiles(ctx context.Context, prefix, delim string) (PageI
 		}
 	}
 	query := &storage.Query{
-		Prefix:    prefix,
+		Prefix:    listingPrefix(objectKey("", prefix), prefix),
 		Delimiter: delim,
 	}
 	pi := &gsPageInfo{
@@ -313,9 +422,36 @@ func (os *gsSession) EndSession() {
 	}
 }
 
-func (os *gsSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+func (os *gsSession) ReadData(ctx context.Context, name string) (res *FileInfoReader, err error) {
+	defer recordRead("gs", time.Now(), &res, &err)
+	return os.readObject(ctx, name, "", time.Time{}, "")
+}
+
+var _ ConditionalReader = (*gsSession)(nil)
+
+func (os *gsSession) ReadDataConditional(ctx context.Context, name, etag string, modifiedSince time.Time) (res *FileInfoReader, err error) {
+	defer recordRead("gs", time.Now(), &res, &err)
+	return os.readObject(ctx, name, etag, modifiedSince, "")
+}
+
+// ReadDataRange reads the byte range of the file as stored, without decompressing the files stored
+// with a gzip Content-Encoding, like S3. Multiple ranges are read one by one and returned in a
+// multipart/byteranges body to read with ByteRangeParts.
+func (os *gsSession) ReadDataRange(ctx context.Context, name, byteRange string) (res *FileInfoReader, err error) {
+	defer recordRead("gs", time.Now(), &res, &err)
+	if ranges := splitByteRanges(byteRange); ranges != nil {
+		return readRangesSequentially(ctx, ranges, func(ctx context.Context, byteRange string) (*FileInfoReader, error) {
+			return os.readObject(ctx, name, "", time.Time{}, byteRange)
+		})
+	}
+	return os.readObject(ctx, name, "", time.Time{}, byteRange)
+}
+
+// readObject reads the object, or its byteRange if set, unless it matches the etag or was not
+// modified after modifiedSince, when they are set
+func (os *gsSession) readObject(ctx context.Context, name, etag string, modifiedSince time.Time, byteRange string) (*FileInfoReader, error) {
 	if !os.useFullAPI {
-		return nil, errors.New("Not implemented")
+		return nil, ErrNotSupported
 	}
 	if os.client == nil {
 		if err := os.createClient(); err != nil {
@@ -323,13 +459,22 @@ func (os *gsSession) ReadData(ctx context.Context, name string) (*FileInfoReader
 		}
 	}
 
-	objh := os.client.Bucket(os.bucket).Object(name)
+	key := os.fullKey(name)
+	objh := os.client.Bucket(os.bucket).Object(key)
 	attrs, err := objh.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) && os.key == "" {
+		// the sessions without a key prefix used to save the files with a leading slash
+		objh = os.client.Bucket(os.bucket).Object("/" + key)
+		attrs, err = objh.Attrs(ctx)
+	}
 	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
 		return nil, ErrNotExist
 	} else if err != nil {
 		return nil, err
 	}
+	if (etag != "" && attrs.Etag == etag) || (!modifiedSince.IsZero() && !attrs.Updated.After(modifiedSince)) {
+		return nil, ErrNotModified
+	}
 	res := &FileInfoReader{}
 	res.Name = name
 	res.Size = &attrs.Size
@@ -337,29 +482,61 @@ func (os *gsSession) ReadData(ctx context.Context, name string) (*FileInfoReader
 	res.LastModified = attrs.Updated
 	res.ContentType = attrs.ContentType
 	if len(attrs.Metadata) > 0 {
+		res.Metadata = make(map[string]string, len(attrs.Metadata))
 		for k, v := range attrs.Metadata {
-			res.Metadata = make(map[string]string, len(attrs.Metadata))
 			res.Metadata[k] = v
 		}
 	}
-	rc, err := objh.NewReader(ctx)
+	var rc *storage.Reader
+	if byteRange == "" {
+		rc, err = objh.NewReader(ctx)
+	} else {
+		start, end, rangeErr := parseByteRange(byteRange, attrs.Size)
+		if rangeErr != nil {
+			return nil, rangeErr
+		}
+		rc, err = objh.ReadCompressed(true).NewRangeReader(ctx, start, end-start+1)
+		res.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, attrs.Size)
+	}
 	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
 		return nil, ErrNotExist
 	} else if err != nil {
 		return nil, err
 	}
 	res.Body = rc
+	// the encoding is empty when the client or the service decompressed the data
+	res.ContentEncoding = rc.Attrs.ContentEncoding
+	if remain := rc.Remain(); remain >= 0 {
+		res.ContentLength = remain
+	}
 	return res, nil
 }
 
-func (os *gsSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
-	return nil, ErrNotSupported
+func (os *gsSession) Presign(name string, expire time.Duration) (string, error) {
+	return "", ErrNotSupported
 }
 
-func (os *gsSession) Presign(name string, expire time.Duration) (string, error) {
+func (os *gsSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (os *gsSession) PublicURL(name string) (string, error) {
+	return os.getAbsURL(objectKey(os.key, name)), nil
+}
+
+// ObjectURI is not supported, the GS OS URLs don't have a key prefix
+func (os *gsSession) ObjectURI(name string) (string, error) {
 	return "", ErrNotSupported
 }
 
+func (os *gsSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return newRangeReadSeeker(ctx, os, name)
+}
+
+func (os *gsSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, os, name, srcPath, fields)
+}
+
 func gsGetFields(sess *s3Session) map[string]string {
 	return map[string]string{
 		"GoogleAccessId": sess.credential,
@@ -371,7 +548,7 @@ func gsGetFields(sess *s3Session) map[string]string {
 func gsCreatePolicy(signer *gsSigner, bucket, region, path string) (string, string) {
 	const timeFormat = "2006-01-02T15:04:05.999Z"
 
-	expireAt := time.Now().Add(S3_POLICY_EXPIRE_IN_HOURS * time.Hour)
+	expireAt := Now().Add(S3_POLICY_EXPIRE_IN_HOURS * time.Hour)
 	expireFmt := expireAt.UTC().Format(timeFormat)
 	src := fmt.Sprintf(`{"expiration": "%s",
 	"conditions": [
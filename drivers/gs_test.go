@@ -0,0 +1,121 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestGsReadData(t *testing.T) {
+	require := require.New(t)
+	content := []byte("0123456789abcdefghij")
+	updated := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	objects := map[string]bool{"rec/1.ts": true, "/legacy.ts": true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket-name/o/") {
+			// the media requests of the objects
+			assert.True(t, objects[strings.TrimPrefix(r.URL.Path, "/bucket-name/")], r.URL.Path)
+			w.Header().Set("Content-Type", "video/mp2t")
+			if r.Header.Get("Range") != "" {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			http.ServeContent(w, r, "", updated, bytes.NewReader(content))
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket-name/o/")
+		if !objects[name] {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(objects, name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"bucket":          "bucket-name",
+			"name":            name,
+			"size":            "20",
+			"etag":            "CKih16GjycICEAE=",
+			"updated":         updated.Format(time.RFC3339),
+			"contentType":     "video/mp2t",
+			"contentEncoding": "gzip",
+			"metadata":        map[string]string{"duration": "2.0", "codecs": "avc1"},
+		})
+	}))
+	defer srv.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(err)
+	drv, err := NewGoogleDriver("bucket-name", "", true)
+	require.NoError(err)
+	sess := drv.NewSession("").(*gsSession)
+	sess.client = client
+
+	res, err := sess.ReadData(context.Background(), "rec/1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Equal(content, data)
+	require.Equal("rec/1.ts", res.Name)
+	require.Equal(int64(20), *res.Size)
+	require.Equal(int64(20), res.ContentLength)
+	require.Equal("CKih16GjycICEAE=", res.ETag)
+	require.Equal(updated, res.LastModified.UTC())
+	require.Equal("video/mp2t", res.ContentType)
+	require.Equal(map[string]string{"duration": "2.0", "codecs": "avc1"}, res.Metadata)
+	require.Empty(res.ContentRange)
+	require.Empty(res.ContentEncoding)
+
+	// the ranges are of the data as stored
+	res, err = sess.ReadDataRange(context.Background(), "rec/1.ts", "bytes=10-14")
+	require.NoError(err)
+	data, err = io.ReadAll(res.Body)
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Equal("abcde", string(data))
+	require.Equal(int64(20), *res.Size)
+	require.Equal(int64(5), res.ContentLength)
+	require.Equal("bytes 10-14/20", res.ContentRange)
+	require.Equal("gzip", res.ContentEncoding)
+	require.Equal("video/mp2t", res.ContentType)
+	require.Equal(map[string]string{"duration": "2.0", "codecs": "avc1"}, res.Metadata)
+
+	_, err = sess.ReadDataRange(context.Background(), "rec/1.ts", "bytes=20-")
+	require.ErrorContains(err, "not satisfiable")
+	_, err = sess.ReadData(context.Background(), "rec/2.ts")
+	require.ErrorIs(err, ErrNotExist)
+
+	// the names are normalized like the saved ones
+	res, err = sess.ReadData(context.Background(), "rec//1.ts")
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	recSess := drv.NewSession("rec").(*gsSession)
+	recSess.client = client
+	res, err = recSess.ReadData(context.Background(), "1.ts")
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	// the files saved with a leading slash by the sessions without a key prefix are still read
+	data, _, err = ReadFile(context.Background(), sess, "legacy.ts")
+	require.NoError(err)
+	require.Equal(content, data)
+
+	// and deleted
+	require.NoError(sess.DeleteFile(context.Background(), "legacy.ts"))
+	require.False(objects["/legacy.ts"])
+	require.ErrorIs(sess.DeleteFile(context.Background(), "legacy.ts"), storage.ErrObjectNotExist)
+	require.NoError(recSess.DeleteFile(context.Background(), "/1.ts"))
+	require.False(objects["rec/1.ts"])
+}
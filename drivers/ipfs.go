@@ -2,19 +2,57 @@ package drivers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"path"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/livepeer/go-tools/clients"
 )
 
+const (
+	pinataGatewayURL = "https://gateway.pinata.cloud/ipfs/"
+	// defaultIpfsReadRetries is the number of times a read is retried on a transient gateway error
+	defaultIpfsReadRetries = 3
+	// defaultIpfsReadBackoff is the delay before the first retry, doubled on each subsequent one
+	defaultIpfsReadBackoff = 500 * time.Millisecond
+	// ipfsNotFoundRetries limits the retries of 404 errors, which the gateway returns for content
+	// that was just pinned and hasn't propagated yet
+	ipfsNotFoundRetries = 1
+	// ipfsDefaultSaveTimeout is used on save ops when no custom timeout is provided
+	ipfsDefaultSaveTimeout = 5 * time.Minute
+	// ipfsIdempotencyKey is the pin metadata key storing FileProperties.IdempotencyKey
+	ipfsIdempotencyKey = "idempotencyKey"
+)
+
 type IpfsOS struct {
-	key    string
-	secret string
+	key        string
+	secret     string
+	gatewayURL string
+	// apiURL overrides the Pinata API URL, used in tests
+	apiURL string
+
+	// ReadRetries is the number of times ReadData retries a read failing with a 429 or 5xx gateway
+	// response. Zero means the default of 3, negative disables the retries.
+	ReadRetries int
+	// ReadRetryBackoff is the delay before the first retry, doubled on each subsequent one. Zero
+	// means the default of 500ms.
+	ReadRetryBackoff time.Duration
+	// GroupID is the id of the Pinata group the saved files are added to. Empty means no group.
+	GroupID string
+	// CIDVersion is the version of the CIDs of the saved files. Nil means CIDv1, which the driver
+	// has always pinned.
+	CIDVersion *int
+	// Regions are the Pinata regions the saved files are replicated to. Empty means the account's
+	// default pin policy.
+	Regions []clients.PinRegion
+	// NodeURL is the address of the gateway of an IPFS node the reads go through instead of the
+	// Pinata public gateway, like http://127.0.0.1:8080 for a local node. The files are read from
+	// its /ipfs/ path. Empty means the public gateway.
+	NodeURL string
 }
 
 var _ OSSession = (*IpfsSession)(nil)
@@ -23,36 +61,50 @@ type IpfsSession struct {
 	os       *IpfsOS
 	filename string
 	client   clients.IPFS
-	dCache   map[string]*dataCache
-	dLock    sync.RWMutex
 }
 
 func NewIpfsDriver(key, secret string) *IpfsOS {
-	return &IpfsOS{key: key, secret: secret}
+	return &IpfsOS{key: key, secret: secret, gatewayURL: pinataGatewayURL}
 }
 
 func (ostore *IpfsOS) NewSession(filename string) OSSession {
 	if filename != "" {
 		panic("File names are not supported by Pinata IPFS driver")
 	}
-	var client clients.IPFS
-	if ostore.key != "" {
-		client = clients.NewPinataClientAPIKey(ostore.key, ostore.secret, map[string]string{})
-	} else {
-		client = clients.NewPinataClientJWT(ostore.secret, map[string]string{})
-	}
 	session := &IpfsSession{
 		os:       ostore,
 		filename: filename,
-		dCache:   make(map[string]*dataCache),
-		dLock:    sync.RWMutex{},
-		client:   client,
+		client:   ostore.newClient(),
 	}
 	return session
 }
 
+func (ostore *IpfsOS) newClient() clients.IPFS {
+	if ostore.apiURL != "" {
+		return clients.NewPinataClient(ostore.apiURL, ostore.key, ostore.secret, map[string]string{})
+	}
+	if ostore.key != "" {
+		return clients.NewPinataClientAPIKey(ostore.key, ostore.secret, map[string]string{})
+	}
+	return clients.NewPinataClientJWT(ostore.secret, map[string]string{})
+}
+
+// HealthCheck checks that Pinata accepts the credentials
+func (ostore *IpfsOS) HealthCheck(ctx context.Context) error {
+	err := ostore.newClient().TestAuthentication(ctx)
+	if err == nil {
+		return nil
+	}
+	status := 0
+	var statusErr *clients.HTTPStatusError
+	if errors.As(err, &statusErr) {
+		status = statusErr.Status
+	}
+	return healthCheckError("pinata", status, err)
+}
+
 func (ostore *IpfsOS) UriSchemes() []string {
-	return []string{"ipfs://pinata.cloud"}
+	return []string{"ipfs"}
 }
 
 func (ostore *IpfsOS) Description() string {
@@ -63,6 +115,10 @@ func (ostore *IpfsOS) Publish(ctx context.Context) (string, error) {
 	return "", ErrNotSupported
 }
 
+func (ostore *IpfsOS) Shutdown(ctx context.Context) error {
+	return nil
+}
+
 func (session *IpfsSession) OS() OSDriver {
 	return session.os
 }
@@ -85,18 +141,17 @@ func (session *IpfsSession) ListFiles(ctx context.Context, cid, delim string) (P
 	return pi, err
 }
 
-func (session *IpfsSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+func (session *IpfsSession) ReadData(ctx context.Context, name string) (res *FileInfoReader, err error) {
+	defer recordRead("ipfs", time.Now(), &res, &err)
 	fullPath := path.Join(session.filename, name)
-	// just get the file through Pinata HTTP gateway
-	resp, err := http.Get("https://gateway.pinata.cloud/ipfs/" + fullPath)
+	// just get the file through the HTTP gateway
+	gatewayURL := session.os.gateway() + fullPath
+	Log.Debugf("Reading IPFS file from gateway url=%s", gatewayURL)
+	resp, err := session.getWithRetries(ctx, gatewayURL, "")
 	if err != nil {
 		return nil, err
-	} else if resp.StatusCode == http.StatusNotFound {
-		return nil, ErrNotExist
-	} else if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("failed to read IPFS file: %d %s", resp.StatusCode, resp.Status)
 	}
-	res := &FileInfoReader{
+	res = &FileInfoReader{
 		FileInfo: FileInfo{
 			Name: name,
 			Size: nil,
@@ -106,14 +161,118 @@ func (session *IpfsSession) ReadData(ctx context.Context, name string) (*FileInf
 	return res, nil
 }
 
-func (session *IpfsSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
-	return nil, ErrNotSupported
+func (ostore *IpfsOS) gateway() string {
+	if ostore.NodeURL != "" {
+		return strings.TrimSuffix(ostore.NodeURL, "/") + "/ipfs/"
+	}
+	if ostore.gatewayURL == "" {
+		return pinataGatewayURL
+	}
+	return ostore.gatewayURL
+}
+
+// getWithRetries gets the url from the gateway, retrying with exponential backoff while it
+// responds with 429 or 5xx, or with 404 up to ipfsNotFoundRetries times. A non-empty byteRange is
+// sent as the Range header.
+func (session *IpfsSession) getWithRetries(ctx context.Context, url, byteRange string) (*http.Response, error) {
+	retries, backoff := session.os.ReadRetries, session.os.ReadRetryBackoff
+	if retries == 0 {
+		retries = defaultIpfsReadRetries
+	}
+	if backoff == 0 {
+		backoff = defaultIpfsReadBackoff
+	}
+	notFound := 0
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		resp, err := httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		retriable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if resp.StatusCode == http.StatusNotFound {
+			retriable = notFound < ipfsNotFoundRetries
+			notFound++
+		}
+		if !retriable || attempt >= retries {
+			if resp.StatusCode == http.StatusNotFound {
+				return nil, ErrNotExist
+			}
+			return nil, fmt.Errorf("failed to read IPFS file: %d %s", resp.StatusCode, resp.Status)
+		}
+		Log.Warnf("Retrying IPFS gateway read url=%s status=%d attempt=%d", url, resp.StatusCode, attempt+1)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// ReadDataRange reads part of the file from the gateway with a Range request. The Size of the
+// returned file is taken from the Content-Range of the partial response.
+func (session *IpfsSession) ReadDataRange(ctx context.Context, name, byteRange string) (res *FileInfoReader, err error) {
+	defer recordRead("ipfs", time.Now(), &res, &err)
+	gatewayURL := session.os.gateway() + path.Join(session.filename, name)
+	resp, err := session.getWithRetries(ctx, gatewayURL, byteRange)
+	if err != nil {
+		return nil, err
+	}
+	res = &FileInfoReader{
+		FileInfo:      FileInfo{Name: name},
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+		Body:          resp.Body,
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		res.ContentRange = resp.Header.Get("Content-Range")
+		if size, ok := contentRangeSize(res.ContentRange); ok {
+			res.Size = &size
+		}
+	} else if resp.ContentLength >= 0 {
+		// the gateway ignored the range and returned the whole file
+		res.Size = &resp.ContentLength
+	}
+	return res, nil
 }
 
 func (session *IpfsSession) Presign(name string, expire time.Duration) (string, error) {
 	return "", ErrNotSupported
 }
 
+func (session *IpfsSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (session *IpfsSession) PublicURL(name string) (string, error) {
+	return "ipfs://" + path.Join(session.filename, name), nil
+}
+
+// ObjectURI is not supported, the IPFS OS URLs only carry the Pinata credentials
+func (session *IpfsSession) ObjectURI(name string) (string, error) {
+	return "", ErrNotSupported
+}
+
+// ReadSeeker reads the ranges of the file from the gateway
+func (session *IpfsSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return newRangeReadSeeker(ctx, session, name)
+}
+
+func (session *IpfsSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, session, name, srcPath, fields)
+}
+
 func (session *IpfsSession) IsExternal() bool {
 	return false
 }
@@ -122,25 +281,97 @@ func (session *IpfsSession) IsOwn(url string) bool {
 	return true
 }
 
+// GetInfo carries the Pinata credentials, so it should only be handed to trusted nodes
 func (session *IpfsSession) GetInfo() *OSInfo {
-	return nil
+	return &OSInfo{
+		StorageType: OSInfo_IPFS,
+		IpfsInfo: &IpfsOSInfo{
+			Key:        session.os.key,
+			Secret:     session.os.secret,
+			GatewayURL: session.os.gatewayURL,
+		},
+	}
+}
+
+func newIpfsSession(info *IpfsOSInfo) OSSession {
+	if info == nil {
+		return nil
+	}
+	ostore := NewIpfsDriver(info.Key, info.Secret)
+	if info.GatewayURL != "" {
+		ostore.gatewayURL = info.GatewayURL
+	}
+	return ostore.NewSession("")
 }
 
 func (ostore *IpfsSession) DeleteFile(ctx context.Context, name string) error {
 	return ErrNotSupported
 }
 
-func (session *IpfsSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+// PrefixSize is not supported, the pins aren't listed by name
+func (session *IpfsSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+// Rename is not supported, the content is addressed by its CID
+func (session *IpfsSession) Rename(ctx context.Context, oldName, newName string) error {
+	return ErrNotSupported
+}
+
+func (session *IpfsSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("ipfs", time.Now(), counter, &err)
+	ctx, cancel := withSaveTimeout(ctx, timeout, ipfsDefaultSaveTimeout)
+	defer cancel()
 	// concatenate filename with name argument to get full filename, both may be empty
 	fullPath := session.getAbsolutePath(name)
+	contentType := ""
+	var keyvalues map[string]string
+	if fields != nil {
+		contentType, keyvalues = fields.ContentType, fields.Metadata
+	}
+	if fields != nil && fields.IdempotencyKey != "" {
+		pin, err := session.client.FindPin(ctx, ipfsIdempotencyKey, fields.IdempotencyKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the pin of idempotency key %s: %w", fields.IdempotencyKey, err)
+		}
+		if pin != nil {
+			return &SaveDataOutput{URL: pin.IPFSPinHash}, nil
+		}
+		keyvalues = copyMetadata(keyvalues)
+		if keyvalues == nil {
+			keyvalues = map[string]string{}
+		}
+		keyvalues[ipfsIdempotencyKey] = fields.IdempotencyKey
+	}
 	if fullPath == "" {
-		// pinata requires name to be set
-		fullPath = "data.bin"
+		// pinata requires name to be set, and the gateways infer the content type from its extension
+		ext, err := ExtensionByType(contentType)
+		if err != nil {
+			ext = ".bin"
+		}
+		fullPath = "data" + ext
+	}
+	if contentType == "" {
+		contentType, _ = TypeByExtension(path.Ext(fullPath))
 	}
-	cid, _, err := session.client.PinContent(ctx, fullPath, "", data)
+	cid, _, err := session.client.PinContent(ctx, fullPath, contentType, data, clients.PinOptions{
+		KeyValues:  keyvalues,
+		GroupID:    session.os.GroupID,
+		CIDVersion: session.os.cidVersion(),
+		Regions:    session.os.Regions,
+	})
 	return &SaveDataOutput{URL: cid}, err
 }
 
+func (ostore *IpfsOS) cidVersion() *int {
+	if ostore.CIDVersion != nil {
+		return ostore.CIDVersion
+	}
+	version := 1
+	return &version
+}
+
 func (session *IpfsSession) getAbsolutePath(name string) string {
 	resPath := path.Clean(session.filename + "/" + name)
 	if resPath == "/" {
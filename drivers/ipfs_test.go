@@ -4,10 +4,16 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/livepeer/go-tools/clients"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -45,3 +51,300 @@ func TestIpfsOS(t *testing.T) {
 	ipfsData.ReadFrom(ipfsInfo.Body)
 	assert.Equal(rndData, ipfsData.Bytes())
 }
+
+func TestIpfsReadDataRetries(t *testing.T) {
+	assert := assert.New(t)
+	var requests int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("content of " + r.URL.Path))
+		}
+	}))
+	defer gateway.Close()
+
+	storage := NewIpfsDriver("key", "secret")
+	storage.gatewayURL = gateway.URL + "/ipfs/"
+	storage.ReadRetryBackoff = time.Millisecond
+	sess := storage.NewSession("")
+	fi, err := sess.ReadData(context.Background(), "bafybeigdyrzt")
+	assert.NoError(err)
+	data, _ := io.ReadAll(fi.Body)
+	fi.Body.Close()
+	assert.Equal("content of /ipfs/bafybeigdyrzt", string(data))
+	assert.Equal(int32(3), atomic.LoadInt32(&requests))
+
+	// retries exhausted
+	atomic.StoreInt32(&requests, 0)
+	storage.ReadRetries = 1
+	_, err = sess.ReadData(context.Background(), "bafybeigdyrzt")
+	assert.EqualError(err, "failed to read IPFS file: 429 429 Too Many Requests")
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+
+	// 404 is retried only once
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer notFound.Close()
+	atomic.StoreInt32(&requests, 0)
+	storage.gatewayURL = notFound.URL + "/ipfs/"
+	storage.ReadRetries = 0
+	_, err = sess.ReadData(context.Background(), "bafybeigdyrzt")
+	assert.ErrorIs(err, ErrNotExist)
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestIpfsHealthCheck(t *testing.T) {
+	assert := assert.New(t)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/data/testAuthentication", r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"message":"Congratulations! You are communicating with the Pinata API!"}`)
+	}))
+	defer api.Close()
+
+	storage := NewIpfsDriver("", "jwt")
+	storage.apiURL = api.URL
+	assert.NoError(storage.HealthCheck(context.Background()))
+	storage = NewIpfsDriver("", "wrong")
+	storage.apiURL = api.URL
+	assert.ErrorIs(storage.HealthCheck(context.Background()), ErrUnauthorized)
+	api.Close()
+	assert.ErrorContains(storage.HealthCheck(context.Background()), "unreachable")
+}
+
+func TestIpfsCancelledContext(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// hang until the client gives up or the test ends
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	storage := NewIpfsDriver("", "jwt")
+	storage.apiURL = srv.URL
+	storage.gatewayURL = srv.URL + "/ipfs/"
+	sess := storage.NewSession("")
+
+	start := time.Now()
+	_, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader([]byte("segment")), nil, 100*time.Millisecond)
+	assert.Error(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = sess.ReadData(ctx, "bafybeigdyrzt")
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Less(time.Since(start), 2*time.Second)
+}
+
+func TestIpfsReadDataRange(t *testing.T) {
+	assert := assert.New(t)
+	content := "0123456789"
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ipfs/bafybeigdyrzt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte(content)))
+	}))
+	defer gateway.Close()
+
+	storage := NewIpfsDriver("key", "secret")
+	storage.gatewayURL = gateway.URL + "/ipfs/"
+	sess := storage.NewSession("")
+	fi, err := sess.ReadDataRange(context.Background(), "bafybeigdyrzt", "bytes=2-5")
+	assert.NoError(err)
+	data, _ := io.ReadAll(fi.Body)
+	fi.Body.Close()
+	assert.Equal("2345", string(data))
+	assert.Equal("bytes 2-5/10", fi.ContentRange)
+	assert.Equal(int64(4), fi.ContentLength)
+	assert.Equal(int64(10), *fi.Size)
+	assert.Equal("video/mp4", fi.ContentType)
+
+	_, err = sess.ReadDataRange(context.Background(), "bafkreimissing", "bytes=2-5")
+	assert.ErrorIs(err, ErrNotExist)
+}
+
+func TestIpfsSaveDataFileName(t *testing.T) {
+	assert := assert.New(t)
+	var fileName, contentType string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/pinning/pinFileToIPFS", r.URL.Path)
+		assert.NoError(r.ParseMultipartForm(1024 * 1024))
+		file := r.MultipartForm.File["file"][0]
+		fileName, contentType = file.Filename, file.Header.Get("Content-Type")
+		fmt.Fprint(w, `{"ipfsHash":"bafybeigdyrzt","pinSize":7}`)
+	}))
+	defer api.Close()
+	storage := NewIpfsDriver("", "jwt")
+	storage.apiURL = api.URL
+	sess := storage.NewSession("")
+
+	out, err := sess.SaveData(context.Background(), "", bytes.NewReader([]byte("segment")), &FileProperties{ContentType: "video/mp2t"}, 0)
+	assert.NoError(err)
+	assert.Equal("bafybeigdyrzt", out.URL)
+	assert.Equal("data.ts", fileName)
+	assert.Equal("video/mp2t", contentType)
+
+	_, err = sess.SaveData(context.Background(), "index.m3u8", bytes.NewReader([]byte("#EXTM3U")), nil, 0)
+	assert.NoError(err)
+	assert.Equal("index.m3u8", fileName)
+	assert.Equal("application/x-mpegurl", contentType)
+
+	_, err = sess.SaveData(context.Background(), "", bytes.NewReader([]byte("data")), nil, 0)
+	assert.NoError(err)
+	assert.Equal("data.bin", fileName)
+}
+
+func TestIpfsSaveDataPinataMetadata(t *testing.T) {
+	assert := assert.New(t)
+	var pinataMetadata, pinataOptions map[string]interface{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(r.ParseMultipartForm(1024 * 1024))
+		pinataMetadata, pinataOptions = nil, nil
+		if metadata := r.FormValue("pinataMetadata"); metadata != "" {
+			assert.NoError(json.Unmarshal([]byte(metadata), &pinataMetadata))
+		}
+		assert.NoError(json.Unmarshal([]byte(r.FormValue("pinataOptions")), &pinataOptions))
+		fmt.Fprint(w, `{"ipfsHash":"bafybeigdyrzt","pinSize":7}`)
+	}))
+	defer api.Close()
+	storage := NewIpfsDriver("", "jwt")
+	storage.apiURL = api.URL
+	storage.GroupID = "group-id"
+	sess := storage.NewSession("")
+
+	fields := &FileProperties{Metadata: map[string]string{"stream": "abc", "rendition": "720p"}}
+	_, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader([]byte("segment")), fields, 0)
+	assert.NoError(err)
+	assert.Equal(map[string]interface{}{"stream": "abc", "rendition": "720p"}, pinataMetadata["keyvalues"])
+	assert.Equal(map[string]interface{}{"cidVersion": float64(1), "groupId": "group-id"}, pinataOptions)
+
+	storage.GroupID = ""
+	_, err = sess.SaveData(context.Background(), "2.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	assert.NoError(err)
+	assert.Nil(pinataMetadata)
+	assert.Equal(map[string]interface{}{"cidVersion": float64(1)}, pinataOptions)
+}
+
+func TestIpfsSaveDataPinPolicy(t *testing.T) {
+	assert := assert.New(t)
+	var pinataOptions string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(r.ParseMultipartForm(1024 * 1024))
+		pinataOptions = r.FormValue("pinataOptions")
+		fmt.Fprint(w, `{"ipfsHash":"bafybeigdyrzt","pinSize":7}`)
+	}))
+	defer api.Close()
+	storage := NewIpfsDriver("", "jwt")
+	storage.apiURL = api.URL
+	sess := storage.NewSession("")
+
+	_, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	assert.NoError(err)
+	assert.JSONEq(`{"cidVersion":1}`, pinataOptions)
+
+	version := 0
+	storage.CIDVersion = &version
+	storage.Regions = []clients.PinRegion{{ID: "FRA1", DesiredReplicationCount: 1}, {ID: "NYC1", DesiredReplicationCount: 2}}
+	_, err = sess.SaveData(context.Background(), "1.ts", bytes.NewReader([]byte("segment")), nil, 0)
+	assert.NoError(err)
+	assert.JSONEq(`{"cidVersion":0,"customPinPolicy":{"regions":[
+		{"id":"FRA1","desiredReplicationCount":1},{"id":"NYC1","desiredReplicationCount":2}]}}`, pinataOptions)
+}
+
+func TestIpfsSaveDataIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+	// fake Pinata API whose first pin response is lost after pinning
+	pins := map[string]string{}
+	pinCount := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data/pinList":
+			var filter map[string]map[string]string
+			assert.NoError(json.Unmarshal([]byte(r.URL.Query().Get("metadata[keyvalues]")), &filter))
+			assert.Equal("eq", filter["idempotencyKey"]["op"])
+			if cid, ok := pins[filter["idempotencyKey"]["value"]]; ok {
+				fmt.Fprintf(w, `{"count":1,"rows":[{"ipfs_pin_hash":%q}]}`, cid)
+				return
+			}
+			fmt.Fprint(w, `{"count":0,"rows":[]}`)
+		case "/pinning/pinFileToIPFS":
+			assert.NoError(r.ParseMultipartForm(1024 * 1024))
+			var metadata struct{ KeyValues map[string]string }
+			assert.NoError(json.Unmarshal([]byte(r.FormValue("pinataMetadata")), &metadata))
+			assert.Equal("abc", metadata.KeyValues["stream"])
+			pinCount++
+			pins[metadata.KeyValues["idempotencyKey"]] = fmt.Sprintf("bafybeicid%d", pinCount)
+			if pinCount == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			fmt.Fprintf(w, `{"ipfsHash":"bafybeicid%d","pinSize":7}`, pinCount)
+		}
+	}))
+	defer api.Close()
+	storage := NewIpfsDriver("", "jwt")
+	storage.apiURL = api.URL
+	sess := storage.NewSession("")
+
+	fields := &FileProperties{Metadata: map[string]string{"stream": "abc"}, IdempotencyKey: "abc/1.ts"}
+	out, err := SaveRetried(context.Background(), sess, "1.ts", []byte("segment"), fields, 3)
+	assert.NoError(err)
+	assert.Equal("bafybeicid1", out.URL)
+	assert.Equal(1, pinCount)
+	assert.Equal(map[string]string{"stream": "abc"}, fields.Metadata)
+
+	// another key is pinned
+	fields.IdempotencyKey = "abc/2.ts"
+	out, err = SaveRetried(context.Background(), sess, "2.ts", []byte("segment"), fields, 3)
+	assert.NoError(err)
+	assert.Equal("bafybeicid2", out.URL)
+	assert.Equal(2, pinCount)
+}
+
+func TestIpfsNodeURL(t *testing.T) {
+	assert := assert.New(t)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ipfs/bafybeigdyrzt/1.ts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "1.ts", time.Time{}, bytes.NewReader([]byte("segment")))
+	}))
+	defer node.Close()
+	storage := NewIpfsDriver("", "jwt")
+	storage.NodeURL = node.URL + "/"
+	storage.ReadRetries = -1
+	sess := storage.NewSession("")
+
+	fi, err := sess.ReadData(context.Background(), "bafybeigdyrzt/1.ts")
+	assert.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	assert.NoError(err)
+	assert.Equal("segment", string(data))
+
+	fi, err = sess.ReadDataRange(context.Background(), "bafybeigdyrzt/1.ts", "bytes=0-2")
+	assert.NoError(err)
+	data, err = io.ReadAll(fi.Body)
+	assert.NoError(err)
+	assert.Equal("seg", string(data))
+	assert.Equal(int64(7), *fi.Size)
+
+	_, err = sess.ReadData(context.Background(), "bafybeigdyrzt/2.ts")
+	assert.ErrorIs(err, ErrNotExist)
+}
@@ -0,0 +1,203 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTooManyOperations is returned by the operations of a LimitedOS failing fast while its limit of
+// operations in flight is reached
+var ErrTooManyOperations = fmt.Errorf("too many operations in flight")
+
+// LimitedOS limits the number of operations in flight across all the sessions of the wrapped
+// driver, so that many concurrent streams can't exhaust the file descriptors or the connections of
+// the node. The operations taking a context count, from the call until they return, and the file
+// bodies returned by ReadData and ReadDataRange and the files opened by ReadSeeker until they are
+// closed. Beyond the limit, the operations wait for another one to finish, or fail with
+// ErrTooManyOperations with FailFast.
+//
+// The optional interfaces of the wrapped sessions, like ResumableUploader, are not exposed.
+type LimitedOS struct {
+	OSDriver
+	// FailFast makes the operations fail with ErrTooManyOperations instead of waiting when the limit
+	// is reached
+	FailFast bool
+
+	sem chan struct{}
+}
+
+var _ OSDriver = (*LimitedOS)(nil)
+
+// NewLimitedDriver wraps the driver to run at most maxInFlight operations at once
+func NewLimitedDriver(inner OSDriver, maxInFlight int) *LimitedOS {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &LimitedOS{
+		OSDriver: inner,
+		sem:      make(chan struct{}, maxInFlight),
+	}
+}
+
+func (ostore *LimitedOS) NewSession(path string) OSSession {
+	return &limitedSession{OSSession: ostore.OSDriver.NewSession(path), os: ostore}
+}
+
+// MaxInFlight returns the maximum number of operations in flight
+func (ostore *LimitedOS) MaxInFlight() int {
+	return cap(ostore.sem)
+}
+
+// InFlight returns the number of operations in flight
+func (ostore *LimitedOS) InFlight() int {
+	return len(ostore.sem)
+}
+
+// acquire takes a slot for an operation, returning the function releasing it
+func (ostore *LimitedOS) acquire(ctx context.Context) (func(), error) {
+	if ostore.FailFast {
+		select {
+		case ostore.sem <- struct{}{}:
+		default:
+			return nil, ErrTooManyOperations
+		}
+	} else {
+		select {
+		case ostore.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-ostore.sem })
+	}, nil
+}
+
+type limitedSession struct {
+	OSSession
+	os *LimitedOS
+}
+
+func (ls *limitedSession) OS() OSDriver {
+	return ls.os
+}
+
+func (ls *limitedSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ls.OSSession.SaveData(ctx, name, data, fields, timeout)
+}
+
+func (ls *limitedSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ls.OSSession.SaveFile(ctx, name, srcPath, fields)
+}
+
+func (ls *limitedSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return ls.read(ctx, func() (*FileInfoReader, error) {
+		return ls.OSSession.ReadData(ctx, name)
+	})
+}
+
+func (ls *limitedSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	return ls.read(ctx, func() (*FileInfoReader, error) {
+		return ls.OSSession.ReadDataRange(ctx, name, byteRange)
+	})
+}
+
+// read holds a slot until the body of the file read is closed
+func (ls *limitedSession) read(ctx context.Context, read func() (*FileInfoReader, error)) (*FileInfoReader, error) {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := read()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+func (ls *limitedSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	rs, size, err := ls.OSSession.ReadSeeker(ctx, name)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &limitedReadSeeker{ReadSeekCloser: rs, release: release}, size, nil
+}
+
+func (ls *limitedSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ls.OSSession.ListFiles(ctx, prefix, delim)
+}
+
+func (ls *limitedSession) DeleteFile(ctx context.Context, name string) error {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return ls.OSSession.DeleteFile(ctx, name)
+}
+
+func (ls *limitedSession) Rename(ctx context.Context, oldName, newName string) error {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return ls.OSSession.Rename(ctx, oldName, newName)
+}
+
+func (ls *limitedSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	release, err := ls.os.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return ls.OSSession.PrefixSize(ctx, prefix)
+}
+
+// limitedBody releases the slot of the read when closed
+type limitedBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body *limitedBody) Close() error {
+	defer body.release()
+	return body.ReadCloser.Close()
+}
+
+// limitedReadSeeker releases the slot of the file opened by ReadSeeker when closed
+type limitedReadSeeker struct {
+	io.ReadSeekCloser
+	release func()
+}
+
+func (rs *limitedReadSeeker) Close() error {
+	defer rs.release()
+	return rs.ReadSeekCloser.Close()
+}
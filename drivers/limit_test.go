@@ -0,0 +1,87 @@
+package drivers
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowReader counts the readers being read at once, taking a while to reach the end
+type slowReader struct {
+	started  bool
+	inFlight *int32
+	max      *int32
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		n := atomic.AddInt32(r.inFlight, 1)
+		for {
+			max := atomic.LoadInt32(r.max)
+			if n <= max || atomic.CompareAndSwapInt32(r.max, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		p[0] = 'x'
+		return 1, nil
+	}
+	atomic.AddInt32(r.inFlight, -1)
+	return 0, io.EOF
+}
+
+func TestLimitedDriver(t *testing.T) {
+	require := require.New(t)
+	drv := NewLimitedDriver(NewFSDriver(&url.URL{Path: t.TempDir()}), 3)
+	require.Equal(3, drv.MaxInFlight())
+
+	var inFlight, max int32
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sess := drv.NewSession("stream")
+			_, err := sess.SaveData(context.Background(), strings.Repeat("a", i+1)+".ts", &slowReader{inFlight: &inFlight, max: &max}, nil, 0)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(int32(3), max)
+	require.Equal(0, drv.InFlight())
+
+	// the bodies of the files read hold their slot until closed
+	drv = NewLimitedDriver(NewFSDriver(&url.URL{Path: t.TempDir()}), 1)
+	sess := drv.NewSession("")
+	require.Equal(drv, sess.OS())
+	_, err := sess.SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	fi, err := sess.ReadData(context.Background(), "1.ts")
+	require.NoError(err)
+	require.Equal(1, drv.InFlight())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = sess.SaveData(ctx, "2.ts", strings.NewReader("data"), nil, 0)
+	require.ErrorIs(err, context.DeadlineExceeded)
+	drv.FailFast = true
+	_, err = sess.ReadData(context.Background(), "1.ts")
+	require.ErrorIs(err, ErrTooManyOperations)
+
+	require.NoError(fi.Body.Close())
+	// closing again doesn't release another slot
+	_ = fi.Body.Close()
+	require.Equal(0, drv.InFlight())
+	_, err = sess.ReadData(context.Background(), "2.ts")
+	require.ErrorIs(err, ErrNotExist)
+	require.Equal(0, drv.InFlight())
+}
@@ -3,9 +3,12 @@ package drivers
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
@@ -55,8 +58,83 @@ func (ostore *MemoryOS) NewSession(path string) OSSession {
 	return session
 }
 
+// Publish has nothing to publish, like the FS driver. It returns the base URL of the files of all
+// the sessions.
 func (ostore *MemoryOS) Publish(ctx context.Context) (string, error) {
-	return "", ErrNotSupported
+	if ostore.baseURI != nil {
+		return ostore.baseURI.String() + "/stream", nil
+	}
+	return "/stream", nil
+}
+
+// Shutdown ends all the open sessions, dropping the data held in memory
+func (ostore *MemoryOS) Shutdown(ctx context.Context) error {
+	ostore.lock.RLock()
+	sessions := make([]*MemorySession, 0, len(ostore.sessions))
+	for _, sess := range ostore.sessions {
+		sessions = append(sessions, sess)
+	}
+	ostore.lock.RUnlock()
+	for _, sess := range sessions {
+		sess.EndSession()
+	}
+	return nil
+}
+
+// Snapshot returns a copy of all the data held by the driver, keyed by the path of each file
+// including the session path, e.g. "sess/rec/1.ts".
+func (ostore *MemoryOS) Snapshot() map[string][]byte {
+	ostore.lock.RLock()
+	defer ostore.lock.RUnlock()
+	snapshot := make(map[string][]byte)
+	for _, sess := range ostore.sessions {
+		sess.dLock.RLock()
+		for dir, cache := range sess.dCache {
+			for _, it := range cache.cache {
+				if it.name != "" {
+					snapshot[dir+it.name] = append([]byte(nil), it.data...)
+				}
+			}
+		}
+		sess.dLock.RUnlock()
+	}
+	return snapshot
+}
+
+// Restore replaces the data held by the driver with the files of a snapshot, keyed like in
+// Snapshot. Each file goes to the open session with the longest path the file is under, or to a
+// new session named after the first element of its path. Like with SaveData, only the last
+// dataCacheLen files of each directory are kept.
+func (ostore *MemoryOS) Restore(snapshot map[string][]byte) {
+	ostore.lock.Lock()
+	defer ostore.lock.Unlock()
+	for _, sess := range ostore.sessions {
+		sess.dLock.Lock()
+		sess.dCache = make(map[string]*dataCache)
+		sess.dLock.Unlock()
+	}
+	for name, data := range snapshot {
+		dir, file := path.Split(path.Clean(name))
+		var sess *MemorySession
+		for sessPath, s := range ostore.sessions {
+			if strings.HasPrefix(dir, sessPath+"/") && (sess == nil || len(sessPath) > len(sess.path)) {
+				sess = s
+			}
+		}
+		if sess == nil {
+			sessPath := strings.Split(dir, "/")[0]
+			sess = &MemorySession{os: ostore, path: sessPath, dCache: make(map[string]*dataCache)}
+			ostore.sessions[sessPath] = sess
+		}
+		sess.dLock.Lock()
+		sess.getCacheForStream(dir).Insert(file, append([]byte(nil), data...), nil)
+		sess.dLock.Unlock()
+	}
+}
+
+// HealthCheck always succeeds, as the data is held in memory
+func (ostore *MemoryOS) HealthCheck(ctx context.Context) error {
+	return nil
 }
 
 func (ostore *MemoryOS) GetSession(path string) *MemorySession {
@@ -90,13 +168,22 @@ func (ostore *MemorySession) DeleteFile(ctx context.Context, name string) error
 	return ErrNotSupported
 }
 
+func (ostore *MemorySession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return listedPrefixSize(ctx, ostore, prefix)
+}
+
+func (ostore *MemorySession) Rename(ctx context.Context, oldName, newName string) error {
+	return ErrNotSupported
+}
+
 func (ostore *MemorySession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
 	pi := &singlePageInfo{}
 	if prefix == "" {
 		return pi, nil
 	}
-	ostore.dLock.RLock()
-	defer ostore.dLock.RUnlock()
+	dataSess := ostore.dataSession(strings.Split(prefix, "/")[0])
+	dataSess.dLock.RLock()
+	defer dataSess.dLock.RUnlock()
 	cprefix := prefix
 	pprefix := ""
 	if cprefix != "" && string(cprefix[len(cprefix)-1]) != "/" {
@@ -104,15 +191,7 @@ func (ostore *MemorySession) ListFiles(ctx context.Context, prefix, delim string
 		cprefix = strings.Join(pp[:len(pp)-1], "/") + "/"
 		pprefix = pp[len(pp)-1]
 	}
-	dCache := ostore.dCache
-	if prefix != "" && Testing {
-		sid := strings.Split(prefix, "/")[0]
-		if osess, has := ostore.os.sessions[sid]; has {
-			dCache = osess.dCache
-		}
-	}
-
-	for cachePath, cache := range dCache {
+	for cachePath, cache := range dataSess.dCache {
 		if strings.HasPrefix(cachePath, cprefix) {
 			for _, it := range cache.cache {
 				if it.name != "" {
@@ -143,18 +222,21 @@ func (ostore *MemorySession) ListFiles(ctx context.Context, prefix, delim string
 	return pi, nil
 }
 
-func (ostore *MemorySession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
-	data := ostore.GetData(name)
-	if data == nil {
+func (ostore *MemorySession) ReadData(ctx context.Context, name string) (res *FileInfoReader, err error) {
+	defer recordRead("memory", time.Now(), &res, &err)
+	item, ok := ostore.getItem(name)
+	if !ok {
 		return nil, ErrNotExist
 	}
-	size := int64(len(data))
-	res := &FileInfoReader{
+	size := int64(len(item.data))
+	res = &FileInfoReader{
 		FileInfo: FileInfo{
 			Name: name,
 			Size: &size,
 		},
-		Body: ioutil.NopCloser(bytes.NewReader(data)),
+		Metadata:    copyMetadata(item.metadata),
+		ContentType: item.contentType,
+		Body:        ioutil.NopCloser(bytes.NewReader(item.data)),
 	}
 	return res, nil
 }
@@ -172,6 +254,14 @@ func (ostore *MemorySession) ReadDataRange(ctx context.Context, name, byteRange
 // - /stream/ + ostore.path + path + file (if ostore.os.baseURI is empty)
 // - ostore.path + path + file
 func (ostore *MemorySession) GetData(name string) []byte {
+	if item, ok := ostore.getItem(name); ok {
+		return item.data
+	}
+	return nil
+}
+
+// getItem returns a copy of the cached file for a name, see GetData
+func (ostore *MemorySession) getItem(name string) (dataCacheItem, bool) {
 	// Since the memory cache uses the path as the key for fetching data we make sure that
 	// ostore.os.baseURI and /stream/ are stripped before splitting into a path and a filename
 	prefix := ""
@@ -182,25 +272,100 @@ func (ostore *MemorySession) GetData(name string) []byte {
 
 	path, file := path.Split(strings.TrimPrefix(name, prefix))
 
-	ostore.dLock.RLock()
-	defer ostore.dLock.RUnlock()
-	dCache := ostore.dCache
-	if Testing {
-		sid := strings.Split(path, "/")[0]
-		if osess, has := ostore.os.sessions[sid]; has {
-			dCache = osess.dCache
-		}
+	dataSess := ostore.dataSession(strings.Split(path, "/")[0])
+	dataSess.dLock.RLock()
+	defer dataSess.dLock.RUnlock()
+	if cache, ok := dataSess.dCache[path]; ok {
+		return cache.Get(file)
 	}
-	if cache, ok := dCache[path]; ok {
-		return cache.GetData(file)
+	return dataCacheItem{}, false
+}
+
+// dataSession returns the session holding the data of the given session path. In tests, the data
+// saved by any session of the driver can be read through any other session.
+func (ostore *MemorySession) dataSession(sid string) *MemorySession {
+	if !Testing {
+		return ostore
 	}
-	return nil
+	ostore.os.lock.RLock()
+	defer ostore.os.lock.RUnlock()
+	if osess, has := ostore.os.sessions[sid]; has {
+		return osess
+	}
+	return ostore
 }
 
 func (ostore *MemorySession) Presign(name string, expire time.Duration) (string, error) {
 	return "", ErrNotSupported
 }
 
+func (ostore *MemorySession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (ostore *MemorySession) PublicURL(name string) (string, error) {
+	return ostore.getAbsoluteURI(name), nil
+}
+
+// ObjectURI returns the memory:// URL of the file, if the driver was created by ParseOSURL in tests
+func (ostore *MemorySession) ObjectURI(name string) (string, error) {
+	testMemoryStoragesLock.Lock()
+	defer testMemoryStoragesLock.Unlock()
+	for host, os := range TestMemoryStorages {
+		if os == ostore.os {
+			u := &url.URL{Scheme: "memory", Host: host, Path: "/" + ostore.getAbsolutePath(name)}
+			return u.String(), nil
+		}
+	}
+	return "", ErrNotSupported
+}
+
+func (ostore *MemorySession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	item, ok := ostore.getItem(name)
+	if !ok {
+		return nil, 0, ErrNotExist
+	}
+	return nopReadSeekCloser{bytes.NewReader(item.data)}, int64(len(item.data)), nil
+}
+
+func (ostore *MemorySession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, ostore, name, srcPath, fields)
+}
+
+// memoryObjectOS is the driver of the memory:// URL of a file, whose sessions read the file when
+// given an empty name
+type memoryObjectOS struct {
+	*MemoryOS
+	name string
+}
+
+func (ostore *memoryObjectOS) NewSession(path string) OSSession {
+	return &memoryObjectSession{MemorySession: ostore.MemoryOS.NewSession(path).(*MemorySession), name: ostore.name}
+}
+
+type memoryObjectSession struct {
+	*MemorySession
+	name string
+}
+
+func (session *memoryObjectSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	if name == "" {
+		name = session.name
+	}
+	return session.MemorySession.ReadData(ctx, name)
+}
+
+func (session *memoryObjectSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	if name == "" {
+		name = session.name
+	}
+	return session.MemorySession.ReadSeeker(ctx, name)
+}
+
+func (session *memoryObjectSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, session, name, srcPath, fields)
+}
+
 func (ostore *MemorySession) IsExternal() bool {
 	return false
 }
@@ -221,7 +386,9 @@ func (ostore *MemoryOS) Description() string {
 	return "Memory driver."
 }
 
-func (ostore *MemorySession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+func (ostore *MemorySession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("memory", time.Now(), counter, &err)
 	path, file := path.Split(ostore.getAbsolutePath(name))
 
 	ostore.dLock.Lock()
@@ -231,14 +398,20 @@ func (ostore *MemorySession) SaveData(ctx context.Context, name string, data io.
 		return nil, fmt.Errorf("Session ended")
 	}
 
+	data, _ = withMaxBytes(data, fields)
 	bytes, err := ioutil.ReadAll(data)
 	if err != nil {
 		return nil, err
 	}
 	dc := ostore.getCacheForStream(path)
-	dc.Insert(file, bytes)
+	dc.Insert(file, bytes, fields)
 
-	return &SaveDataOutput{URL: ostore.getAbsoluteURI(name)}, nil
+	checksum := sha256.Sum256(bytes)
+	return &SaveDataOutput{
+		URL:               ostore.getAbsoluteURI(name),
+		Checksum:          hex.EncodeToString(checksum[:]),
+		ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+	}, nil
 }
 
 func (ostore *MemorySession) getCacheForStream(streamID string) *dataCache {
@@ -262,6 +435,8 @@ func (ostore *MemorySession) getAbsoluteURI(name string) string {
 	return name
 }
 
+// dataCache holds the data saved by the memory driver under a directory. Only the last
+// dataCacheLen files of each directory are kept, older ones are overwritten.
 type dataCache struct {
 	cacheLen int
 	nextFree int
@@ -269,37 +444,51 @@ type dataCache struct {
 }
 
 type dataCacheItem struct {
-	name string
-	data []byte
+	name        string
+	data        []byte
+	contentType string
+	metadata    map[string]string
 }
 
 func newDataCache(len int) *dataCache {
 	return &dataCache{cacheLen: len, cache: make([]dataCacheItem, len)}
 }
 
-func (dc *dataCache) Insert(name string, data []byte) {
+// Insert caches the data with the content type and metadata of the fields. Like with the S3
+// driver, the content type defaults to the one of the file extension, or is detected from the data.
+func (dc *dataCache) Insert(name string, data []byte, fields *FileProperties) {
+	newItem := dataCacheItem{name: name, data: data}
+	if fields != nil {
+		newItem.contentType = fields.ContentType
+		newItem.metadata = copyMetadata(fields.Metadata)
+	}
+	if newItem.contentType == "" {
+		var err error
+		if newItem.contentType, err = TypeByExtension(path.Ext(name)); err != nil {
+			newItem.contentType = http.DetectContentType(data)
+		}
+	}
 	// replace existing item
 	for i, item := range dc.cache {
 		if item.name == name {
-			dc.cache[i] = dataCacheItem{name: name, data: data}
+			dc.cache[i] = newItem
 			return
 		}
 	}
-	dc.cache[dc.nextFree].name = name
-	dc.cache[dc.nextFree].data = data
+	dc.cache[dc.nextFree] = newItem
 	dc.nextFree++
 	if dc.nextFree >= dc.cacheLen {
 		dc.nextFree = 0
 	}
 }
 
-func (dc *dataCache) GetData(name string) []byte {
-	for _, s := range dc.cache {
-		if s.name == name {
-			return s.data
+func (dc *dataCache) Get(name string) (dataCacheItem, bool) {
+	for _, item := range dc.cache {
+		if item.name == name {
+			return item, true
 		}
 	}
-	return nil
+	return dataCacheItem{}, false
 }
 
 type singlePageInfo struct {
@@ -2,10 +2,13 @@ package drivers
 
 import (
 	"context"
+	"io"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -66,3 +69,177 @@ func TestLocalOS(t *testing.T) {
 	data = sess.GetData(path)
 	require.Equal(t, tempData1, string(data))
 }
+
+func TestLocalOSChecksum(t *testing.T) {
+	sess := NewMemoryDriver(nil).NewSession("sesspath")
+	out, err := sess.SaveData(context.TODO(), "name1/1.ts", strings.NewReader("dataitselftempdata1"), nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, "416d3322c0a9680a3c691afed1699423dad5b7634b8a58427bd91861a3a63ff8", out.Checksum)
+	require.Equal(t, ChecksumAlgorithmSHA256, out.ChecksumAlgorithm)
+}
+
+func TestLocalOSShutdown(t *testing.T) {
+	os := NewMemoryDriver(nil)
+	sess := os.NewSession("sesspath").(*MemorySession)
+	_, err := sess.SaveData(context.TODO(), "name1/1.ts", strings.NewReader("dataitselftempdata1"), nil, 0)
+	require.NoError(t, err)
+	require.NotNil(t, os.GetSession("sesspath"))
+
+	require.NoError(t, os.Shutdown(context.TODO()))
+	require.Nil(t, os.GetSession("sesspath"))
+	require.Nil(t, sess.GetData("sesspath/name1/1.ts"))
+	_, err = sess.SaveData(context.TODO(), "name1/2.ts", strings.NewReader("dataitselftempdata2"), nil, 0)
+	require.Error(t, err)
+}
+
+func TestReadFile(t *testing.T) {
+	sess := NewMemoryDriver(nil).NewSession("sesspath")
+	_, err := sess.SaveData(context.TODO(), "name1/1.ts", strings.NewReader("dataitselftempdata1"), nil, 0)
+	require.NoError(t, err)
+
+	data, fi, err := ReadFile(context.TODO(), sess, "sesspath/name1/1.ts")
+	require.NoError(t, err)
+	require.Equal(t, "dataitselftempdata1", string(data))
+	require.Equal(t, "sesspath/name1/1.ts", fi.Name)
+	require.Equal(t, int64(19), *fi.Size)
+
+	data, fi, err = ReadFile(context.TODO(), sess, "sesspath/name1/2.ts")
+	require.ErrorIs(t, err, ErrNotExist)
+	require.Nil(t, data)
+	require.Nil(t, fi)
+}
+
+func TestMemoryOSSnapshotRestore(t *testing.T) {
+	require := require.New(t)
+	drv := NewMemoryDriver(nil)
+	sess := drv.NewSession("sess")
+	_, err := sess.SaveData(context.Background(), "rec/1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	_, err = sess.SaveData(context.Background(), "index.m3u8", strings.NewReader("playlist"), nil, 0)
+	require.NoError(err)
+
+	snapshot := drv.Snapshot()
+	require.Equal(map[string][]byte{
+		"sess/rec/1.ts":   []byte("segment"),
+		"sess/index.m3u8": []byte("playlist"),
+	}, snapshot)
+
+	_, err = sess.SaveData(context.Background(), "rec/2.ts", strings.NewReader("later"), nil, 0)
+	require.NoError(err)
+	drv.Restore(snapshot)
+	require.Equal(snapshot, drv.Snapshot())
+	require.Nil(sess.(*MemorySession).GetData("sess/rec/2.ts"))
+	require.Equal([]byte("segment"), sess.(*MemorySession).GetData("sess/rec/1.ts"))
+
+	// fixtures can be loaded into a fresh driver and read through the sessions opened later
+	fresh := NewMemoryDriver(nil)
+	fresh.Restore(map[string][]byte{"other/data.json": []byte("{}")})
+	_, data, err := readFully(context.Background(), fresh.NewSession("other"), "other/data.json")
+	require.NoError(err)
+	require.Equal("{}", string(data))
+}
+
+func TestMemoryOSPublish(t *testing.T) {
+	require := require.New(t)
+	u, err := url.Parse("fake.com/url")
+	require.NoError(err)
+	drv := NewMemoryDriver(u)
+	out, err := drv.NewSession("sesspath").SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+
+	base, err := drv.Publish(context.Background())
+	require.NoError(err)
+	require.Equal("fake.com/url/stream", base)
+	require.True(strings.HasPrefix(out.URL, base+"/"))
+
+	base, err = NewMemoryDriver(nil).Publish(context.Background())
+	require.NoError(err)
+	require.Equal("/stream", base)
+}
+
+func TestMemoryOSMetadata(t *testing.T) {
+	require := require.New(t)
+	sess := NewMemoryDriver(nil).NewSession("sess")
+	fields := &FileProperties{ContentType: "video/mp4", Metadata: map[string]string{"stream": "abc"}}
+	_, err := sess.SaveData(context.Background(), "rec/init.mp4", strings.NewReader("init"), fields, 0)
+	require.NoError(err)
+	fields.Metadata["stream"] = "changed"
+
+	res, err := sess.ReadData(context.Background(), "sess/rec/init.mp4")
+	require.NoError(err)
+	require.Equal("video/mp4", res.ContentType)
+	require.Equal(map[string]string{"stream": "abc"}, res.Metadata)
+
+	// the content type defaults to the one of the extension
+	_, err = sess.SaveData(context.Background(), "rec/index.m3u8", strings.NewReader("#EXTM3U"), nil, 0)
+	require.NoError(err)
+	res, err = sess.ReadData(context.Background(), "sess/rec/index.m3u8")
+	require.NoError(err)
+	require.Equal("application/x-mpegurl", res.ContentType)
+	require.Nil(res.Metadata)
+}
+
+func TestMemoryOSConcurrentSaveAndRead(t *testing.T) {
+	ctx := context.Background()
+	sess := NewMemoryDriver(nil).NewSession("sess")
+	fields := &FileProperties{Metadata: map[string]string{"stream": "abc"}}
+	_, err := sess.SaveData(ctx, "rec/1.ts", strings.NewReader("segment"), fields, 0)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_, err := sess.SaveData(ctx, "rec/1.ts", strings.NewReader("segment"), fields, 0)
+			assert.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			res, err := sess.ReadData(ctx, "sess/rec/1.ts")
+			if !assert.NoError(t, err) {
+				return
+			}
+			data, err := io.ReadAll(res.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "segment", string(data))
+			assert.Equal(t, "abc", res.Metadata["stream"])
+		}
+	}()
+	wg.Wait()
+}
+
+func TestMemoryOSPrefixSize(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	sess := NewMemoryDriver(nil).NewSession("sess")
+	for name, data := range map[string]string{"rec/hls/1.ts": "segment", "rec/hls/index.m3u8": "#EXTM3U", "other/1.ts": "segment"} {
+		_, err := sess.SaveData(ctx, name, strings.NewReader(data), nil, 0)
+		require.NoError(err)
+	}
+	size, err := sess.PrefixSize(ctx, "sess/rec/")
+	require.NoError(err)
+	require.Equal(int64(14), size)
+	size, err = sess.PrefixSize(ctx, "sess/rec/hls/index")
+	require.NoError(err)
+	require.Equal(int64(7), size)
+	size, err = sess.PrefixSize(ctx, "sess/missing/")
+	require.NoError(err)
+	require.Zero(size)
+
+	_, err = NewIpfsDriver("", "jwt").NewSession("").PrefixSize(ctx, "")
+	require.ErrorIs(err, ErrNotSupported)
+}
+
+func TestMemoryOSEmptyFile(t *testing.T) {
+	require := require.New(t)
+	sess := NewMemoryDriver(nil).NewSession("sess")
+	_, err := sess.SaveData(context.Background(), "1.ts", strings.NewReader(""), nil, 0)
+	require.NoError(err)
+
+	data, _, err := ReadFile(context.Background(), sess, "sess/1.ts")
+	require.NoError(err)
+	require.Empty(data)
+}
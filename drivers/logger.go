@@ -0,0 +1,18 @@
+package drivers
+
+// Logger receives the diagnostic messages of the drivers, e.g. retry attempts or dropped data
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// NoopLogger is a Logger which discards all the messages
+type NoopLogger struct{}
+
+func (NoopLogger) Debugf(format string, args ...interface{}) {}
+func (NoopLogger) Infof(format string, args ...interface{})  {}
+func (NoopLogger) Warnf(format string, args ...interface{})  {}
+
+// Log is the logger used by all the drivers. Set it before the drivers are used.
+var Log Logger = NoopLogger{}
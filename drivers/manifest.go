@@ -0,0 +1,79 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// WriteManifest saves the segments of an HLS or DASH playlist in parallel, using specified number of
+// jobs, and then the playlist itself, so that players never get a playlist referencing segments
+// which are not saved yet. The playlist is not saved if any segment fails. With rollback set, the
+// segments saved successfully are then deleted.
+// Returns the output of saving the playlist.
+func WriteManifest(ctx context.Context, sess OSSession, playlist FileToSave, segments []FileToSave, workers int, rollback bool) (*SaveDataOutput, error) {
+	_, errs := ParallelSaveFiles(ctx, sess, segments, workers)
+	var failed error
+	for i, err := range errs {
+		if err != nil {
+			failed = fmt.Errorf("failed to save segment %s: %w", segments[i].Name, err)
+			break
+		}
+	}
+	if failed != nil {
+		if rollback {
+			deleteSaved(ctx, sess, segments, errs)
+		}
+		return nil, failed
+	}
+	out, err := sess.SaveData(ctx, playlist.Name, bytes.NewReader(playlist.Data), playlist.Fields, 0)
+	if err != nil {
+		if rollback {
+			deleteSaved(ctx, sess, segments, errs)
+		}
+		return nil, fmt.Errorf("failed to save playlist %s: %w", playlist.Name, err)
+	}
+	return out, nil
+}
+
+func deleteSaved(ctx context.Context, sess OSSession, files []FileToSave, errs []error) {
+	for i, file := range files {
+		if errs[i] != nil {
+			continue
+		}
+		if err := sess.DeleteFile(ctx, file.Name); err != nil {
+			Log.Warnf("Failed to delete file on rollback name=%s err=%v", file.Name, err)
+		}
+	}
+}
+
+// manifestContentType is the content type of the sidecar manifests saved by SaveManifest
+const manifestContentType = "application/json"
+
+// SaveManifest saves v encoded as JSON in the sidecar manifest of the file name, stored as
+// name+".json", to carry the metadata of the file, like its duration or codecs, alongside it
+func SaveManifest(ctx context.Context, sess OSSession, name string, v interface{}) (*SaveDataOutput, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest of %s: %w", name, err)
+	}
+	return sess.SaveData(ctx, manifestName(name), bytes.NewReader(data), &FileProperties{ContentType: manifestContentType}, 0)
+}
+
+// ReadManifest decodes the sidecar manifest of the file name saved by SaveManifest into v.
+// Returns ErrNotExist if the file has no manifest.
+func ReadManifest(ctx context.Context, sess OSSession, name string, v interface{}) error {
+	data, _, err := ReadFile(ctx, sess, manifestName(name))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode manifest of %s: %w", name, err)
+	}
+	return nil
+}
+
+func manifestName(name string) string {
+	return name + ".json"
+}
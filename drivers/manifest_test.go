@@ -0,0 +1,79 @@
+package drivers
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteManifest(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	dirURI, _ := url.Parse(dir)
+	sess := NewFSDriver(dirURI).NewSession("")
+
+	playlist := FileToSave{Name: "rec/index.m3u8", Data: []byte("#EXTM3U")}
+	segments := []FileToSave{
+		{Name: "rec/1.ts", Data: []byte("segment 1")},
+		{Name: "rec/2.ts", Data: []byte("segment 2")},
+	}
+	out, err := WriteManifest(context.Background(), sess, playlist, segments, 2, true)
+	assert.NoError(err)
+	assert.Equal(filepath.Join(dir, "rec", "index.m3u8"), out.URL)
+	for _, f := range append(segments, playlist) {
+		data, err := os.ReadFile(filepath.Join(dir, f.Name))
+		assert.NoError(err)
+		assert.Equal(f.Data, data)
+	}
+
+	// the second segment can't be saved under the first one, which is a file
+	playlist = FileToSave{Name: "fail/index.m3u8", Data: []byte("#EXTM3U")}
+	segments = []FileToSave{
+		{Name: "fail/1.ts", Data: []byte("segment 1")},
+		{Name: "fail/1.ts/2.ts", Data: []byte("segment 2")},
+	}
+	_, err = WriteManifest(context.Background(), sess, playlist, segments, 1, false)
+	assert.ErrorContains(err, "failed to save segment fail/1.ts/2.ts")
+	assert.FileExists(filepath.Join(dir, "fail", "1.ts"))
+	assert.NoFileExists(filepath.Join(dir, "fail", "index.m3u8"))
+
+	_, err = WriteManifest(context.Background(), sess, playlist, segments, 1, true)
+	assert.Error(err)
+	assert.NoFileExists(filepath.Join(dir, "fail", "1.ts"))
+	assert.NoFileExists(filepath.Join(dir, "fail", "index.m3u8"))
+}
+
+func TestSidecarManifest(t *testing.T) {
+	assert := assert.New(t)
+	type recording struct {
+		Duration float64  `json:"duration"`
+		Codecs   []string `json:"codecs"`
+	}
+	sess := NewFakeOSSession()
+	ctx := context.Background()
+
+	var got recording
+	assert.ErrorIs(ReadManifest(ctx, sess, "rec/source.mp4", &got), ErrNotExist)
+
+	saved := recording{Duration: 12.5, Codecs: []string{"avc1.64001f", "mp4a.40.2"}}
+	_, err := SaveManifest(ctx, sess, "rec/source.mp4", saved)
+	assert.NoError(err)
+	fi, err := sess.ReadData(ctx, "rec/source.mp4.json")
+	assert.NoError(err)
+	assert.Equal("application/json", fi.ContentType)
+	fi.Body.Close()
+
+	assert.NoError(ReadManifest(ctx, sess, "rec/source.mp4", &got))
+	assert.Equal(saved, got)
+
+	_, err = SaveManifest(ctx, sess, "rec/bad.mp4", make(chan int))
+	assert.ErrorContains(err, "failed to encode manifest of rec/bad.mp4")
+	_, err = sess.SaveData(ctx, "rec/bad.mp4.json", strings.NewReader("{"), nil, 0)
+	assert.NoError(err)
+	assert.ErrorContains(ReadManifest(ctx, sess, "rec/bad.mp4", &got), "failed to decode manifest of rec/bad.mp4")
+}
@@ -0,0 +1,105 @@
+package drivers
+
+import (
+	"io"
+	"time"
+)
+
+// MetricsRecorder receives the results of the storage operations performed by the drivers, e.g. to
+// export them as Prometheus metrics. The driver argument is the name of the driver performing the
+// operation: "b2", "fs", "gs", "ipfs", "memory", "s3" or "w3s".
+type MetricsRecorder interface {
+	// OnSave is called when SaveData finishes, with the number of bytes read from the data.
+	OnSave(driver string, duration time.Duration, bytes int64, err error)
+	// OnRead is called when the body returned by ReadData or ReadDataRange is closed, with the
+	// number of bytes read from it. If the read fails, it is called right away with zero bytes.
+	OnRead(driver string, duration time.Duration, bytes int64, err error)
+	// OnDelete is called when DeleteFile finishes.
+	OnDelete(driver string, duration time.Duration, err error)
+}
+
+// NoopMetricsRecorder is a MetricsRecorder which discards all the results
+type NoopMetricsRecorder struct{}
+
+func (NoopMetricsRecorder) OnSave(driver string, duration time.Duration, bytes int64, err error) {}
+func (NoopMetricsRecorder) OnRead(driver string, duration time.Duration, bytes int64, err error) {}
+func (NoopMetricsRecorder) OnDelete(driver string, duration time.Duration, err error)            {}
+
+// Metrics is the recorder used by all the drivers. Set it before the drivers are used.
+var Metrics MetricsRecorder = NoopMetricsRecorder{}
+
+func metricsEnabled() bool {
+	if Metrics == nil {
+		return false
+	}
+	_, noop := Metrics.(NoopMetricsRecorder)
+	return !noop
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+type countingReadCloser struct {
+	countingReader
+	closer io.Closer
+	driver string
+	start  time.Time
+}
+
+func (crc *countingReadCloser) Close() error {
+	err := crc.closer.Close()
+	Metrics.OnRead(crc.driver, time.Since(crc.start), crc.n, err)
+	return err
+}
+
+// countSave wraps the data passed to SaveData so that the number of saved bytes can be recorded.
+// Returns nil counter when metrics are disabled.
+func countSave(data io.Reader) (io.Reader, *countingReader) {
+	if !metricsEnabled() {
+		return data, nil
+	}
+	cr := &countingReader{Reader: data}
+	return cr, cr
+}
+
+// recordSave should be deferred by SaveData implementations
+func recordSave(driver string, start time.Time, cr *countingReader, err *error) {
+	if cr == nil || !metricsEnabled() {
+		return
+	}
+	Metrics.OnSave(driver, time.Since(start), cr.n, *err)
+}
+
+// recordRead should be deferred by ReadData implementations. It postpones recording successful
+// reads until the returned body is closed.
+func recordRead(driver string, start time.Time, res **FileInfoReader, err *error) {
+	if !metricsEnabled() {
+		return
+	}
+	if *err != nil || *res == nil || (*res).Body == nil {
+		Metrics.OnRead(driver, time.Since(start), 0, *err)
+		return
+	}
+	(*res).Body = &countingReadCloser{
+		countingReader: countingReader{Reader: (*res).Body},
+		closer:         (*res).Body,
+		driver:         driver,
+		start:          start,
+	}
+}
+
+// recordDelete should be deferred by DeleteFile implementations
+func recordDelete(driver string, start time.Time, err *error) {
+	if !metricsEnabled() {
+		return
+	}
+	Metrics.OnDelete(driver, time.Since(start), *err)
+}
@@ -0,0 +1,90 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type metricsCall struct {
+	op     string
+	driver string
+	bytes  int64
+	err    error
+}
+
+type testMetricsRecorder struct {
+	mu    sync.Mutex
+	calls []metricsCall
+}
+
+func (r *testMetricsRecorder) record(c metricsCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, c)
+}
+
+func (r *testMetricsRecorder) OnSave(driver string, duration time.Duration, bytes int64, err error) {
+	r.record(metricsCall{"save", driver, bytes, err})
+}
+
+func (r *testMetricsRecorder) OnRead(driver string, duration time.Duration, bytes int64, err error) {
+	r.record(metricsCall{"read", driver, bytes, err})
+}
+
+func (r *testMetricsRecorder) OnDelete(driver string, duration time.Duration, err error) {
+	r.record(metricsCall{"delete", driver, 0, err})
+}
+
+func TestMetricsRecorder(t *testing.T) {
+	require := require.New(t)
+	rec := &testMetricsRecorder{}
+	oldMetrics := Metrics
+	Metrics = rec
+	defer func() {
+		Metrics = oldMetrics
+	}()
+
+	u, err := url.Parse(t.TempDir())
+	require.NoError(err)
+	sess := NewFSDriver(u).NewSession("")
+	ctx := context.Background()
+
+	_, err = sess.SaveData(ctx, "1.ts", bytes.NewReader(make([]byte, 1000)), nil, 0)
+	require.NoError(err)
+	fi, err := sess.ReadData(ctx, "1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Len(data, 1000)
+	require.NoError(fi.Body.Close())
+	_, err = sess.ReadData(ctx, "missing.ts")
+	require.ErrorIs(err, ErrNotExist)
+	require.NoError(sess.DeleteFile(ctx, "1.ts"))
+
+	require.Equal([]metricsCall{
+		{"save", "fs", 1000, nil},
+		{"read", "fs", 1000, nil},
+		{"read", "fs", 0, ErrNotExist},
+		{"delete", "fs", 0, nil},
+	}, rec.calls)
+}
+
+func TestMetricsDisabledDoesNotAllocate(t *testing.T) {
+	data := bytes.NewReader([]byte("data"))
+	allocs := testing.AllocsPerRun(100, func() {
+		var err error
+		_, counter := countSave(data)
+		recordSave("fs", time.Now(), counter, &err)
+		var res *FileInfoReader
+		recordRead("fs", time.Now(), &res, &err)
+		recordDelete("fs", time.Now(), &err)
+	})
+	require.Equal(t, float64(0), allocs)
+}
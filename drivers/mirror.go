@@ -0,0 +1,116 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// MirroringSession reads the files missing from the primary session from a fallback session, like
+// a cache in front of a slower origin, and copies them to the primary session in the background
+// for the next reads. The copy is saved once the body of the fallback read has been read to the
+// end, so a partially read file is not copied. Ranges missing from the primary session are read
+// from the fallback session without copying the file. All the other operations go to the primary
+// session.
+type MirroringSession struct {
+	OSSession
+	fallback OSSession
+
+	mu sync.Mutex
+	// copying are the files being copied to the primary session
+	copying map[string]bool
+	wg      sync.WaitGroup
+}
+
+var _ OSSession = (*MirroringSession)(nil)
+
+// NewMirroringSession wraps the primary session to read the files it misses from the fallback one
+func NewMirroringSession(primary, fallback OSSession) *MirroringSession {
+	return &MirroringSession{
+		OSSession: primary,
+		fallback:  fallback,
+		copying:   make(map[string]bool),
+	}
+}
+
+func (ms *MirroringSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	res, err := ms.OSSession.ReadData(ctx, name)
+	if !errors.Is(err, ErrNotExist) {
+		return res, err
+	}
+	res, err = ms.fallback.ReadData(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	fields := &FileProperties{ContentType: res.ContentType, Metadata: copyMetadata(res.Metadata)}
+	res.Body = &mirroredBody{
+		ReadCloser: res.Body,
+		done: func(data []byte) {
+			ms.copy(name, data, fields)
+		},
+	}
+	return res, nil
+}
+
+func (ms *MirroringSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	res, err := ms.OSSession.ReadDataRange(ctx, name, byteRange)
+	if !errors.Is(err, ErrNotExist) {
+		return res, err
+	}
+	return ms.fallback.ReadDataRange(ctx, name, byteRange)
+}
+
+// copy saves the file read from the fallback session to the primary session in the background,
+// unless it is already being copied
+func (ms *MirroringSession) copy(name string, data []byte, fields *FileProperties) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.copying[name] {
+		return
+	}
+	ms.copying[name] = true
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		if _, err := ms.OSSession.SaveData(context.Background(), name, bytes.NewReader(data), fields, 0); err != nil {
+			Log.Warnf("Failed to copy mirrored file name=%s err=%v", name, err)
+		}
+		ms.mu.Lock()
+		delete(ms.copying, name)
+		ms.mu.Unlock()
+	}()
+}
+
+// Wait waits for the files being copied to the primary session to be saved
+func (ms *MirroringSession) Wait() {
+	ms.wg.Wait()
+}
+
+// EndSession waits for the copies to the primary session before ending both sessions
+func (ms *MirroringSession) EndSession() {
+	ms.Wait()
+	ms.OSSession.EndSession()
+	ms.fallback.EndSession()
+}
+
+// mirroredBody collects the data read from the body, passing it to done once the end is reached
+type mirroredBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func(data []byte)
+}
+
+func (body *mirroredBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if body.done == nil {
+		return n, err
+	}
+	body.buf.Write(p[:n])
+	if err == io.EOF {
+		body.done(body.buf.Bytes())
+		body.done = nil
+	}
+	return n, err
+}
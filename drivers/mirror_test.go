@@ -0,0 +1,64 @@
+package drivers
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirroringSession(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	primary := &countingSession{OSSession: NewFakeOSSession()}
+	fallback := &countingSession{OSSession: NewFakeOSSession()}
+	sess := NewMirroringSession(primary, fallback)
+	_, err := fallback.SaveData(ctx, "1.ts", strings.NewReader("segment"), &FileProperties{ContentType: "video/mp2t"}, 0)
+	require.NoError(err)
+
+	// the file missing from the primary session is read from the fallback one
+	data, _, err := ReadFile(ctx, sess, "1.ts")
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal(1, primary.reads)
+	require.Equal(1, fallback.reads)
+
+	// then copied to the primary session in the background
+	sess.Wait()
+	res, err := primary.ReadData(ctx, "1.ts")
+	require.NoError(err)
+	require.Equal("video/mp2t", res.ContentType)
+	res.Body.Close()
+	data, _, err = ReadFile(ctx, sess, "1.ts")
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal(1, fallback.reads)
+
+	// a partially read file is not copied
+	_, err = fallback.SaveData(ctx, "2.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	res, err = sess.ReadData(ctx, "2.ts")
+	require.NoError(err)
+	_, err = io.ReadFull(res.Body, make([]byte, 3))
+	require.NoError(err)
+	res.Body.Close()
+	sess.Wait()
+	_, err = primary.ReadData(ctx, "2.ts")
+	require.ErrorIs(err, ErrNotExist)
+
+	// ranges are read from the fallback session without copying the file
+	res, err = sess.ReadDataRange(ctx, "2.ts", "bytes=0-2")
+	require.NoError(err)
+	data, err = io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("seg", string(data))
+	sess.Wait()
+	_, err = primary.ReadData(ctx, "2.ts")
+	require.ErrorIs(err, ErrNotExist)
+
+	// the files missing from both sessions don't exist
+	_, err = sess.ReadData(ctx, "3.ts")
+	require.ErrorIs(err, ErrNotExist)
+}
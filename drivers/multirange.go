@@ -0,0 +1,96 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// multipartByteranges is the content type of the responses to multi-range requests, with a part
+// for each of the ranges
+const multipartByteranges = "multipart/byteranges"
+
+// splitByteRanges splits a multi-range spec like "bytes=0-99,500-599" into the single range specs
+// "bytes=0-99" and "bytes=500-599". Returns nil if the spec is not a multi-range one.
+func splitByteRanges(byteRange string) []string {
+	if !strings.HasPrefix(byteRange, "bytes=") || !strings.Contains(byteRange, ",") {
+		return nil
+	}
+	var ranges []string
+	for _, spec := range strings.Split(strings.TrimPrefix(byteRange, "bytes="), ",") {
+		ranges = append(ranges, "bytes="+strings.TrimSpace(spec))
+	}
+	return ranges
+}
+
+// readRangesSequentially reads each of the ranges with readRange, for the backends not supporting
+// multi-range requests, and returns them in a multipart/byteranges body like the one of an HTTP
+// multi-range response. The first range is read before returning, for its errors to be returned
+// and its metadata to describe the file. The others are read as the body is consumed. If the
+// backend ignores the first range and returns the whole file, so is the result.
+func readRangesSequentially(ctx context.Context, ranges []string, readRange func(ctx context.Context, byteRange string) (*FileInfoReader, error)) (*FileInfoReader, error) {
+	first, err := readRange(ctx, ranges[0])
+	if err != nil {
+		return nil, err
+	}
+	if first.ContentRange == "" {
+		return first, nil
+	}
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		err := writeRangePart(writer, first)
+		for _, byteRange := range ranges[1:] {
+			if err != nil {
+				break
+			}
+			var part *FileInfoReader
+			if part, err = readRange(ctx, byteRange); err == nil {
+				err = writeRangePart(writer, part)
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	res := &FileInfoReader{
+		FileInfo:        first.FileInfo,
+		Metadata:        first.Metadata,
+		Body:            pr,
+		ContentType:     multipartByteranges + "; boundary=" + writer.Boundary(),
+		ContentEncoding: first.ContentEncoding,
+	}
+	return res, nil
+}
+
+func writeRangePart(writer *multipart.Writer, res *FileInfoReader) error {
+	defer res.Body.Close()
+	if res.ContentRange == "" {
+		return fmt.Errorf("byte range of %s ignored by the storage", res.Name)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", res.ContentType)
+	header.Set("Content-Range", res.ContentRange)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, res.Body)
+	return err
+}
+
+// ByteRangeParts returns a reader of the parts of the body of a multi-range ReadDataRange, each
+// with the Content-Range of its data in its Header. Returns an error if the body holds a single
+// range or the whole file, e.g. when only one of the requested ranges was satisfiable.
+func ByteRangeParts(res *FileInfoReader) (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(res.ContentType)
+	if err != nil || mediaType != multipartByteranges || params["boundary"] == "" {
+		return nil, fmt.Errorf("not a multi-range response: %q", res.ContentType)
+	}
+	return multipart.NewReader(res.Body, params["boundary"]), nil
+}
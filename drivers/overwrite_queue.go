@@ -68,6 +68,7 @@ func (oq *OverwriteQueue) workerLoop() {
 				if err == nil {
 					break
 				}
+				Log.Warnf("Failed to save %s name=%s try=%d/%d timeout=%s err=%v", oq.desc, oq.name, try+1, oq.maxRetries, timeout, err)
 				timeout = time.Duration(float64(timeout) * timeoutMultiplier)
 				if timeout > oq.maxTimeout {
 					timeout = oq.maxTimeout
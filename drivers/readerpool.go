@@ -2,7 +2,9 @@ package drivers
 
 import (
 	"context"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"time"
 )
 
 type readResult struct {
@@ -16,6 +18,8 @@ type task struct {
 	sess     OSSession
 	fileName string
 	index    int
+	// budget is the retry budget the read of a retried file takes a retry from
+	budget *RetryBudget
 }
 
 func readWorker(ctx context.Context, tasks chan *task, resCh chan *readResult) {
@@ -23,25 +27,20 @@ func readWorker(ctx context.Context, tasks chan *task, resCh chan *readResult) {
 		select {
 		case <-ctx.Done():
 			return
-		case task := <-tasks:
+		case task, ok := <-tasks:
+			if !ok {
+				return
+			}
 			res := &readResult{
 				index: task.index,
 			}
-			fi, err := task.sess.ReadData(ctx, task.fileName)
-			if err != nil {
-				res.err = err
-				resCh <- res
-				continue
-			}
-			fb, err := ioutil.ReadAll(fi.Body)
-			if err != nil {
-				res.err = err
-				resCh <- res
-				continue
+			if task.budget != nil {
+				if res.err = task.budget.Take(ctx); res.err != nil {
+					resCh <- res
+					continue
+				}
 			}
-			fi.Body.Close()
-			res.data = fb
-			res.fileInfo = fi
+			res.fileInfo, res.data, res.err = readFully(ctx, task.sess, task.fileName)
 			resCh <- res
 		}
 	}
@@ -49,6 +48,99 @@ func readWorker(ctx context.Context, tasks chan *task, resCh chan *readResult) {
 
 // ParallelReadFiles reads files in parallel, using specified number of jobs
 func ParallelReadFiles(ctx context.Context, sess OSSession, filesNames []string, workers int) ([]*FileInfoReader, [][]byte, error) {
+	firs := make([]*FileInfoReader, len(filesNames))
+	data := make([][]byte, len(filesNames))
+	var err error
+	for _, res := range parallelRead(ctx, sess, filesNames, workers, nil) {
+		firs[res.index] = res.fileInfo
+		data[res.index] = res.data
+		if res.err != nil {
+			err = res.err
+		}
+	}
+	return firs, data, err
+}
+
+// ReadFilesOptions control the retries and the verification of ParallelReadFilesRetried
+type ReadFilesOptions struct {
+	// Retries is the number of times the reads of the files which failed are retried. Files which
+	// don't exist are not retried.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubled on each subsequent one
+	RetryBackoff time.Duration
+	// Expected has the expected info of the file at the same index. When set, a file whose size
+	// differs from a non-nil Size, or whose ETag differs from a non-empty ETag, is read again.
+	Expected []FileInfo
+	// Budget bounds the retries of all the files, and can be shared with other batch operations.
+	// Each retried read takes a retry from it, waiting while its rate is exceeded. Once it is
+	// exhausted, the files keep the error of their last read. Nil means no limit.
+	Budget *RetryBudget
+}
+
+// ParallelReadFilesRetried reads files in parallel like ParallelReadFiles, then retries reading only
+// the files which failed. Returns the error of the last read of each file, nil for the files read
+// successfully.
+func ParallelReadFilesRetried(ctx context.Context, sess OSSession, filesNames []string, workers int, opts ReadFilesOptions) ([]*FileInfoReader, [][]byte, []error) {
+	firs := make([]*FileInfoReader, len(filesNames))
+	data := make([][]byte, len(filesNames))
+	errs := make([]error, len(filesNames))
+	pending := make([]int, len(filesNames))
+	for i := range pending {
+		pending[i] = i
+	}
+	backoff := opts.RetryBackoff
+	var budget *RetryBudget
+	for attempt := 0; ; attempt++ {
+		names := make([]string, len(pending))
+		for i, index := range pending {
+			names[i] = filesNames[index]
+		}
+		var failed []int
+		for _, res := range parallelRead(ctx, sess, names, workers, budget) {
+			index := pending[res.index]
+			if errors.Is(res.err, ErrRetryBudgetExhausted) {
+				continue
+			}
+			if res.err == nil && index < len(opts.Expected) {
+				res.err = verifyRead(filesNames[index], opts.Expected[index], res.fileInfo, res.data)
+			}
+			firs[index], data[index], errs[index] = res.fileInfo, res.data, res.err
+			if res.err != nil && !errors.Is(res.err, ErrNotExist) {
+				failed = append(failed, index)
+			}
+		}
+		if len(failed) == 0 || attempt >= opts.Retries {
+			return firs, data, errs
+		}
+		Log.Warnf("Retrying reading files count=%d attempt=%d", len(failed), attempt+1)
+		select {
+		case <-ctx.Done():
+			for _, index := range failed {
+				errs[index] = ctx.Err()
+			}
+			return firs, data, errs
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		pending = failed
+		budget = opts.Budget
+	}
+}
+
+// verifyRead checks the read file against the expected info
+func verifyRead(name string, expected FileInfo, fi *FileInfoReader, data []byte) error {
+	if expected.Size != nil && int64(len(data)) != *expected.Size {
+		return fmt.Errorf("read %d bytes of file %s, expected %d", len(data), name, *expected.Size)
+	}
+	if expected.ETag != "" && fi != nil && fi.ETag != expected.ETag {
+		return fmt.Errorf("read file %s with ETag %s, expected %s", name, fi.ETag, expected.ETag)
+	}
+	return nil
+}
+
+// parallelRead reads the files with the given number of workers and returns the results by index.
+// With a budget, each read first takes a retry from it.
+func parallelRead(ctx context.Context, sess OSSession, filesNames []string, workers int, budget *RetryBudget) []*readResult {
 	workersToStart := workers
 	if len(filesNames) < workers {
 		workersToStart = len(filesNames)
@@ -63,19 +155,15 @@ func ParallelReadFiles(ctx context.Context, sess OSSession, filesNames []string,
 			fileName: fn,
 			sess:     sess,
 			index:    i,
+			budget:   budget,
 		}
 		tasks <- task
 	}
-	firs := make([]*FileInfoReader, len(filesNames))
-	data := make([][]byte, len(filesNames))
-	var err error
+	close(tasks)
+	results := make([]*readResult, len(filesNames))
 	for i := 0; i < len(filesNames); i++ {
 		res := <-resCh
-		firs[res.index] = res.fileInfo
-		data[res.index] = res.data
-		if res.err != nil {
-			err = res.err
-		}
+		results[res.index] = res
 	}
-	return firs, data, err
+	return results
 }
@@ -68,3 +68,62 @@ func TestReaderPoolShouldReadInParallel(t *testing.T) {
 	assert.Equal(fis[1].Name, "f2")
 	assert.Nil(err)
 }
+
+func TestParallelReadFilesRetried(t *testing.T) {
+	assert := assert.New(t)
+	mos := &MockOSSession{}
+	ctx := context.Background()
+	mos.On("ReadData", ctx, "f1").Return(testFileInfoReader("f1", "body 1"), nil).Once()
+	// f2 fails transiently
+	mos.On("ReadData", ctx, "f2").Return(nil, errors.New("ReadData error")).Once()
+	mos.On("ReadData", ctx, "f2").Return(testFileInfoReader("f2", "body 2"), nil).Once()
+	// f3 is truncated once
+	mos.On("ReadData", ctx, "f3").Return(testFileInfoReader("f3", "body"), nil).Once()
+	mos.On("ReadData", ctx, "f3").Return(testFileInfoReader("f3", "body 3"), nil).Once()
+	// f4 is missing, which isn't retried
+	mos.On("ReadData", ctx, "f4").Return(nil, ErrNotExist).Once()
+	size := int64(6)
+
+	fis, data, errs := ParallelReadFilesRetried(ctx, mos, []string{"f1", "f2", "f3", "f4"}, 2, ReadFilesOptions{
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Expected:     []FileInfo{{}, {}, {Size: &size}},
+	})
+	assert.Equal([][]byte{[]byte("body 1"), []byte("body 2"), []byte("body 3"), nil}, data)
+	assert.Equal("f2", fis[1].Name)
+	assert.Equal([]error{nil, nil, nil, ErrNotExist}, errs)
+	mos.AssertNumberOfCalls(t, "ReadData", 6)
+}
+
+func TestParallelReadFilesRetriesExhausted(t *testing.T) {
+	assert := assert.New(t)
+	mos := &MockOSSession{}
+	ctx := context.Background()
+	mos.On("ReadData", ctx, "f1").Return(testFileInfoReader("f1", "body 1"), nil).Once()
+	mos.On("ReadData", ctx, "f2").Return(nil, errors.New("ReadData error"))
+
+	_, data, errs := ParallelReadFilesRetried(ctx, mos, []string{"f1", "f2"}, 2, ReadFilesOptions{Retries: 2, RetryBackoff: time.Millisecond})
+	assert.Equal([]byte("body 1"), data[0])
+	assert.NoError(errs[0])
+	assert.EqualError(errs[1], "ReadData error")
+	mos.AssertNumberOfCalls(t, "ReadData", 4)
+}
+
+func TestParallelReadFilesRetryBudget(t *testing.T) {
+	assert := assert.New(t)
+	mos := &MockOSSession{}
+	ctx := context.Background()
+	mos.On("ReadData", ctx, mock.Anything).Return(nil, errors.New("ReadData error"))
+	names := []string{"f1", "f2", "f3", "f4", "f5", "f6", "f7", "f8", "f9", "f10"}
+
+	// the budget is shared by the batches, each file would be retried 3 times without it
+	budget := NewRetryBudget(12, 0, 0)
+	for i := 0; i < 2; i++ {
+		_, _, errs := ParallelReadFilesRetried(ctx, mos, names, 4, ReadFilesOptions{Retries: 3, Budget: budget})
+		for _, err := range errs {
+			assert.EqualError(err, "ReadData error")
+		}
+	}
+	assert.Equal(12, budget.Retries())
+	mos.AssertNumberOfCalls(t, "ReadData", 2*len(names)+12)
+}
@@ -0,0 +1,96 @@
+package drivers
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// DriverFactory creates the driver for an OS URL with a registered scheme
+type DriverFactory func(u *url.URL, useFullAPI bool) (OSDriver, error)
+
+// builtinSchemes are the schemes handled by ParseOSURL itself, which can't be registered
+var builtinSchemes = map[string]bool{
+	"":         true,
+	"ar":       true,
+	"file":     true,
+	"s3":       true,
+	"s3+http":  true,
+	"s3+https": true,
+	"r2":       true,
+	"spaces":   true,
+	"b2":       true,
+	"gs":       true,
+	"ipfs":     true,
+	"memory":   true,
+	"w3s":      true,
+}
+
+var (
+	registeredDrivers     = map[string]DriverFactory{}
+	registeredDriversLock sync.RWMutex
+)
+
+// RegisterDriver makes ParseOSURL create the drivers for the URLs with the given scheme with the
+// factory. The built-in schemes can't be overridden, and a scheme can only be registered once.
+func RegisterDriver(scheme string, factory DriverFactory) error {
+	if factory == nil {
+		return fmt.Errorf("no driver factory given for scheme %q", scheme)
+	}
+	if builtinSchemes[scheme] {
+		return fmt.Errorf("scheme %q is handled by a built-in driver", scheme)
+	}
+	registeredDriversLock.Lock()
+	defer registeredDriversLock.Unlock()
+	if _, ok := registeredDrivers[scheme]; ok {
+		return fmt.Errorf("a driver is already registered for scheme %q", scheme)
+	}
+	registeredDrivers[scheme] = factory
+	return nil
+}
+
+func registeredDriver(scheme string) (DriverFactory, bool) {
+	registeredDriversLock.RLock()
+	defer registeredDriversLock.RUnlock()
+	factory, ok := registeredDrivers[scheme]
+	return factory, ok
+}
+
+// registeredSchemes returns the registered schemes in alphabetical order
+func registeredSchemes() []string {
+	registeredDriversLock.RLock()
+	defer registeredDriversLock.RUnlock()
+	schemes := make([]string, 0, len(registeredDrivers))
+	for scheme := range registeredDrivers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// SupportedSchemes returns the schemes of the OS URLs accepted by ParseOSURL: those of the
+// AvailableDrivers, with "" for file system paths, followed by the registered ones
+func SupportedSchemes() []string {
+	var schemes []string
+	seen := map[string]bool{}
+	for _, driver := range AvailableDrivers {
+		for _, scheme := range driver.UriSchemes() {
+			if !seen[scheme] {
+				seen[scheme] = true
+				schemes = append(schemes, scheme)
+			}
+		}
+	}
+	return append(schemes, registeredSchemes()...)
+}
+
+// IsSchemeSupported tells whether ParseOSURL accepts the OS URLs with the scheme, e.g. to validate
+// a configuration before creating the driver
+func IsSchemeSupported(scheme string) bool {
+	if builtinSchemes[scheme] {
+		return true
+	}
+	_, ok := registeredDriver(scheme)
+	return ok
+}
@@ -0,0 +1,88 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted indicates that the retries allowed by a RetryBudget were all used
+var ErrRetryBudgetExhausted = fmt.Errorf("the retry budget is exhausted")
+
+// RetryBudget bounds the retries of a batch operation shared by all its workers, so that a partial
+// outage of the storage doesn't turn into a retry storm. It is a token bucket: each retry takes a
+// token, waiting for one to be refilled when the bucket is empty, and fails once the total number
+// of retries is reached.
+type RetryBudget struct {
+	rate float64
+	max  int
+
+	mu      sync.Mutex
+	tokens  float64
+	burst   float64
+	last    time.Time
+	retries int
+}
+
+// NewRetryBudget allows up to maxRetries retries in total, at perSecond retries per second with
+// bursts of up to burst retries. Zero maxRetries means no total limit, and zero perSecond means no
+// rate limit.
+func NewRetryBudget(maxRetries int, perSecond float64, burst int) *RetryBudget {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RetryBudget{
+		rate:   perSecond,
+		max:    maxRetries,
+		tokens: float64(burst),
+		burst:  float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Take waits for a retry to be allowed. Returns ErrRetryBudgetExhausted once all the retries are
+// used, or the error of the context if it is done first.
+func (rb *RetryBudget) Take(ctx context.Context) error {
+	for {
+		wait, err := rb.take()
+		if err != nil || wait == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// take takes a token if one is available, or returns the time until the next one is refilled
+func (rb *RetryBudget) take() (time.Duration, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.max > 0 && rb.retries >= rb.max {
+		return 0, ErrRetryBudgetExhausted
+	}
+	if rb.rate > 0 {
+		now := time.Now()
+		rb.tokens += now.Sub(rb.last).Seconds() * rb.rate
+		if rb.tokens > rb.burst {
+			rb.tokens = rb.burst
+		}
+		rb.last = now
+		if rb.tokens < 1 {
+			return time.Duration((1-rb.tokens)/rb.rate*float64(time.Second)) + 1, nil
+		}
+		rb.tokens--
+	}
+	rb.retries++
+	return 0, nil
+}
+
+// Retries returns the number of retries taken from the budget
+func (rb *RetryBudget) Retries() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.retries
+}
@@ -0,0 +1,31 @@
+package drivers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBudget(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	// the burst is taken at once, then the retries are spread at the rate
+	budget := NewRetryBudget(5, 50, 2)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.NoError(budget.Take(ctx))
+	}
+	require.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+	require.ErrorIs(budget.Take(ctx), ErrRetryBudgetExhausted)
+	require.Equal(5, budget.Retries())
+
+	budget = NewRetryBudget(0, 1, 1)
+	require.NoError(budget.Take(ctx))
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(budget.Take(ctx), context.DeadlineExceeded)
+	require.Equal(1, budget.Retries())
+}
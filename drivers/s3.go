@@ -8,13 +8,17 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,8 +26,11 @@ import (
 	"github.com/aws/aws-sdk-go/aws/request"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
@@ -39,11 +46,19 @@ const (
 	uploaderConcurrency = 8
 	// uploderPartSize is the size of the parts that will be uploaded to the
 	// S3-compatible service. Fine-tuned for Storj (chunk size of 64MB) and Google
-	// Cloud Storage (also improves performance). Can make this configurable in
-	// the future for optimized support of other storage providers.
+	// Cloud Storage (also improves performance). Can be overridden per driver with
+	// S3OS.UploadPartSize for optimized support of other storage providers.
 	uploaderPartSize = 63 * 1024 * 1024
 	// default region parameter if we can't derive one from the url
 	defaultIgnoredRegion = "us-east-1"
+	// region expected by Cloudflare R2
+	r2Region = "auto"
+	// s3ThrottleMinDelay is the delay before the first retry of a throttled request without a
+	// Retry-After header, doubled for each of the next retries
+	s3ThrottleMinDelay = 500 * time.Millisecond
+	// s3ThrottleMaxDelay caps the delay before retrying a throttled request, including the delays
+	// asked with Retry-After
+	s3ThrottleMaxDelay = 30 * time.Second
 )
 
 var _ OSSession = (*s3Session)(nil)
@@ -51,6 +66,10 @@ var _ OSSession = (*s3Session)(nil)
 // S3OS S3 backed object storage driver. For own storage access key and access key secret
 // should be specified. To give to other nodes access to own S3 storage so called 'POST' policy
 // is created. This policy is valid for S3_POLICY_EXPIRE_IN_HOURS hours.
+//
+// Without useFullAPI the driver works in "lite" mode, only needing the permission to write objects:
+// SaveData uploads with the POST policy, and ListFiles, ReadData, ReadDataRange, DeleteFile,
+// Presign, PresignUpload and ResumeUpload fail with ErrNotSupported.
 type S3OS struct {
 	host               string
 	region             string
@@ -61,6 +80,110 @@ type S3OS struct {
 	s3svc              *s3.S3
 	s3sess             *session.Session
 	useFullAPI         bool
+
+	// UploadPartSize is the size in bytes of the parts uploaded in parallel when saving a file.
+	// Each upload buffers up to UploadConcurrency parts of this size in memory, so the memory
+	// used by a single SaveData call can reach UploadPartSize * UploadConcurrency bytes.
+	// Zero means the default of 63MB.
+	UploadPartSize int64
+	// UploadConcurrency is the number of parts uploaded in parallel when saving a file. Only
+	// matters for files bigger than UploadPartSize. Zero means the default of 8.
+	UploadConcurrency int
+	// ListPageSize is the maximum number of keys returned by each page of ListFiles. Zero means
+	// the default of the service, which is 1000 for AWS.
+	ListPageSize int64
+	// DecompressGzip makes ReadData request the files stored with a gzip Content-Encoding as
+	// stored and decompress them itself, whatever the HTTP client. By default the request is left
+	// as is, and the Go HTTP client decompresses whole files transparently.
+	// Ranges of files are always returned as stored.
+	DecompressGzip bool
+	// ExpectedBucketOwner is the account ID the bucket must belong to, for the requests to fail
+	// instead of accessing a bucket of another account. Empty to not check the owner.
+	ExpectedBucketOwner string
+	// RequestPayer is set to "requester" to access requester pays buckets of other accounts. The
+	// account of the credentials is then billed for the requests and the data transfer out of the
+	// bucket, instead of the bucket owner, so it should only be set for such buckets. It is not
+	// applied to the URLs returned by Presign, which have to be requested without headers.
+	RequestPayer string
+	// MultiRangeReads makes ReadDataRange request multiple ranges at once, for the S3 compatible
+	// services answering with a multipart/byteranges response. AWS S3 doesn't support it, so by
+	// default the ranges are requested one by one.
+	MultiRangeReads bool
+	// KeyRewrites serve the objects moved to another key prefix at their old keys, for the URLs of
+	// the old keys to keep working after a migration. ReadData, ReadDataRange and ListFiles read the
+	// keys starting with the OldPrefix of the first matching rewrite from its NewPrefix, and
+	// ListFiles returns them with the OldPrefix. The prefixes are whole object keys, including the
+	// prefix of the session. The other operations use the keys as given.
+	KeyRewrites []S3KeyRewrite
+	// KeyMapper maps the keys of the files to the keys of the objects storing them, e.g. to spread
+	// the objects of a high write rate bucket over sharded prefixes. The files are still read, saved
+	// and deleted with their names. ListFiles lists the objects under the prefix as given, returning
+	// the names the KeyMapper maps their keys back to, so the files of a sharded layout are listed
+	// from the prefix of each shard. Nil keeps the keys. Not applied in lite mode.
+	KeyMapper S3KeyMapper
+	// FollowRegionRedirects makes the requests to a bucket of another region than the one of the
+	// driver be retried in the region of the bucket, instead of failing with ErrRegionMismatch. Every
+	// request still goes to the wrong region first, so the region should be fixed anyway. Only the
+	// drivers created with NewS3Driver follow the redirects, and not in lite mode.
+	FollowRegionRedirects bool
+	// UseFIPS makes the drivers created with NewS3Driver use the FIPS 140-2 endpoints of the region,
+	// for the deployments which have to comply with it. The drivers of the custom endpoints and the
+	// other S3 compatible services ignore it.
+	UseFIPS bool
+	// UseDualStack makes the drivers created with NewS3Driver use the dual-stack endpoints of the
+	// region, reachable over IPv6 as well as IPv4. The drivers of the custom endpoints and the other
+	// S3 compatible services ignore it.
+	UseDualStack bool
+	// SDKRetryer replaces the retryer of the AWS SDK, which retries the failed requests up to 3
+	// times by default, e.g. with a client.DefaultRetryer to tune the number of retries and their
+	// delays. Nil keeps the default retryer. The requests throttled by S3, with a 429 or a 503
+	// SlowDown, are still retried after the delay of their Retry-After header, or with a longer
+	// backoff than the other errors. Not applied in lite mode.
+	SDKRetryer request.Retryer
+	// DisableSDKRetries turns off the retries of the AWS SDK, for the callers retrying the
+	// operations themselves, like SaveRetried, not to compound both retries. Overrides SDKRetryer.
+	// The requests redirected with FollowRegionRedirects are not retried in the region of the bucket
+	// either.
+	DisableSDKRetries bool
+
+	// awsConfig is the configuration of the S3 API session, without the credentials
+	awsConfig *aws.Config
+	// anonymous drivers only read public objects, without credentials
+	anonymous bool
+	// awsEndpoints is set when the endpoints are resolved from the region, for the AWS service
+	awsEndpoints bool
+	// osURL is the OS URL of the bucket the driver was created for, without the key prefix
+	osURL *url.URL
+}
+
+// ErrRegionMismatch indicates that the bucket is in another region than the one of the S3 driver. The
+// returned errors wrapping it name the region of the bucket.
+var ErrRegionMismatch = fmt.Errorf("the bucket is in another region")
+
+// ErrObjectLockNotEnabled indicates that a file can't be saved with FileProperties.Retention because
+// the bucket doesn't have Object Lock enabled
+var ErrObjectLockNotEnabled = fmt.Errorf("object lock is not enabled on the bucket")
+
+// errAnonymousWrite is returned by the operations writing to the bucket of an anonymous S3 driver
+var errAnonymousWrite = fmt.Errorf("%w: the anonymous S3 drivers can only read public objects", ErrNotSupported)
+
+// s3BucketRegionHeader is the header of the redirects naming the region of the bucket
+const s3BucketRegionHeader = "X-Amz-Bucket-Region"
+
+// S3KeyRewrite maps the keys starting with OldPrefix to the same keys starting with NewPrefix
+type S3KeyRewrite struct {
+	OldPrefix string
+	NewPrefix string
+}
+
+// S3KeyMapper maps the keys of the files, made of the key prefix of the session and the file name,
+// to the keys of the objects. The mapping must be reversible.
+type S3KeyMapper interface {
+	// ObjectKey returns the key of the object storing the file with the key
+	ObjectKey(key string) string
+	// FileKey returns the key of the file stored in the object with the key, or false if the object
+	// doesn't store a mapped file
+	FileKey(objectKey string) (string, bool)
 }
 
 type s3Session struct {
@@ -82,6 +205,14 @@ func s3Host(bucket string) string {
 	return fmt.Sprintf("https://%s.s3.amazonaws.com", bucket)
 }
 
+func r2Host(accountID string) string {
+	return fmt.Sprintf("%s.r2.cloudflarestorage.com", accountID)
+}
+
+func spacesHost(region string) string {
+	return fmt.Sprintf("%s.digitaloceanspaces.com", region)
+}
+
 func customS3Host(host string, ssl bool) string {
 	if !strings.Contains("://", host) {
 		protocol := "http"
@@ -113,6 +244,7 @@ func customS3Region(host string) string {
 func newS3Session(info *S3OSInfo) OSSession {
 	sess := &s3Session{
 		host:        info.Host,
+		bucket:      info.Bucket,
 		key:         info.Key,
 		policy:      info.Policy,
 		signature:   info.Signature,
@@ -133,60 +265,127 @@ func NewS3Driver(region, bucket, accessKey, accessKeySecret string, keyPrefix st
 		awsSecretAccessKey: accessKeySecret,
 		useFullAPI:         useFullAPI,
 		keyPrefix:          keyPrefix,
+		awsEndpoints:       true,
+		osURL:              s3OSURL("s3", region, accessKey, accessKeySecret),
 	}
+	os.awsConfig = aws.NewConfig().
+		WithRegion(os.region).
+		WithHTTPClient(httpClient())
 	if os.awsAccessKeyID != "" {
-		var err error
 		creds := credentials.NewStaticCredentials(os.awsAccessKeyID, os.awsSecretAccessKey, "")
-		cfg := aws.NewConfig().
-			WithRegion(os.region).
-			WithCredentials(creds)
-		os.s3sess, err = session.NewSession(cfg)
-		if err != nil {
+		if err := os.initSession(creds); err != nil {
 			return nil, err
 		}
-		os.s3svc = s3.New(os.s3sess)
 	}
 	return os, nil
 }
 
 // NewCustomS3Driver for creating S3-compatible stores other than S3 itself
 func NewCustomS3Driver(host, bucket, accessKey, accessKeySecret, keyPrefix string, useFullAPI bool, useSSL bool) (OSDriver, error) {
+	region := customS3Region(customS3Host(host, useSSL))
+	scheme := "s3+http"
+	if useSSL {
+		scheme = "s3+https"
+	}
+	osURL := s3OSURL(scheme, host, accessKey, accessKeySecret)
+	return newS3CompatibleDriver(host, region, bucket, accessKey, accessKeySecret, keyPrefix, useFullAPI, useSSL, true, osURL)
+}
+
+// NewS3EndpointDriver for creating AWS S3 stores accessed through a custom endpoint, like a VPC
+// endpoint, with virtual-hosted style URLs
+func NewS3EndpointDriver(endpoint, region, bucket, accessKey, accessKeySecret, keyPrefix string, useFullAPI, useSSL bool) (OSDriver, error) {
+	osURL := s3OSURL("s3", region, accessKey, accessKeySecret)
+	query := url.Values{"endpoint": {endpoint}}
+	if !useSSL {
+		query.Set("ssl", "false")
+	}
+	osURL.RawQuery = query.Encode()
+	return newS3CompatibleDriver(endpoint, region, bucket, accessKey, accessKeySecret, keyPrefix, useFullAPI, useSSL, false, osURL)
+}
+
+// NewR2Driver for creating Cloudflare R2 stores of the given account
+func NewR2Driver(accountID, bucket, accessKey, accessKeySecret, keyPrefix string, useFullAPI bool) (OSDriver, error) {
+	osURL := s3OSURL("r2", accountID, accessKey, accessKeySecret)
+	return newS3CompatibleDriver(r2Host(accountID), r2Region, bucket, accessKey, accessKeySecret, keyPrefix, useFullAPI, true, true, osURL)
+}
+
+// NewSpacesDriver for creating DigitalOcean Spaces stores in the given region
+func NewSpacesDriver(region, bucket, accessKey, accessKeySecret, keyPrefix string, useFullAPI bool) (OSDriver, error) {
+	osURL := s3OSURL("spaces", region, accessKey, accessKeySecret)
+	return newS3CompatibleDriver(spacesHost(region), region, bucket, accessKey, accessKeySecret, keyPrefix, useFullAPI, true, false, osURL)
+}
+
+// s3OSURL returns the OS URL of a bucket of the S3 service at the given host, without the path
+func s3OSURL(scheme, host, accessKey, accessKeySecret string) *url.URL {
+	return &url.URL{Scheme: scheme, User: url.UserPassword(accessKey, accessKeySecret), Host: host}
+}
+
+// newS3CompatibleDriver creates a driver for the S3-compatible service at the given host. With
+// forcePathStyle the bucket is a part of the URL path, otherwise it's a subdomain of the host. The
+// osURL is the OS URL the driver is parsed from, without the path.
+func newS3CompatibleDriver(host, region, bucket, accessKey, accessKeySecret, keyPrefix string, useFullAPI, useSSL, forcePathStyle bool, osURL *url.URL) (OSDriver, error) {
 	os := &S3OS{
 		host:               customS3Host(host, useSSL),
+		region:             region,
 		bucket:             bucket,
 		awsAccessKeyID:     accessKey,
 		awsSecretAccessKey: accessKeySecret,
 		keyPrefix:          keyPrefix,
 		useFullAPI:         useFullAPI,
+		osURL:              osURL,
 	}
-	os.region = customS3Region(os.host)
-	if !useFullAPI {
+	if !forcePathStyle {
+		os.host = customS3Host(bucket+"."+host, useSSL)
+	} else if !useFullAPI {
 		os.host += "/" + bucket
 	}
+	os.awsConfig = aws.NewConfig().
+		WithRegion(os.region).
+		WithEndpoint(host).
+		WithS3ForcePathStyle(forcePathStyle).
+		WithDisableSSL(!useSSL).
+		WithHTTPClient(httpClient())
 	if os.awsAccessKeyID != "" {
-		var err error
 		creds := credentials.NewStaticCredentials(os.awsAccessKeyID, os.awsSecretAccessKey, "")
-		cfg := aws.NewConfig().
-			WithRegion(os.region).
-			WithCredentials(creds).
-			WithEndpoint(host).
-			WithS3ForcePathStyle(true).
-			WithDisableSSL(!useSSL)
-		os.s3sess, err = session.NewSession(cfg)
-		if err != nil {
+		if err := os.initSession(creds); err != nil {
 			return nil, err
 		}
-		os.s3svc = s3.New(os.s3sess)
 	}
 	return os, nil
 }
 
+// initSession creates the session of the S3 API with the credentials
+func (ostore *S3OS) initSession(creds *credentials.Credentials) error {
+	sess, err := session.NewSession(ostore.awsConfig.Copy().WithCredentials(creds))
+	if err != nil {
+		return err
+	}
+	ostore.s3sess = sess
+	ostore.s3svc = ostore.newService()
+	return nil
+}
+
+// setAnonymous makes the driver read the public objects of the bucket without signing the
+// requests. The writes fail with ErrNotSupported.
+func (ostore *S3OS) setAnonymous() error {
+	ostore.anonymous = true
+	ostore.useFullAPI = true
+	ostore.awsAccessKeyID, ostore.awsSecretAccessKey = "", ""
+	if ostore.osURL != nil {
+		query := ostore.osURL.Query()
+		query.Set("anonymous", "true")
+		ostore.osURL.User = nil
+		ostore.osURL.RawQuery = query.Encode()
+	}
+	return ostore.initSession(credentials.AnonymousCredentials)
+}
+
 func (os *S3OS) NewSession(path string) OSSession {
 	policy, signature, credential, xAmzDate := createPolicy(os.awsAccessKeyID,
-		os.bucket, os.region, os.awsSecretAccessKey, path)
+		os.bucket, os.region, os.awsSecretAccessKey, os.keyPrefix+path, S3_POLICY_EXPIRE_IN_HOURS*time.Hour, 0)
 	sess := &s3Session{
 		os:          os,
-		host:        os.host,
+		host:        os.endpointHost(),
 		bucket:      os.bucket,
 		key:         os.keyPrefix + path,
 		policy:      policy,
@@ -196,13 +395,193 @@ func (os *S3OS) NewSession(path string) OSSession {
 		storageType: OSInfo_S3,
 	}
 	if os.useFullAPI {
-		sess.s3svc = os.s3svc
+		sess.s3svc = os.service()
 		sess.s3sess = os.s3sess
 	}
 	sess.fields = s3GetFields(sess)
 	return sess
 }
 
+// resolvesEndpoints tells if the endpoints are resolved with the UseFIPS and UseDualStack options
+func (ostore *S3OS) resolvesEndpoints() bool {
+	return ostore.awsEndpoints && (ostore.UseFIPS || ostore.UseDualStack)
+}
+
+func (ostore *S3OS) endpointOptions(opts *endpoints.Options) {
+	if ostore.UseFIPS {
+		opts.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if ostore.UseDualStack {
+		opts.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+}
+
+// service returns the client of the S3 API, resolving the FIPS and dual-stack endpoints and
+// replacing the retryer if enabled
+func (ostore *S3OS) service() *s3.S3 {
+	if ostore.s3sess == nil || (!ostore.resolvesEndpoints() && ostore.SDKRetryer == nil && !ostore.DisableSDKRetries) {
+		return ostore.s3svc
+	}
+	cfg := &aws.Config{}
+	if ostore.resolvesEndpoints() {
+		var opts endpoints.Options
+		ostore.endpointOptions(&opts)
+		cfg.UseFIPSEndpoint = opts.UseFIPSEndpoint
+		cfg.UseDualStackEndpoint = opts.UseDualStackEndpoint
+	}
+	return ostore.newService(cfg)
+}
+
+// retryer returns the retryer of the SDK requests, backing off from the throttled ones
+func (ostore *S3OS) retryer() request.Retryer {
+	if ostore.DisableSDKRetries {
+		return client.NoOpRetryer{}
+	}
+	retryer := ostore.SDKRetryer
+	if retryer == nil {
+		retryer = client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries}
+	}
+	return &s3ThrottleRetryer{Retryer: retryer}
+}
+
+// s3ThrottleRetryer delays the retries of the requests throttled by S3 as asked by their
+// Retry-After header, or with an exponential backoff starting at s3ThrottleMinDelay, so that
+// retrying doesn't keep the request rate over the limit of the bucket. The other errors are
+// retried by the wrapped retryer.
+type s3ThrottleRetryer struct {
+	request.Retryer
+}
+
+func (retryer *s3ThrottleRetryer) RetryRules(r *request.Request) time.Duration {
+	if !isS3Throttle(r) {
+		return retryer.Retryer.RetryRules(r)
+	}
+	if delay, ok := retryAfter(r.HTTPResponse.Header.Get("Retry-After")); ok {
+		if delay > s3ThrottleMaxDelay {
+			delay = s3ThrottleMaxDelay
+		}
+		return delay
+	}
+	delay := s3ThrottleMaxDelay
+	if r.RetryCount < 6 {
+		delay = s3ThrottleMinDelay << r.RetryCount
+	}
+	// jittered, for the throttled requests not to be retried all at once
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// isS3Throttle tells if the request failed because of the request rate limit of the bucket, as
+// opposed to the other 5xx errors
+func isS3Throttle(r *request.Request) bool {
+	if r.HTTPResponse == nil {
+		return false
+	}
+	var aerr awserr.Error
+	return r.HTTPResponse.StatusCode == http.StatusTooManyRequests ||
+		(errors.As(r.Error, &aerr) && aerr.Code() == "SlowDown")
+}
+
+// retryAfter parses the delay of a Retry-After header, either in seconds or as an HTTP date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		delay := date.Sub(Now())
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+func (ostore *S3OS) newService(cfgs ...*aws.Config) *s3.S3 {
+	cfgs = append(cfgs, request.WithRetryer(&aws.Config{}, ostore.retryer()))
+	svc := s3.New(ostore.s3sess, cfgs...)
+	svc.Handlers.UnmarshalError.PushBack(ostore.checkRegionRedirect)
+	return svc
+}
+
+// checkRegionRedirect replaces the error of the requests redirected because the bucket is in
+// another region with one naming the region, or prepares their retry in the region of the bucket
+// with FollowRegionRedirects
+func (ostore *S3OS) checkRegionRedirect(r *request.Request) {
+	if r.HTTPResponse == nil || r.HTTPResponse.StatusCode != http.StatusMovedPermanently {
+		return
+	}
+	region := r.HTTPResponse.Header.Get(s3BucketRegionHeader)
+	if region == "" || region == aws.StringValue(r.Config.Region) {
+		return
+	}
+	if ostore.FollowRegionRedirects && ostore.awsEndpoints {
+		configured := aws.StringValue(r.Config.Region)
+		err := ostore.redirectRegion(r, region)
+		if err == nil {
+			Log.Warnf("Retrying the request in the region of the bucket, the region of the driver should be fixed bucket=%s region=%s bucketRegion=%s",
+				ostore.bucket, configured, region)
+			r.Retryable = aws.Bool(true)
+			return
+		}
+		Log.Warnf("Failed to redirect the request to the region of the bucket bucket=%s region=%s err=%v", ostore.bucket, region, err)
+	}
+	r.Error = regionMismatchError(ostore.bucket, region, aws.StringValue(r.Config.Region))
+}
+
+// redirectRegion makes the retries of the request go to the endpoint of the region
+func (ostore *S3OS) redirectRegion(r *request.Request, region string) error {
+	resolver := r.Config.EndpointResolver
+	if resolver == nil {
+		resolver = endpoints.DefaultResolver()
+	}
+	endpoint, err := resolver.EndpointFor(s3.EndpointsID, region, ostore.endpointOptions)
+	if err != nil {
+		return err
+	}
+	oldURL, err := url.Parse(r.ClientInfo.Endpoint)
+	if err != nil {
+		return err
+	}
+	newURL, err := url.Parse(endpoint.URL)
+	if err != nil {
+		return err
+	}
+	r.HTTPRequest.URL.Host = strings.Replace(r.HTTPRequest.URL.Host, oldURL.Host, newURL.Host, 1)
+	r.HTTPRequest.Host = strings.Replace(r.HTTPRequest.Host, oldURL.Host, newURL.Host, 1)
+	r.ClientInfo.Endpoint = endpoint.URL
+	r.ClientInfo.SigningRegion = region
+	r.Config.Region = aws.String(region)
+	return nil
+}
+
+func regionMismatchError(bucket, region, configured string) error {
+	if configured == "" {
+		return fmt.Errorf("%w: bucket %s is in region %s", ErrRegionMismatch, bucket, region)
+	}
+	return fmt.Errorf("%w: bucket %s is in region %s, not %s", ErrRegionMismatch, bucket, region, configured)
+}
+
+// endpointHost returns the host the POST policy uploads and the public URLs use, the virtual-hosted
+// style host of the bucket at the FIPS or dual-stack endpoint of the region if enabled
+func (ostore *S3OS) endpointHost() string {
+	if !ostore.resolvesEndpoints() {
+		return ostore.host
+	}
+	endpoint, err := endpoints.DefaultResolver().EndpointFor(s3.EndpointsID, ostore.region, ostore.endpointOptions)
+	if err != nil {
+		Log.Warnf("Failed to resolve the S3 endpoint region=%s err=%v", ostore.region, err)
+		return ostore.host
+	}
+	u, err := url.Parse(endpoint.URL)
+	if err != nil {
+		return ostore.host
+	}
+	return fmt.Sprintf("%s://%s.%s", u.Scheme, ostore.bucket, u.Host)
+}
+
 func s3GetFields(sess *s3Session) map[string]string {
 	return map[string]string{
 		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
@@ -212,6 +591,24 @@ func s3GetFields(sess *s3Session) map[string]string {
 	}
 }
 
+func (os *s3Session) expectedBucketOwner() *string {
+	if os.os == nil || os.os.ExpectedBucketOwner == "" {
+		return nil
+	}
+	return aws.String(os.os.ExpectedBucketOwner)
+}
+
+func (os *s3Session) anonymous() bool {
+	return os.os != nil && os.os.anonymous
+}
+
+func (os *s3Session) requestPayer() *string {
+	if os.os == nil || os.os.RequestPayer == "" {
+		return nil
+	}
+	return aws.String(os.os.RequestPayer)
+}
+
 func (os *s3Session) OS() OSDriver {
 	return os.os
 }
@@ -224,17 +621,49 @@ func (os *s3Session) EndSession() {
 }
 
 func (ostore *S3OS) UriSchemes() []string {
-	return []string{"s3", "s3+http", "s3+https"}
+	return []string{"s3", "s3+http", "s3+https", "r2", "spaces"}
 }
 
 func (ostore *S3OS) Publish(ctx context.Context) (string, error) {
 	return "", ErrNotSupported
 }
 
+func (ostore *S3OS) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// HealthCheck checks that the bucket exists and can be accessed with a HEAD bucket request. Not
+// supported in lite mode, where the credentials may only allow to write objects.
+func (ostore *S3OS) HealthCheck(ctx context.Context) error {
+	if !ostore.useFullAPI || ostore.s3svc == nil {
+		return ErrNotSupported
+	}
+	input := &s3.HeadBucketInput{Bucket: aws.String(ostore.bucket)}
+	if ostore.ExpectedBucketOwner != "" {
+		input.ExpectedBucketOwner = aws.String(ostore.ExpectedBucketOwner)
+	}
+	_, err := ostore.service().HeadBucketWithContext(ctx, input)
+	if err == nil {
+		return nil
+	}
+	status := 0
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		status = reqErr.StatusCode()
+	}
+	return healthCheckError("s3 bucket "+ostore.bucket, status, err)
+}
+
 func (ostore *S3OS) Description() string {
 	return "AWS S3 or S3 compatible storage."
 }
 
+// String describes the driver with the access key secret masked, so it's safe to log
+func (ostore *S3OS) String() string {
+	return fmt.Sprintf("S3OS{host: %s, region: %s, bucket: %s, keyPrefix: %s, accessKeyID: %s, accessKeySecret: %s}",
+		ostore.host, ostore.region, ostore.bucket, ostore.keyPrefix, ostore.awsAccessKeyID, redactSecret(ostore.awsSecretAccessKey))
+}
+
 type s3pageInfo struct {
 	files       []FileInfo
 	directories []string
@@ -242,6 +671,10 @@ type s3pageInfo struct {
 	s3svc       *s3.S3
 	params      *s3.ListObjectsInput
 	nextMarker  string
+	// rewrite maps the listed keys back to the prefix they were requested with
+	rewrite *S3KeyRewrite
+	// mapper maps the listed keys back to the keys of the files
+	mapper S3KeyMapper
 }
 
 func (s3pi *s3pageInfo) Files() []FileInfo {
@@ -258,9 +691,11 @@ func (s3pi *s3pageInfo) NextPage() (PageInfo, error) {
 		return nil, ErrNoNextPage
 	}
 	next := &s3pageInfo{
-		s3svc:  s3pi.s3svc,
-		params: s3pi.params,
-		ctx:    s3pi.ctx,
+		s3svc:   s3pi.s3svc,
+		params:  s3pi.params,
+		ctx:     s3pi.ctx,
+		rewrite: s3pi.rewrite,
+		mapper:  s3pi.mapper,
 	}
 	next.params.Marker = &s3pi.nextMarker
 	if err := next.listFiles(); err != nil {
@@ -275,11 +710,11 @@ func (s3pi *s3pageInfo) listFiles() error {
 		return err
 	}
 	for _, cont := range resp.CommonPrefixes {
-		s3pi.directories = append(s3pi.directories, *cont.Prefix)
+		s3pi.directories = append(s3pi.directories, s3pi.requestedKey(*cont.Prefix))
 	}
 	for _, cont := range resp.Contents {
 		fi := FileInfo{
-			Name:         *cont.Key,
+			Name:         s3pi.requestedKey(*cont.Key),
 			ETag:         *cont.ETag,
 			LastModified: *cont.LastModified,
 			Size:         cont.Size,
@@ -294,26 +729,79 @@ func (s3pi *s3pageInfo) listFiles() error {
 	return nil
 }
 
+// requestedKey returns the key with the prefix the listing was requested with, mapped back to the
+// key of the file if it was mapped
+func (s3pi *s3pageInfo) requestedKey(key string) string {
+	if s3pi.rewrite != nil && strings.HasPrefix(key, s3pi.rewrite.NewPrefix) {
+		key = s3pi.rewrite.OldPrefix + strings.TrimPrefix(key, s3pi.rewrite.NewPrefix)
+	}
+	if s3pi.mapper != nil {
+		if fileKey, ok := s3pi.mapper.FileKey(key); ok {
+			return fileKey
+		}
+	}
+	return key
+}
+
+// rewriteKey applies the first of the KeyRewrites matching the key. Returns the key unchanged and
+// a nil rewrite if none matches.
+func (os *s3Session) rewriteKey(key string) (string, *S3KeyRewrite) {
+	if os.os == nil {
+		return key, nil
+	}
+	for i, rewrite := range os.os.KeyRewrites {
+		if strings.HasPrefix(key, rewrite.OldPrefix) {
+			return rewrite.NewPrefix + strings.TrimPrefix(key, rewrite.OldPrefix), &os.os.KeyRewrites[i]
+		}
+	}
+	return key, nil
+}
+
+// fullKey returns the object key of the file
+// TODO: Remove the compat once legacy clients stop sending the full path for reading and listing
+func (os *s3Session) fullKey(name string) string {
+	if os.key != "" && strings.HasPrefix(name, os.key+"/") {
+		return objectKey("", name)
+	}
+	return objectKey(os.key, name)
+}
+
+// mapKey returns the key of the object storing the file with the key, mapped by the KeyMapper
+func (os *s3Session) mapKey(key string) string {
+	if os.os == nil || os.os.KeyMapper == nil || key == "" {
+		return key
+	}
+	return os.os.KeyMapper.ObjectKey(key)
+}
+
 func (os *s3Session) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
 	if os.s3svc != nil {
 		bucket := aws.String(os.bucket)
 		params := &s3.ListObjectsInput{
-			Bucket: bucket,
-		}
-		// TODO: Remove this compat once legacy clients stop sending the full path for listing
-		if os.key != "" && !strings.HasPrefix(prefix, os.key+"/") {
-			prefix = path.Join(os.key, prefix)
+			Bucket:              bucket,
+			ExpectedBucketOwner: os.expectedBucketOwner(),
+			RequestPayer:        os.requestPayer(),
 		}
+		prefix = listingPrefix(os.fullKey(prefix), prefix)
+		var rewrite *S3KeyRewrite
 		if prefix != "" {
+			prefix, rewrite = os.rewriteKey(prefix)
 			params.Prefix = aws.String(prefix)
 		}
 		if delim != "" {
 			params.Delimiter = aws.String(delim)
 		}
+		if os.os != nil && os.os.ListPageSize > 0 {
+			params.MaxKeys = aws.Int64(os.os.ListPageSize)
+		}
 		pi := &s3pageInfo{
-			ctx:    ctx,
-			s3svc:  os.s3svc,
-			params: params,
+			ctx:     ctx,
+			s3svc:   os.s3svc,
+			params:  params,
+			rewrite: rewrite,
+		}
+		if os.os != nil {
+			pi.mapper = os.os.KeyMapper
 		}
 		if err := pi.listFiles(); err != nil {
 			return nil, err
@@ -328,25 +816,76 @@ func (os *s3Session) ReadData(ctx context.Context, name string) (*FileInfoReader
 	return os.ReadDataRange(ctx, name, "")
 }
 
-func (os *s3Session) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+// ReadDataRange reads the byte range of the file. Multiple ranges, e.g. "bytes=0-99,500-599", are
+// returned in a multipart/byteranges body to read with ByteRangeParts. They are requested at once
+// with MultiRangeReads, falling back to a request per range if the service doesn't return a
+// multipart response.
+func (os *s3Session) ReadDataRange(ctx context.Context, name, byteRange string) (res *FileInfoReader, err error) {
+	defer recordRead("s3", time.Now(), &res, &err)
+	readRange := func(ctx context.Context, byteRange string) (*FileInfoReader, error) {
+		return os.getObject(ctx, name, func(params *s3.GetObjectInput) {
+			if byteRange != "" {
+				params.Range = aws.String(byteRange)
+			}
+		})
+	}
+	ranges := splitByteRanges(byteRange)
+	if ranges == nil || (os.os != nil && os.os.MultiRangeReads) {
+		res, err = readRange(ctx, byteRange)
+		if ranges == nil || err != nil {
+			return res, err
+		}
+		if strings.HasPrefix(res.ContentType, multipartByteranges) {
+			// the size of the file isn't known from a multipart response
+			res.Size = nil
+			return res, nil
+		}
+		res.Body.Close()
+	}
+	return readRangesSequentially(ctx, ranges, readRange)
+}
+
+var _ ConditionalReader = (*s3Session)(nil)
+
+func (os *s3Session) ReadDataConditional(ctx context.Context, name, etag string, modifiedSince time.Time) (res *FileInfoReader, err error) {
+	defer recordRead("s3", time.Now(), &res, &err)
+	return os.getObject(ctx, name, func(params *s3.GetObjectInput) {
+		if etag != "" {
+			params.IfNoneMatch = aws.String(etag)
+		}
+		if !modifiedSince.IsZero() {
+			params.IfModifiedSince = aws.Time(modifiedSince)
+		}
+	})
+}
+
+// getObject reads the file with the GetObject parameters set by setParams
+func (os *s3Session) getObject(ctx context.Context, name string, setParams func(*s3.GetObjectInput)) (*FileInfoReader, error) {
 	if os.s3svc == nil {
 		return nil, ErrNotSupported
 	}
-	// TODO: Remove this compat once legacy clients stop sending the full path for reading
-	if os.key != "" && !strings.HasPrefix(name, os.key+"/") {
-		name = path.Join(os.key, name)
-	}
+	name = os.fullKey(name)
+	key, _ := os.rewriteKey(os.mapKey(name))
 	params := &s3.GetObjectInput{
-		Bucket: aws.String(os.bucket),
-		Key:    aws.String(name),
+		Bucket:              aws.String(os.bucket),
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		RequestPayer:        os.requestPayer(),
+		Key:                 aws.String(key),
 	}
-	if byteRange != "" {
-		params.Range = aws.String(byteRange)
+	setParams(params)
+	decompress := os.os != nil && os.os.DecompressGzip
+	var opts []request.Option
+	if decompress {
+		// Accept gzip explicitly so that the HTTP client doesn't decompress the files transparently
+		opts = append(opts, request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "gzip"}))
 	}
-	resp, err := os.s3svc.GetObjectWithContext(ctx, params)
+	resp, err := os.s3svc.GetObjectWithContext(ctx, params, opts...)
+	var reqErr awserr.RequestFailure
 	var awserr awserr.Error
 	if errors.As(err, &awserr) && (awserr.Code() == s3.ErrCodeNoSuchKey || awserr.Code() == s3.ErrCodeNoSuchBucket) {
 		return nil, ErrNotExist
+	} else if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotModified {
+		return nil, ErrNotModified
 	} else if err != nil {
 		return nil, err
 	}
@@ -362,23 +901,55 @@ func (os *s3Session) ReadDataRange(ctx context.Context, name, byteRange string)
 	if resp.ContentType != nil {
 		res.ContentType = *resp.ContentType
 	}
-	if resp.ContentRange != nil {
-		res.ContentRange = *resp.ContentRange
-	}
 	res.Name = name
 	res.Size = resp.ContentLength
+	res.ContentLength = aws.Int64Value(resp.ContentLength)
+	// S3 returns the whole object when no range was requested or when some S3 compatible services
+	// ignore it, only partial content responses come with a Content-Range
+	if resp.ContentRange != nil && *resp.ContentRange != "" {
+		res.ContentRange = *resp.ContentRange
+		res.Size = nil
+		if size, ok := contentRangeSize(res.ContentRange); ok {
+			res.Size = &size
+		}
+	}
 	if len(resp.Metadata) > 0 {
 		res.Metadata = make(map[string]string, len(resp.Metadata))
 		for k, v := range resp.Metadata {
 			res.Metadata[k] = *v
 		}
 	}
+	res.ContentEncoding = aws.StringValue(resp.ContentEncoding)
+	if decompress && res.ContentEncoding == "gzip" && res.ContentRange == "" {
+		if err := gunzipBody(res); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
 	return res, nil
 }
 
+// S3ExpiryTag is the object tag set to the number of days after which the file should be deleted,
+// when saved with FileProperties.ExpiresAfter. S3 only deletes the objects if the bucket has a
+// lifecycle rule for each of the used values, e.g. for 30 days:
+//
+//	{
+//	  "ID": "expire-after-30-days",
+//	  "Status": "Enabled",
+//	  "Filter": {"Tag": {"Key": "expire-after-days", "Value": "30"}},
+//	  "Expiration": {"Days": 30}
+//	}
+const S3ExpiryTag = "expire-after-days"
+
+// expiryDays rounds the duration up to the whole days used by the lifecycle rules
+func expiryDays(expiresAfter time.Duration) int {
+	day := 24 * time.Hour
+	return int((expiresAfter + day - 1) / day)
+}
+
 func (os *s3Session) saveDataPut(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
 	bucket := aws.String(os.bucket)
-	keyname := aws.String(path.Join(os.key, name))
+	keyname := aws.String(os.mapKey(objectKey(os.key, name)))
 	var metadata map[string]*string
 	if fields != nil && len(fields.Metadata) > 0 {
 		metadata = make(map[string]*string)
@@ -386,76 +957,391 @@ func (os *s3Session) saveDataPut(ctx context.Context, name string, data io.Reade
 			metadata[k] = aws.String(v)
 		}
 	}
-	data, contentType, err := os.peekContentType(name, data)
+	data, contentType, err := peekContentType(name, data)
 	if err != nil {
 		return nil, err
 	}
 	if fields != nil && fields.ContentType != "" {
 		contentType = fields.ContentType
 	}
+	headers, err := parseObjectHeaders(fields)
+	if err != nil {
+		return nil, err
+	}
 
 	respHeaders := http.Header{}
-	uploader := s3manager.NewUploader(os.s3sess, func(u *s3manager.Uploader) {
-		u.Concurrency = uploaderConcurrency
-		u.PartSize = uploaderPartSize
-		u.RequestOptions = append(u.RequestOptions, request.WithGetResponseHeaders(&respHeaders))
-	})
+	var sizeHint int64
+	if fields != nil {
+		sizeHint = fields.SizeHint
+	}
+	uploader := os.newUploader(&respHeaders, sizeHint)
+	body, checksum := withChecksum(data)
 	params := &s3manager.UploadInput{
-		Bucket:      bucket,
-		Key:         keyname,
-		Metadata:    metadata,
-		Body:        data,
-		ContentType: aws.String(contentType),
+		Bucket:              bucket,
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		RequestPayer:        os.requestPayer(),
+		Key:                 keyname,
+		Metadata:            metadata,
+		Body:                body,
+		ContentType:         aws.String(contentType),
+	}
+	if headers.contentDisposition != "" {
+		params.ContentDisposition = aws.String(headers.contentDisposition)
+	}
+	if headers.contentLanguage != "" {
+		params.ContentLanguage = aws.String(headers.contentLanguage)
 	}
 	if fields != nil {
 		params.CacheControl = &fields.CacheControl
+		if fields.ExpiresAfter > 0 {
+			days := expiryDays(fields.ExpiresAfter)
+			params.Tagging = aws.String(url.Values{S3ExpiryTag: {strconv.Itoa(days)}}.Encode())
+			params.Expires = aws.Time(Now().Add(time.Duration(days) * 24 * time.Hour))
+		}
+		if fields.Retention != nil {
+			if err := checkRetention(fields.Retention); err != nil {
+				return nil, err
+			}
+			params.ObjectLockMode = aws.String(fields.Retention.Mode)
+			params.ObjectLockRetainUntilDate = aws.Time(fields.Retention.RetainUntil)
+		}
+		if fields.Compress && compressible(contentType) {
+			compressed := withGzip(body)
+			defer compressed.Close()
+			params.Body = compressed
+			params.ContentEncoding = aws.String("gzip")
+		}
 	}
-	if timeout == 0 {
-		timeout = defaultSaveTimeout
-	}
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+	ctx, cancel := withSaveTimeout(ctx, timeout, defaultSaveTimeout)
 	_, err = uploader.UploadWithContext(ctx, params)
 	cancel()
-	if err != nil {
+	if err != nil && params.ObjectLockMode != nil {
+		return nil, objectLockError(err)
+	} else if err != nil {
 		return nil, err
 	}
 
 	return &SaveDataOutput{
 		URL:                     os.getAbsURL(*keyname),
 		UploaderResponseHeaders: respHeaders,
+		Checksum:                checksum(),
+		ChecksumAlgorithm:       ChecksumAlgorithmSHA256,
 	}, nil
 }
 
-func (os *s3Session) DeleteFile(ctx context.Context, name string) error {
+func checkRetention(retention *ObjectRetention) error {
+	if retention.Mode != RetentionGovernance && retention.Mode != RetentionCompliance {
+		return fmt.Errorf("invalid retention mode %q", retention.Mode)
+	}
+	if retention.RetainUntil.IsZero() {
+		return errors.New("the retain until date of the retention is required")
+	}
+	return nil
+}
+
+// objectLockError returns an error wrapping ErrObjectLockNotEnabled when the upload was rejected
+// because the bucket doesn't have Object Lock enabled. The uploads of multiple parts return the
+// error of the failed part as the original error.
+func objectLockError(err error) error {
+	var aerr awserr.Error
+	for cause := err; errors.As(cause, &aerr); cause = aerr.OrigErr() {
+		if aerr.Code() == "InvalidRequest" && strings.Contains(aerr.Message(), "Object Lock") {
+			return fmt.Errorf("%w: %v", ErrObjectLockNotEnabled, err)
+		}
+	}
+	return err
+}
+
+var _ Stater = (*s3Session)(nil)
+
+// Stat returns the properties of the file with a HEAD request, including its Object Lock retention
+// and legal hold
+func (os *s3Session) Stat(ctx context.Context, name string) (*FileStat, error) {
+	if os.s3svc == nil {
+		return nil, ErrNotSupported
+	}
+	key, _ := os.rewriteKey(os.mapKey(os.fullKey(name)))
+	resp, err := os.s3svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:              aws.String(os.bucket),
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		RequestPayer:        os.requestPayer(),
+		Key:                 aws.String(key),
+	})
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	stat := &FileStat{
+		FileInfo: FileInfo{
+			Name: name,
+			ETag: aws.StringValue(resp.ETag),
+			Size: resp.ContentLength,
+		},
+		ContentType: aws.StringValue(resp.ContentType),
+		LegalHold:   aws.StringValue(resp.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn,
+	}
+	if resp.LastModified != nil {
+		stat.LastModified = *resp.LastModified
+	}
+	if resp.ObjectLockMode != nil && resp.ObjectLockRetainUntilDate != nil {
+		stat.Retention = &ObjectRetention{
+			Mode:        *resp.ObjectLockMode,
+			RetainUntil: *resp.ObjectLockRetainUntilDate,
+		}
+	}
+	return stat, nil
+}
+
+func (os *s3Session) newUploader(respHeaders *http.Header, sizeHint int64) *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(os.s3svc, func(u *s3manager.Uploader) {
+		u.Concurrency = uploaderConcurrency
+		if os.os != nil && os.os.UploadConcurrency > 0 {
+			u.Concurrency = os.os.UploadConcurrency
+		}
+		u.PartSize = os.uploadPartSize(sizeHint)
+		u.RequestOptions = append(u.RequestOptions, func(r *request.Request) {
+			// the parts are uploaded concurrently, only the request completing the upload writes
+			// the headers
+			switch r.Operation.Name {
+			case "PutObject", "CompleteMultipartUpload":
+				request.WithGetResponseHeaders(respHeaders)(r)
+			}
+		})
+	})
+}
+
+// uploadPartSize returns the part size for uploading a file of the given size hint. The uploader
+// saves the files smaller than a part with a single request, buffering the part, so a file known
+// to be smaller than the configured part size gets a part just big enough for it. A file too big
+// for the max number of parts gets bigger parts.
+func (os *s3Session) uploadPartSize(sizeHint int64) int64 {
+	partSize := int64(uploaderPartSize)
+	if os.os != nil && os.os.UploadPartSize > 0 {
+		partSize = os.os.UploadPartSize
+	}
+	if sizeHint <= 0 {
+		return partSize
+	}
+	if sizeHint < partSize {
+		// one more byte than the data, for the uploader to find its end within the part
+		if sizeHint+1 < s3manager.MinUploadPartSize {
+			return s3manager.MinUploadPartSize
+		}
+		return sizeHint + 1
+	}
+	if minPartSize := (sizeHint + s3manager.MaxUploadParts - 1) / s3manager.MaxUploadParts; minPartSize > partSize {
+		return minPartSize
+	}
+	return partSize
+}
+
+func (os *s3Session) DeleteFile(ctx context.Context, name string) (err error) {
+	defer recordDelete("s3", time.Now(), &err)
 	if os.s3svc == nil {
 		return ErrNotSupported
 	}
-	params := &s3.DeleteObjectInput{
-		Bucket: aws.String(os.bucket),
-		Key:    aws.String(name),
+	if os.anonymous() {
+		return errAnonymousWrite
 	}
-	if os.key != "" && !strings.HasPrefix(name, os.key+"/") {
-		params.Key = aws.String(path.Join(os.key, name))
+	params := &s3.DeleteObjectInput{
+		Bucket:              aws.String(os.bucket),
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		RequestPayer:        os.requestPayer(),
+		Key:                 aws.String(os.mapKey(os.fullKey(name))),
 	}
-	_, err := os.s3svc.DeleteObjectWithContext(ctx, params)
+	_, err = os.s3svc.DeleteObjectWithContext(ctx, params)
 	return err
 }
 
-func (os *s3Session) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+func (os *s3Session) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return listedPrefixSize(ctx, os, prefix)
+}
+
+// Rename copies the object to the new name and deletes the old one. It's not atomic: the file is
+// available under both names until the delete completes.
+func (os *s3Session) Rename(ctx context.Context, oldName, newName string) error {
+	if os.s3svc == nil {
+		return ErrNotSupported
+	}
+	if os.anonymous() {
+		return errAnonymousWrite
+	}
+	oldName, newName = os.fullKey(oldName), os.fullKey(newName)
+	_, err := os.s3svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:              aws.String(os.bucket),
+		CopySource:          aws.String(url.PathEscape(os.bucket + "/" + os.mapKey(oldName))),
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		RequestPayer:        os.requestPayer(),
+		Key:                 aws.String(os.mapKey(newName)),
+	})
+	var awserr awserr.Error
+	if errors.As(err, &awserr) && (awserr.Code() == s3.ErrCodeNoSuchKey || awserr.Code() == s3.ErrCodeNoSuchBucket) {
+		return ErrNotExist
+	} else if err != nil {
+		return err
+	}
+	return os.DeleteFile(ctx, oldName)
+}
+
+func (os *s3Session) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("s3", time.Now(), counter, &err)
+	return os.saveData(ctx, name, data, fields, timeout)
+}
+
+func (os *s3Session) saveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	if os.anonymous() {
+		return nil, errAnonymousWrite
+	}
+	// a failing read aborts the upload, so no partial object is left behind
+	data, limiter := withMaxBytes(data, fields)
 	if os.s3svc != nil {
-		return os.saveDataPut(ctx, name, data, fields, timeout)
+		out, err := os.saveDataPut(ctx, name, data, fields, timeout)
+		return out, limiter.tooLarge(err)
+	}
+	// the POST policy doesn't allow any header fields
+	if err := checkNoHeaders(fields); err != nil {
+		return nil, err
+	}
+	if fields != nil && fields.Retention != nil {
+		return nil, fmt.Errorf("retention: %w", ErrNotSupported)
 	}
 	_ = path.Join(os.host, os.key, name)
 	path, err := os.postData(ctx, name, data, fields, timeout)
 	if err != nil {
 		// handle error
-		return nil, err
+		return nil, limiter.tooLarge(err)
 	}
 
 	url := os.getAbsURL(path)
 	return &SaveDataOutput{URL: url}, nil
 }
 
+// S3UploadState is the progress of a multipart upload started by ResumeUpload. It can be persisted
+// as JSON to resume the upload after the process restarts.
+type S3UploadState struct {
+	Key      string         `json:"key"`
+	UploadID string         `json:"uploadId"`
+	PartSize int64          `json:"partSize"`
+	Parts    []S3UploadPart `json:"parts"`
+}
+
+// S3UploadPart is a part of a multipart upload which was uploaded successfully
+type S3UploadPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// ResumableUploader is implemented by the sessions which can resume interrupted uploads
+type ResumableUploader interface {
+	// ResumeUpload saves the data as a multipart upload. If the upload fails, the returned state can
+	// be passed to a later call with the same data from the start, and only the parts which were
+	// not uploaded yet will be sent. Pass a nil state to start a new upload. The returned state is
+	// nil once the upload is complete.
+	ResumeUpload(ctx context.Context, name string, data io.Reader, state *S3UploadState) (*SaveDataOutput, *S3UploadState, error)
+}
+
+var _ ResumableUploader = (*s3Session)(nil)
+
+func (os *s3Session) ResumeUpload(ctx context.Context, name string, data io.Reader, state *S3UploadState) (out *SaveDataOutput, resumeState *S3UploadState, err error) {
+	data, counter := countSave(data)
+	defer recordSave("s3", time.Now(), counter, &err)
+	if os.s3svc == nil {
+		return nil, nil, ErrNotSupported
+	}
+	if os.anonymous() {
+		return nil, nil, errAnonymousWrite
+	}
+	key := os.mapKey(objectKey(os.key, name))
+	if state == nil || state.UploadID == "" {
+		var contentType string
+		data, contentType, err = peekContentType(name, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := os.s3svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:              aws.String(os.bucket),
+			ExpectedBucketOwner: os.expectedBucketOwner(),
+			RequestPayer:        os.requestPayer(),
+			Key:                 aws.String(key),
+			ContentType:         aws.String(contentType),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		partSize := int64(uploaderPartSize)
+		if os.os != nil && os.os.UploadPartSize > 0 {
+			partSize = os.os.UploadPartSize
+		}
+		state = &S3UploadState{Key: key, UploadID: aws.StringValue(resp.UploadId), PartSize: partSize}
+	} else if state.Key != key {
+		return nil, nil, fmt.Errorf("upload state is for key %s, not %s", state.Key, key)
+	} else {
+		resumed := *state
+		resumed.Parts = append([]S3UploadPart(nil), state.Parts...)
+		state = &resumed
+	}
+
+	body, checksum := withChecksum(data)
+	// skip the data of the parts uploaded before
+	if skip := state.PartSize * int64(len(state.Parts)); skip > 0 {
+		if _, err = io.CopyN(ioutil.Discard, body, skip); err != nil {
+			return nil, state, err
+		}
+	}
+	buf := make([]byte, state.PartSize)
+	for {
+		n, readErr := io.ReadFull(body, buf)
+		if readErr == io.EOF && len(state.Parts) > 0 {
+			break
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return nil, state, readErr
+		}
+		number := int64(len(state.Parts) + 1)
+		resp, err := os.s3svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:              aws.String(os.bucket),
+			ExpectedBucketOwner: os.expectedBucketOwner(),
+			RequestPayer:        os.requestPayer(),
+			Key:                 aws.String(key),
+			UploadId:            aws.String(state.UploadID),
+			PartNumber:          aws.Int64(number),
+			Body:                bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			Log.Warnf("Multipart upload interrupted key=%s part=%d err=%v", key, number, err)
+			return nil, state, err
+		}
+		state.Parts = append(state.Parts, S3UploadPart{Number: number, ETag: aws.StringValue(resp.ETag)})
+		if readErr != nil {
+			break
+		}
+	}
+
+	parts := make([]*s3.CompletedPart, len(state.Parts))
+	for i, part := range state.Parts {
+		parts[i] = &s3.CompletedPart{PartNumber: aws.Int64(part.Number), ETag: aws.String(part.ETag)}
+	}
+	_, err = os.s3svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:              aws.String(os.bucket),
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		RequestPayer:        os.requestPayer(),
+		Key:                 aws.String(key),
+		UploadId:            aws.String(state.UploadID),
+		MultipartUpload:     &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return nil, state, err
+	}
+	return &SaveDataOutput{
+		URL:               os.getAbsURL(key),
+		Checksum:          checksum(),
+		ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+	}, nil, nil
+}
+
 func (os *s3Session) getAbsURL(path string) string {
 	if strings.Contains(os.host, os.bucket) {
 		return os.host + "/" + path
@@ -479,7 +1365,7 @@ func (os *s3Session) GetInfo() *OSInfo {
 	return oi
 }
 
-func (os *s3Session) peekContentType(fileName string, data io.Reader) (*bufio.Reader, string, error) {
+func peekContentType(fileName string, data io.Reader) (*bufio.Reader, string, error) {
 	bufData := bufio.NewReaderSize(data, 4096)
 	firstBytes, err := bufData.Peek(512)
 	if err != nil && err != io.EOF {
@@ -495,11 +1381,11 @@ func (os *s3Session) peekContentType(fileName string, data io.Reader) (*bufio.Re
 
 // if s3 storage is not our own, we are saving data into it using POST request
 func (os *s3Session) postData(ctx context.Context, fileName string, data io.Reader, props *FileProperties, timeout time.Duration) (string, error) {
-	data, fileType, err := os.peekContentType(fileName, data)
+	data, fileType, err := peekContentType(fileName, data)
 	if err != nil {
 		return "", err
 	}
-	path, fileName := path.Split(path.Join(os.key, fileName))
+	path, fileName := path.Split(objectKey(os.key, fileName))
 	fields := map[string]string{
 		"acl":          "public-read",
 		"Content-Type": fileType,
@@ -517,12 +1403,19 @@ func (os *s3Session) postData(ctx context.Context, fileName string, data io.Read
 	if err != nil {
 		return "", err
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := httpClient().Do(req)
 	if err != nil {
 		return "", err
 	}
 	cancel()
+	if region := resp.Header.Get(s3BucketRegionHeader); resp.StatusCode == http.StatusMovedPermanently && region != "" {
+		resp.Body.Close()
+		configured := ""
+		if os.os != nil {
+			configured = os.os.region
+		}
+		return "", regionMismatchError(os.bucket, region, configured)
+	}
 	body := &bytes.Buffer{}
 	sz, err := body.ReadFrom(resp.Body)
 	if err != nil {
@@ -540,17 +1433,105 @@ func (os *s3Session) IsOwn(url string) bool {
 }
 
 func (os *s3Session) Presign(name string, expire time.Duration) (string, error) {
-	key := os.key
-	if name != "" {
-		key = path.Join(key, name)
+	if os.s3svc == nil {
+		return "", ErrNotSupported
 	}
+	key := os.mapKey(objectKey(os.key, name))
+	// The request payer would become a header the URL has to be requested with, so it is left out
 	req, _ := os.s3svc.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(os.bucket),
-		Key:    aws.String(key),
+		Bucket:              aws.String(os.bucket),
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		Key:                 aws.String(key),
 	})
+	signAtNow(req)
 	return req.Presign(expire)
 }
 
+// signAtNow makes the request be signed at the time of Now, for the expiry of the presigned URLs
+func signAtNow(req *request.Request) {
+	req.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
+		Name: v4.SignRequestHandler.Name,
+		Fn: func(r *request.Request) {
+			v4.SignSDKRequestWithCurrentTime(r, Now)
+		},
+	})
+}
+
+// PresignUpload returns a URL to upload the file with a PUT request. The content type, metadata
+// and cache control are part of the signature, so the upload has to send the returned headers.
+func (os *s3Session) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	if os.s3svc == nil {
+		return "", nil, ErrNotSupported
+	}
+	if os.anonymous() {
+		return "", nil, errAnonymousWrite
+	}
+	input := &s3.PutObjectInput{
+		Bucket:              aws.String(os.bucket),
+		ExpectedBucketOwner: os.expectedBucketOwner(),
+		RequestPayer:        os.requestPayer(),
+		Key:                 aws.String(os.mapKey(objectKey(os.key, name))),
+	}
+	contentType, err := TypeByExtension(path.Ext(name))
+	if err != nil {
+		contentType = ""
+	}
+	if fields != nil {
+		if fields.ContentType != "" {
+			contentType = fields.ContentType
+		}
+		if fields.CacheControl != "" {
+			input.CacheControl = aws.String(fields.CacheControl)
+		}
+		if len(fields.Metadata) > 0 {
+			input.Metadata = aws.StringMap(fields.Metadata)
+		}
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	req, _ := os.s3svc.PutObjectRequest(input)
+	signAtNow(req)
+	presigned, signedHeaders, err := req.PresignRequest(expire)
+	if err != nil {
+		return "", nil, err
+	}
+	// the signer returns lower case header names
+	headers := http.Header{}
+	for k, v := range signedHeaders {
+		for _, vv := range v {
+			headers.Add(k, vv)
+		}
+	}
+	return presigned, headers, nil
+}
+
+func (os *s3Session) PublicURL(name string) (string, error) {
+	return os.getAbsURL(os.mapKey(objectKey(os.key, name))), nil
+}
+
+// ObjectURI returns the OS URL of the bucket with the key of the file as the key prefix
+func (os *s3Session) ObjectURI(name string) (string, error) {
+	if os.os == nil || os.os.osURL == nil {
+		return "", ErrNotSupported
+	}
+	u := *os.os.osURL
+	u.Path = "/" + os.bucket + "/" + os.mapKey(objectKey(os.key, name))
+	return u.String(), nil
+}
+
+// ReadSeeker reads the file with a GET of the rest of the file from each offset seeked to
+func (os *s3Session) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	if os.s3svc == nil {
+		return nil, 0, ErrNotSupported
+	}
+	return newRangeReadSeeker(ctx, os, name)
+}
+
+func (os *s3Session) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, os, name, srcPath, fields)
+}
+
 func makeHmac(key []byte, data []byte) []byte {
 	hash := hmac.New(sha256.New, key)
 	hash.Write(data)
@@ -567,29 +1548,81 @@ func signString(stringToSign, sregion, amzDate, secret string) string {
 	return sSignature
 }
 
-// createPolicy returns policy, signature, xAmzCredentail and xAmzDate
-func createPolicy(key, bucket, region, secret, path string) (string, string, string, string) {
+// createPolicy returns policy, signature, xAmzCredentail and xAmzDate. The policy allows uploads
+// of objects under the path, up to maxSize bytes when maxSize is positive.
+func createPolicy(key, bucket, region, secret, path string, expire time.Duration, maxSize int64) (string, string, string, string) {
 	const timeFormat = "2006-01-02T15:04:05.999Z"
 	const shortTimeFormat = "20060102"
 
-	expireAt := time.Now().Add(S3_POLICY_EXPIRE_IN_HOURS * time.Hour)
+	now := Now()
+	expireAt := now.Add(expire)
 	expireFmt := expireAt.UTC().Format(timeFormat)
-	xAmzDate := time.Now().UTC().Format(shortTimeFormat)
+	xAmzDate := now.UTC().Format(shortTimeFormat)
 	xAmzCredential := fmt.Sprintf("%s/%s/%s/s3/aws4_request", key, xAmzDate, region)
+	sizeCondition := ""
+	if maxSize > 0 {
+		sizeCondition = fmt.Sprintf(`
+		["content-length-range", 0, %d],`, maxSize)
+	}
 	src := fmt.Sprintf(`{ "expiration": "%s",
 	"conditions": [
 		{"bucket": "%s"},
 		{"acl": "public-read"},
 		["starts-with", "$Content-Type", ""],
-		["starts-with", "$key", "%s"],
+		["starts-with", "$key", "%s"],%s
 		{"x-amz-algorithm": "AWS4-HMAC-SHA256"},
 		{"x-amz-credential": "%s"},
 		{"x-amz-date": "%sT000000Z" }
-	]}`, expireFmt, bucket, path, xAmzCredential, xAmzDate)
+	]}`, expireFmt, bucket, path, sizeCondition, xAmzCredential, xAmzDate)
 	policy := base64.StdEncoding.EncodeToString([]byte(src))
 	return policy, signString(policy, region, xAmzDate, secret), xAmzCredential, xAmzDate + "T000000Z"
 }
 
+// PostPolicy creates a POST policy allowing another node to upload objects under the path, for the
+// given duration and up to maxSize bytes per object when maxSize is positive. The other node can
+// upload with a session created from the returned info with NewSession.
+func (ostore *S3OS) PostPolicy(path string, expire time.Duration, maxSize int64) *OSInfo {
+	key := ostore.keyPrefix + path
+	policy, signature, credential, xAmzDate := createPolicy(ostore.awsAccessKeyID,
+		ostore.bucket, ostore.region, ostore.awsSecretAccessKey, key, expire, maxSize)
+	return &OSInfo{
+		S3Info: &S3OSInfo{
+			Host:       ostore.host,
+			Bucket:     ostore.bucket,
+			Key:        key,
+			Policy:     policy,
+			Signature:  signature,
+			Credential: credential,
+			XAmzDate:   xAmzDate,
+		},
+		StorageType: OSInfo_S3,
+	}
+}
+
+// VerifyPostPolicy checks that the POST policy was signed with the credentials of the driver and
+// has not expired yet
+func (ostore *S3OS) VerifyPostPolicy(info *S3OSInfo) error {
+	date := strings.TrimSuffix(info.XAmzDate, "T000000Z")
+	signature := signString(info.Policy, ostore.region, date, ostore.awsSecretAccessKey)
+	if !hmac.Equal([]byte(signature), []byte(info.Signature)) {
+		return errors.New("invalid POST policy signature")
+	}
+	src, err := base64.StdEncoding.DecodeString(info.Policy)
+	if err != nil {
+		return fmt.Errorf("invalid POST policy: %w", err)
+	}
+	var policy struct {
+		Expiration time.Time `json:"expiration"`
+	}
+	if err = json.Unmarshal(src, &policy); err != nil {
+		return fmt.Errorf("invalid POST policy: %w", err)
+	}
+	if Now().After(policy.Expiration) {
+		return errors.New("POST policy expired")
+	}
+	return nil
+}
+
 func newfileUploadRequest(ctx context.Context, uri string, params map[string]string, fData io.Reader, fileName string, timeout time.Duration) (*http.Request, context.CancelFunc, error) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -600,16 +1633,13 @@ func newfileUploadRequest(ctx context.Context, uri string, params map[string]str
 	if err != nil {
 		return nil, nil, err
 	}
-	_, err = io.Copy(part, fData)
-
-	err = writer.Close()
-	if err != nil {
+	if _, err = io.Copy(part, fData); err != nil {
 		return nil, nil, err
 	}
-	if timeout == 0 {
-		timeout = defaultSaveTimeout
+	if err = writer.Close(); err != nil {
+		return nil, nil, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := withSaveTimeout(ctx, timeout, defaultSaveTimeout)
 	req, err := http.NewRequestWithContext(ctx, "POST", uri, body)
 	if err != nil {
 		cancel()
@@ -2,17 +2,32 @@ package drivers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -196,3 +211,1404 @@ func TestWasabiS3Upload(t *testing.T) {
 		t.Skip("No Wasabi S3 credentials, test skipped")
 	}
 }
+
+func TestS3UploaderConfig(t *testing.T) {
+	require := require.New(t)
+	drv, err := NewS3Driver("us-west-2", "example-bucket", "user", "secret", "", true)
+	require.NoError(err)
+	s3os := drv.(*S3OS)
+
+	respHeaders := http.Header{}
+	uploader := s3os.NewSession("").(*s3Session).newUploader(&respHeaders, 0)
+	require.Equal(int64(uploaderPartSize), uploader.PartSize)
+	require.Equal(uploaderConcurrency, uploader.Concurrency)
+
+	s3os.UploadPartSize = 8 * 1024 * 1024
+	s3os.UploadConcurrency = 2
+	uploader = s3os.NewSession("").(*s3Session).newUploader(&respHeaders, 0)
+	require.Equal(int64(8*1024*1024), uploader.PartSize)
+	require.Equal(2, uploader.Concurrency)
+}
+
+func TestS3EndpointOptions(t *testing.T) {
+	requestHost := func(sess *s3Session) string {
+		req, _ := sess.s3svc.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(sess.bucket), Key: aws.String("file.ts")})
+		require.NoError(t, req.Build())
+		return req.HTTPRequest.URL.Host
+	}
+	tests := []struct {
+		name         string
+		fips         bool
+		dualStack    bool
+		expectedHost string
+	}{
+		{name: "default", expectedHost: "example-bucket.s3.us-west-2.amazonaws.com"},
+		{name: "fips", fips: true, expectedHost: "example-bucket.s3-fips.us-west-2.amazonaws.com"},
+		{name: "dual-stack", dualStack: true, expectedHost: "example-bucket.s3.dualstack.us-west-2.amazonaws.com"},
+		{name: "fips dual-stack", fips: true, dualStack: true, expectedHost: "example-bucket.s3-fips.dualstack.us-west-2.amazonaws.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			drv, err := NewS3Driver("us-west-2", "example-bucket", "user", "secret", "", true)
+			require.NoError(err)
+			s3os := drv.(*S3OS)
+			s3os.UseFIPS = tt.fips
+			s3os.UseDualStack = tt.dualStack
+
+			sess := s3os.NewSession("").(*s3Session)
+			require.Equal(tt.expectedHost, requestHost(sess))
+			if tt.fips || tt.dualStack {
+				url, err := sess.PublicURL("file.ts")
+				require.NoError(err)
+				require.Equal("https://"+tt.expectedHost+"/file.ts", url)
+			}
+		})
+	}
+
+	// the custom endpoints are kept
+	drv, err := NewS3EndpointDriver("vpce-1.s3.us-west-2.vpce.amazonaws.com", "us-west-2", "example-bucket", "user", "secret", "", true, true)
+	require.NoError(t, err)
+	drv.(*S3OS).UseFIPS = true
+	require.Equal(t, "example-bucket.vpce-1.s3.us-west-2.vpce.amazonaws.com", requestHost(drv.NewSession("").(*s3Session)))
+}
+
+func TestS3SDKRetryer(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name             string
+		retryer          request.Retryer
+		disable          bool
+		expectedRetries  int
+		expectedRequests int
+	}{
+		{name: "default", expectedRetries: client.DefaultRetryerMaxNumRetries, expectedRequests: 4},
+		{name: "custom", retryer: client.DefaultRetryer{NumMaxRetries: 1, MinRetryDelay: time.Millisecond, MaxRetryDelay: time.Millisecond}, expectedRetries: 1, expectedRequests: 2},
+		{name: "disabled", retryer: client.DefaultRetryer{NumMaxRetries: 5}, disable: true, expectedRetries: 0, expectedRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+			require.NoError(err)
+			s3os := drv.(*S3OS)
+			s3os.SDKRetryer = tt.retryer
+			s3os.DisableSDKRetries = tt.disable
+
+			sess := s3os.NewSession("").(*s3Session)
+			require.Equal(tt.expectedRetries, sess.s3svc.Retryer.MaxRetries())
+			requests = 0
+			_, err = sess.ReadData(context.Background(), "file.ts")
+			require.Error(err)
+			require.Equal(tt.expectedRequests, requests)
+		})
+	}
+}
+
+func TestS3ThrottleRetries(t *testing.T) {
+	var requests int
+	var throttle func(w http.ResponseWriter)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			throttle(w)
+			return
+		}
+		_, _ = w.Write([]byte("segment"))
+	}))
+	defer srv.Close()
+	slowDown := func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+	}
+	tooManyRequests := func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	tests := []struct {
+		name     string
+		throttle func(w http.ResponseWriter)
+		minDelay time.Duration
+	}{
+		{name: "retry after", throttle: slowDown, minDelay: time.Second},
+		{name: "backoff", throttle: tooManyRequests, minDelay: s3ThrottleMinDelay / 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+			require.NoError(err)
+			requests, throttle = 0, tt.throttle
+			start := time.Now()
+			res, err := drv.NewSession("").ReadData(context.Background(), "1.ts")
+			require.NoError(err)
+			require.NoError(res.Body.Close())
+			require.Equal(2, requests)
+			require.GreaterOrEqual(time.Since(start), tt.minDelay)
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	require := require.New(t)
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	Now = func() time.Time { return now }
+	t.Cleanup(func() { Now = time.Now })
+
+	delay, ok := retryAfter("5")
+	require.True(ok)
+	require.Equal(5*time.Second, delay)
+	delay, ok = retryAfter(now.Add(3 * time.Second).Format(http.TimeFormat))
+	require.True(ok)
+	require.Equal(3*time.Second, delay)
+	delay, ok = retryAfter(now.Add(-time.Minute).Format(http.TimeFormat))
+	require.True(ok)
+	require.Zero(delay)
+	_, ok = retryAfter("")
+	require.False(ok)
+	_, ok = retryAfter("soon")
+	require.False(ok)
+}
+
+func TestS3RegionMismatch(t *testing.T) {
+	redirect := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusMovedPermanently)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>PermanentRedirect</Code>` +
+			`<Message>The bucket you are attempting to access must be addressed using the specified endpoint.</Message></Error>`))
+	}
+	wrongRegion := httptest.NewServer(http.HandlerFunc(redirect))
+	defer wrongRegion.Close()
+	bucketRegion := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/s3/")
+		http.ServeContent(w, r, "file.ts", time.Time{}, strings.NewReader("data"))
+	}))
+	defer bucketRegion.Close()
+
+	// drivers resolving the endpoint of eu-west-1, the region of the bucket, to the second stub
+	newDriver := func(follow bool) *S3OS {
+		drv, err := NewS3Driver("us-west-2", "example-bucket", "user", "secret", "", true)
+		require.NoError(t, err)
+		s3os := drv.(*S3OS)
+		s3os.FollowRegionRedirects = follow
+		s3os.s3sess.Config.S3ForcePathStyle = aws.Bool(true)
+		s3os.s3sess.Config.EndpointResolver = endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+			if region == "eu-west-1" {
+				return endpoints.ResolvedEndpoint{URL: bucketRegion.URL, SigningRegion: region}, nil
+			}
+			return endpoints.ResolvedEndpoint{URL: wrongRegion.URL, SigningRegion: region}, nil
+		})
+		s3os.s3svc = s3os.newService()
+		return s3os
+	}
+
+	_, err := newDriver(false).NewSession("").ReadData(context.Background(), "file.ts")
+	require.ErrorIs(t, err, ErrRegionMismatch)
+	require.EqualError(t, err, "the bucket is in another region: bucket example-bucket is in region eu-west-1, not us-west-2")
+	// HEAD responses have no body
+	require.ErrorIs(t, newDriver(false).HealthCheck(context.Background()), ErrRegionMismatch)
+
+	fi, err := newDriver(true).NewSession("").ReadData(context.Background(), "file.ts")
+	require.NoError(t, err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+
+	// lite mode
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(wrongRegion.URL, "http://"), "example-bucket", "user", "secret", "", false, false)
+	require.NoError(t, err)
+	_, err = drv.NewSession("").SaveData(context.Background(), "file.ts", strings.NewReader("data"), nil, 0)
+	require.ErrorIs(t, err, ErrRegionMismatch)
+}
+
+func TestS3Anonymous(t *testing.T) {
+	require := require.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a public bucket, rejecting the signed requests of other accounts
+		if r.Header.Get("Authorization") != "" || r.URL.Path != "/public-bucket/videos/file.ts" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "file.ts", time.Time{}, strings.NewReader("data"))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	_, err := ParseOSURL("s3+http://"+host+"/public-bucket/videos", false)
+	require.EqualError(err, "password is required with s3+http:// OS")
+	_, err = ParseOSURL("s3+http://user:secret@"+host+"/public-bucket/videos?anonymous=true", false)
+	require.ErrorContains(err, "credentials can't be given with the anonymous parameter")
+	_, err = ParseOSURL("s3+http://"+host+"/public-bucket/videos?anonymous=yes", false)
+	require.ErrorContains(err, `invalid anonymous parameter "yes"`)
+
+	drv, err := ParseOSURL("s3+http://"+host+"/public-bucket/videos?anonymous=true", false)
+	require.NoError(err)
+	sess := drv.NewSession("")
+	fi, err := sess.ReadData(context.Background(), "file.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("data", string(data))
+
+	_, err = sess.SaveData(context.Background(), "new.ts", strings.NewReader("data"), nil, 0)
+	require.ErrorIs(err, ErrNotSupported)
+	require.ErrorIs(sess.DeleteFile(context.Background(), "file.ts"), ErrNotSupported)
+	require.ErrorIs(sess.Rename(context.Background(), "file.ts", "new.ts"), ErrNotSupported)
+	_, _, err = sess.PresignUpload("new.ts", time.Hour, nil)
+	require.ErrorIs(err, ErrNotSupported)
+
+	uri, err := sess.ObjectURI("file.ts")
+	require.NoError(err)
+	require.Equal("s3+http://"+host+"/public-bucket/videos/file.ts?anonymous=true", uri)
+	drv, err = ParseOSURL(uri, true)
+	require.NoError(err)
+	fi, err = drv.NewSession("").ReadData(context.Background(), "")
+	require.NoError(err)
+	fi.Body.Close()
+}
+
+func TestS3ObjectLock(t *testing.T) {
+	require := require.New(t)
+	var puts []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/unlocked-bucket/"):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidRequest</Code>` +
+				`<Message>Bucket is missing Object Lock Configuration</Message></Error>`))
+		case r.Method == "PUT":
+			puts = append(puts, r.Header.Clone())
+			w.Header().Set("ETag", `"etag"`)
+		case r.Method == "HEAD" && r.URL.Path == "/locked-bucket/rec/1.ts":
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Header().Set("Content-Length", "7")
+			w.Header().Set("X-Amz-Object-Lock-Mode", "COMPLIANCE")
+			w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date", "2030-01-02T03:04:05Z")
+			w.Header().Set("X-Amz-Object-Lock-Legal-Hold", "ON")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	retainUntil := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	fields := &FileProperties{Retention: &ObjectRetention{Mode: RetentionCompliance, RetainUntil: retainUntil}}
+	drv, err := NewCustomS3Driver(host, "locked-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("rec")
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), fields, 0)
+	require.NoError(err)
+	require.Len(puts, 1)
+	require.Equal("COMPLIANCE", puts[0].Get("X-Amz-Object-Lock-Mode"))
+	require.Equal("2030-01-02T03:04:05Z", puts[0].Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	// S3 requires the MD5 of the locked objects
+	require.NotEmpty(puts[0].Get("Content-Md5"))
+
+	stat, err := sess.(Stater).Stat(context.Background(), "1.ts")
+	require.NoError(err)
+	require.Equal(&ObjectRetention{Mode: RetentionCompliance, RetainUntil: retainUntil}, stat.Retention)
+	require.True(stat.LegalHold)
+	require.Equal(int64(7), *stat.Size)
+	require.Equal("video/mp2t", stat.ContentType)
+	_, err = sess.(Stater).Stat(context.Background(), "2.ts")
+	require.ErrorIs(err, ErrNotExist)
+
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), &FileProperties{Retention: &ObjectRetention{Mode: "forever", RetainUntil: retainUntil}}, 0)
+	require.EqualError(err, `invalid retention mode "forever"`)
+
+	drv, err = NewCustomS3Driver(host, "unlocked-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	_, err = drv.NewSession("rec").SaveData(context.Background(), "1.ts", strings.NewReader("segment"), fields, 0)
+	require.ErrorIs(err, ErrObjectLockNotEnabled)
+
+	drv, err = NewCustomS3Driver(host, "locked-bucket", "user", "secret", "", false, false)
+	require.NoError(err)
+	_, err = drv.NewSession("rec").SaveData(context.Background(), "1.ts", strings.NewReader("segment"), fields, 0)
+	require.ErrorIs(err, ErrNotSupported)
+}
+
+func TestS3ReadDataRange(t *testing.T) {
+	require := require.New(t)
+	content := "0123456789"
+	ignoreRange := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/example-bucket/key/file.ts", r.URL.Path)
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "file.ts", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "key", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("")
+	read := func(byteRange string) (*FileInfoReader, string) {
+		fi, err := sess.ReadDataRange(context.Background(), "file.ts", byteRange)
+		require.NoError(err)
+		data, err := io.ReadAll(fi.Body)
+		require.NoError(err)
+		fi.Body.Close()
+		return fi, string(data)
+	}
+
+	// 206 partial content
+	fi, data := read("bytes=2-5")
+	require.Equal("2345", data)
+	require.Equal("bytes 2-5/10", fi.ContentRange)
+	require.Equal(int64(10), *fi.Size)
+	require.Equal(int64(4), fi.ContentLength)
+
+	// 200 when no range is requested
+	fi, data = read("")
+	require.Equal(content, data)
+	require.Equal("", fi.ContentRange)
+	require.Equal(int64(10), *fi.Size)
+	require.Equal(int64(10), fi.ContentLength)
+
+	// 200 when the range is ignored
+	ignoreRange = true
+	fi, data = read("bytes=2-5")
+	require.Equal(content, data)
+	require.Equal("", fi.ContentRange)
+	require.Equal(int64(10), *fi.Size)
+	require.Equal(int64(10), fi.ContentLength)
+}
+
+func TestS3ReadDataMultiRange(t *testing.T) {
+	require := require.New(t)
+	content := "0123456789"
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "file.mp4", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("")
+	readParts := func() []string {
+		res, err := sess.ReadDataRange(context.Background(), "file.mp4", "bytes=0-1,5-7")
+		require.NoError(err)
+		defer res.Body.Close()
+		parts, err := ByteRangeParts(res)
+		require.NoError(err)
+		var got []string
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return got
+			}
+			require.NoError(err)
+			data, err := io.ReadAll(part)
+			require.NoError(err)
+			got = append(got, part.Header.Get("Content-Range")+"="+string(data))
+		}
+	}
+	expected := []string{"bytes 0-1/10=01", "bytes 5-7/10=567"}
+
+	// AWS doesn't support multi-range requests, so the ranges are read one by one
+	require.Equal(expected, readParts())
+	require.Equal(2, requests)
+
+	requests = 0
+	drv.(*S3OS).MultiRangeReads = true
+	require.Equal(expected, readParts())
+	require.Equal(1, requests)
+
+	res, err := sess.ReadDataRange(context.Background(), "file.mp4", "bytes=0-1")
+	require.NoError(err)
+	_, err = ByteRangeParts(res)
+	require.ErrorContains(err, "not a multi-range response")
+}
+
+func TestS3PresignUpload(t *testing.T) {
+	require := require.New(t)
+	drv, err := NewS3Driver("us-west-2", "example-bucket", "user", "secret", "prefix/", true)
+	require.NoError(err)
+	sess := drv.NewSession("sess")
+
+	fields := &FileProperties{
+		CacheControl: "max-age=60",
+		Metadata:     map[string]string{"foo": "bar"},
+	}
+	presigned, headers, err := sess.PresignUpload("1.ts", time.Hour, fields)
+	require.NoError(err)
+	u, err := url.Parse(presigned)
+	require.NoError(err)
+	require.Equal("example-bucket.s3.us-west-2.amazonaws.com", u.Host)
+	require.Equal("/prefix/sess/1.ts", u.Path)
+	require.Equal("3600", u.Query().Get("X-Amz-Expires"))
+	require.Contains(u.Query().Get("X-Amz-SignedHeaders"), "content-type")
+	require.Equal("video/mp2t", headers.Get("Content-Type"))
+	require.Equal("max-age=60", headers.Get("Cache-Control"))
+	require.Equal("bar", headers.Get("X-Amz-Meta-Foo"))
+
+	_, _, err = NewMemoryDriver(nil).NewSession("").PresignUpload("1.ts", time.Hour, nil)
+	require.ErrorIs(err, ErrNotSupported)
+}
+
+func TestS3PresignClock(t *testing.T) {
+	require := require.New(t)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	Now = func() time.Time { return now }
+	t.Cleanup(func() { Now = time.Now })
+
+	drv, err := NewS3Driver("us-west-2", "example-bucket", "user", "secret", "", true)
+	require.NoError(err)
+	sess := drv.NewSession("")
+	presigned, err := sess.Presign("1.ts", time.Hour)
+	require.NoError(err)
+	u, err := url.Parse(presigned)
+	require.NoError(err)
+	require.Equal("20240102T030405Z", u.Query().Get("X-Amz-Date"))
+	require.Equal("3600", u.Query().Get("X-Amz-Expires"))
+	presigned, _, err = sess.PresignUpload("1.ts", time.Hour, nil)
+	require.NoError(err)
+	u, err = url.Parse(presigned)
+	require.NoError(err)
+	require.Equal("20240102T030405Z", u.Query().Get("X-Amz-Date"))
+
+	// the POST policy expires once the clock passes its expiration
+	owner := drv.(*S3OS)
+	info := owner.PostPolicy("sess", time.Hour, 0)
+	require.Equal("20240102T000000Z", info.S3Info.XAmzDate)
+	now = now.Add(59 * time.Minute)
+	require.NoError(owner.VerifyPostPolicy(info.S3Info))
+	now = now.Add(2 * time.Minute)
+	require.EqualError(owner.VerifyPostPolicy(info.S3Info), "POST policy expired")
+}
+
+func TestS3PostPolicyRoundTrip(t *testing.T) {
+	require := require.New(t)
+	var owner *S3OS
+	var uploaded []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/example-bucket", r.URL.Path)
+		require.NoError(r.ParseMultipartForm(1024 * 1024))
+		info := &S3OSInfo{
+			Policy:    r.FormValue("policy"),
+			Signature: r.FormValue("x-amz-signature"),
+			XAmzDate:  r.FormValue("x-amz-date"),
+		}
+		if err := owner.VerifyPostPolicy(info); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		src, err := base64.StdEncoding.DecodeString(info.Policy)
+		require.NoError(err)
+		require.Contains(string(src), `["starts-with", "$key", "prefix/sess"]`)
+		require.Contains(string(src), `["content-length-range", 0, 1024]`)
+		file, header, err := r.FormFile("file")
+		require.NoError(err)
+		data, _ := io.ReadAll(file)
+		uploaded = append(uploaded, strings.Replace(r.FormValue("key"), "${filename}", header.Filename, 1)+"="+string(data))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "prefix/", false, false)
+	require.NoError(err)
+	owner = drv.(*S3OS)
+	info := owner.PostPolicy("sess", time.Hour, 1024)
+	require.Equal("example-bucket", info.S3Info.Bucket)
+	require.Equal("prefix/sess", info.S3Info.Key)
+	require.NoError(owner.VerifyPostPolicy(info.S3Info))
+
+	sess := NewSession(info)
+	out, err := sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal(srv.URL+"/example-bucket/prefix/sess/1.ts", out.URL)
+	require.Equal([]string{"prefix/sess/1.ts=segment"}, uploaded)
+
+	tampered := *info.S3Info
+	tampered.Signature = strings.Repeat("0", len(tampered.Signature))
+	_, err = NewSession(&OSInfo{S3Info: &tampered, StorageType: OSInfo_S3}).SaveData(context.Background(), "2.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "invalid POST policy signature")
+
+	expired := owner.PostPolicy("sess", -time.Minute, 0)
+	require.EqualError(owner.VerifyPostPolicy(expired.S3Info), "POST policy expired")
+}
+
+func TestS3MaxBytes(t *testing.T) {
+	require := require.New(t)
+	var puts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		puts = append(puts, r.URL.Path+"="+string(body))
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("")
+	_, err = sess.SaveData(context.Background(), "big.ts", strings.NewReader("0123456789"), &FileProperties{MaxBytes: 5}, 0)
+	require.ErrorIs(err, ErrTooLarge)
+	require.Empty(puts)
+
+	_, err = sess.SaveData(context.Background(), "small.ts", strings.NewReader("01234"), &FileProperties{MaxBytes: 5}, 0)
+	require.NoError(err)
+	require.Equal([]string{"/example-bucket/small.ts=01234"}, puts)
+
+	// in lite mode the data beyond the peeked content type isn't posted either
+	puts = nil
+	lite, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", false, false)
+	require.NoError(err)
+	data := bytes.Repeat([]byte("x"), 20000)
+	_, err = lite.NewSession("").SaveData(context.Background(), "big.ts", bytes.NewReader(data), &FileProperties{MaxBytes: 10000}, 0)
+	require.ErrorIs(err, ErrTooLarge)
+	require.Empty(puts)
+}
+
+func TestS3ListFilesDelimiter(t *testing.T) {
+	require := require.New(t)
+	keys := []string{"rec/index.m3u8", "rec/hls/1.ts", "rec/hls/2.ts", "rec/mp4/video.mp4", "other/1.ts"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix, delim := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+		var contents, prefixes strings.Builder
+		seen := map[string]bool{}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(key, prefix)
+			if i := strings.Index(rest, delim); delim != "" && i != -1 {
+				common := prefix + rest[:i+1]
+				if !seen[common] {
+					seen[common] = true
+					fmt.Fprintf(&prefixes, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", common)
+				}
+				continue
+			}
+			fmt.Fprintf(&contents, `<Contents><Key>%s</Key><ETag>"etag"</ETag><Size>1</Size><LastModified>2023-01-01T00:00:00.000Z</LastModified></Contents>`, key)
+		}
+		fmt.Fprintf(w, `<ListBucketResult><Name>example-bucket</Name><IsTruncated>false</IsTruncated>%s%s</ListBucketResult>`,
+			contents.String(), prefixes.String())
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("")
+
+	pi, err := sess.ListFiles(context.Background(), "rec/", "/")
+	require.NoError(err)
+	require.Equal([]string{"rec/hls/", "rec/mp4/"}, pi.Directories())
+	require.Len(pi.Files(), 1)
+	require.Equal("rec/index.m3u8", pi.Files()[0].Name)
+	require.False(pi.HasNextPage())
+
+	pi, err = sess.ListFiles(context.Background(), "rec/", "")
+	require.NoError(err)
+	require.Empty(pi.Directories())
+	require.Len(pi.Files(), 4)
+}
+
+func TestS3ResumeUpload(t *testing.T) {
+	require := require.New(t)
+	parts := map[string]string{}
+	failPart := "2"
+	var completed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/example-bucket/rec/video.mp4", r.URL.Path)
+		q := r.URL.Query()
+		switch {
+		case r.Method == "POST" && q.Has("uploads"):
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == "PUT" && q.Get("uploadId") == "upload-1":
+			part := q.Get("partNumber")
+			if part == failPart {
+				failPart = ""
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `<Error><Code>BadDigest</Code></Error>`)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			parts[part] = string(body)
+			w.Header().Set("ETag", `"etag-`+part+`"`)
+		case r.Method == "POST" && q.Get("uploadId") == "upload-1":
+			body, _ := io.ReadAll(r.Body)
+			require.Contains(string(body), "etag-1")
+			require.Contains(string(body), "etag-3")
+			completed = parts["1"] + parts["2"] + parts["3"]
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><Key>rec/video.mp4</Key></CompleteMultipartUploadResult>`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	drv.(*S3OS).UploadPartSize = 5
+	sess := drv.NewSession("rec").(ResumableUploader)
+	content := "0123456789abcde"
+
+	_, state, err := sess.ResumeUpload(context.Background(), "video.mp4", strings.NewReader(content), nil)
+	require.Error(err)
+	require.Equal("upload-1", state.UploadID)
+	require.Equal([]S3UploadPart{{Number: 1, ETag: `"etag-1"`}}, state.Parts)
+
+	out, state, err := sess.ResumeUpload(context.Background(), "video.mp4", strings.NewReader(content), state)
+	require.NoError(err)
+	require.Nil(state)
+	require.Equal(content, completed)
+	require.Equal(srv.URL+"/example-bucket/rec/video.mp4", out.URL)
+}
+
+func TestS3ListPageSize(t *testing.T) {
+	require := require.New(t)
+	keys := []string{"rec/1.ts", "rec/2.ts", "rec/3.ts", "rec/4.ts", "rec/5.ts"}
+	var maxKeys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		maxKeys = append(maxKeys, query.Get("max-keys"))
+		limit := len(keys)
+		if query.Get("max-keys") != "" {
+			limit, _ = strconv.Atoi(query.Get("max-keys"))
+		}
+		var remaining []string
+		for _, key := range keys {
+			if key > query.Get("marker") {
+				remaining = append(remaining, key)
+			}
+		}
+		truncated := len(remaining) > limit
+		if truncated {
+			remaining = remaining[:limit]
+		}
+		var contents strings.Builder
+		for _, key := range remaining {
+			fmt.Fprintf(&contents, `<Contents><Key>%s</Key><ETag>"etag"</ETag><Size>1</Size><LastModified>2023-01-01T00:00:00.000Z</LastModified></Contents>`, key)
+		}
+		fmt.Fprintf(w, `<ListBucketResult><Name>example-bucket</Name><IsTruncated>%t</IsTruncated>%s</ListBucketResult>`, truncated, contents.String())
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	pi, err := drv.NewSession("").ListFiles(context.Background(), "rec/", "")
+	require.NoError(err)
+	require.Len(pi.Files(), 5)
+	require.False(pi.HasNextPage())
+	require.Equal([]string{""}, maxKeys)
+
+	maxKeys = nil
+	drv.(*S3OS).ListPageSize = 2
+	pi, err = drv.NewSession("").ListFiles(context.Background(), "rec/", "")
+	require.NoError(err)
+	var names []string
+	for {
+		require.LessOrEqual(len(pi.Files()), 2)
+		for _, f := range pi.Files() {
+			names = append(names, f.Name)
+		}
+		if !pi.HasNextPage() {
+			break
+		}
+		pi, err = pi.NextPage()
+		require.NoError(err)
+	}
+	require.Equal(keys, names)
+	require.Equal([]string{"2", "2", "2"}, maxKeys)
+}
+
+func TestS3ReadGzipEncoded(t *testing.T) {
+	require := require.New(t)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write([]byte(`{"sidecar":true}`))
+	require.NoError(err)
+	require.NoError(zw.Close())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	// by default the HTTP client decompresses the file transparently
+	info, data, err := readFully(context.Background(), drv.NewSession(""), "sidecar.json")
+	require.NoError(err)
+	require.Equal(`{"sidecar":true}`, string(data))
+	require.Empty(info.ContentEncoding)
+
+	drv.(*S3OS).DecompressGzip = true
+	info, data, err = readFully(context.Background(), drv.NewSession(""), "sidecar.json")
+	require.NoError(err)
+	require.Equal(`{"sidecar":true}`, string(data))
+	require.Empty(info.ContentEncoding)
+	require.Equal(int64(compressed.Len()), *info.Size)
+}
+
+func TestS3SaveCompressed(t *testing.T) {
+	require := require.New(t)
+	type object struct {
+		data     []byte
+		encoding string
+	}
+	objects := map[string]object{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			require.NoError(err)
+			objects[r.URL.Path] = object{data: data, encoding: r.Header.Get("Content-Encoding")}
+		case http.MethodGet:
+			obj, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if obj.encoding != "" {
+				w.Header().Set("Content-Encoding", obj.encoding)
+			}
+			w.Write(obj.data)
+		}
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("rec")
+	playlist := strings.Repeat("#EXTINF:2.000,\nsegment.ts\n", 100)
+	segment := bytes.Repeat([]byte{0x47}, 1000)
+	fields := &FileProperties{Compress: true}
+	out, err := sess.SaveData(context.Background(), "index.m3u8", strings.NewReader(playlist), fields, 0)
+	require.NoError(err)
+	_, err = sess.SaveData(context.Background(), "1.ts", bytes.NewReader(segment), fields, 0)
+	require.NoError(err)
+
+	stored := objects["/example-bucket/rec/index.m3u8"]
+	require.Equal("gzip", stored.encoding)
+	require.Less(len(stored.data), len(playlist))
+	checksum := sha256.Sum256([]byte(playlist))
+	require.Equal(hex.EncodeToString(checksum[:]), out.Checksum)
+	require.Empty(objects["/example-bucket/rec/1.ts"].encoding)
+	require.Equal(segment, objects["/example-bucket/rec/1.ts"].data)
+
+	drv.(*S3OS).DecompressGzip = true
+	_, data, err := readFully(context.Background(), sess, "index.m3u8")
+	require.NoError(err)
+	require.Equal(playlist, string(data))
+}
+
+func TestS3LiteMode(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	s3Drv, err := NewS3Driver("us-west-2", "example-bucket", "user", "secret", "prefix/", false)
+	require.NoError(err)
+	customDrv, err := NewCustomS3Driver("localhost:9000", "example-bucket", "user", "secret", "", false, false)
+	require.NoError(err)
+	for _, sess := range []OSSession{s3Drv.NewSession("sess"), customDrv.NewSession("sess"), newTestGsOS(t, "example-bucket").NewSession("sess")} {
+		_, err = sess.ListFiles(ctx, "", "")
+		require.ErrorIs(err, ErrNotSupported)
+		_, err = sess.ReadData(ctx, "1.ts")
+		require.ErrorIs(err, ErrNotSupported)
+		_, err = sess.ReadDataRange(ctx, "1.ts", "bytes=0-1")
+		require.ErrorIs(err, ErrNotSupported)
+		require.ErrorIs(sess.DeleteFile(ctx, "1.ts"), ErrNotSupported)
+		_, err = sess.Presign("1.ts", time.Minute)
+		require.ErrorIs(err, ErrNotSupported)
+		_, _, err = sess.PresignUpload("1.ts", time.Minute, nil)
+		require.ErrorIs(err, ErrNotSupported)
+	}
+	_, _, err = s3Drv.NewSession("sess").(ResumableUploader).ResumeUpload(ctx, "1.ts", strings.NewReader("data"), nil)
+	require.ErrorIs(err, ErrNotSupported)
+}
+
+func TestS3BucketOwnerAndRequestPayer(t *testing.T) {
+	require := require.New(t)
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method)
+		require.Equal("111122223333", r.Header.Get("X-Amz-Expected-Bucket-Owner"), r.Method)
+		require.Equal("requester", r.Header.Get("X-Amz-Request-Payer"), r.Method)
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Has("prefix") {
+				fmt.Fprint(w, `<ListBucketResult><Name>example-bucket</Name><IsTruncated>false</IsTruncated></ListBucketResult>`)
+				return
+			}
+			w.Write([]byte("data"))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	drv.(*S3OS).ExpectedBucketOwner = "111122223333"
+	drv.(*S3OS).RequestPayer = "requester"
+	sess := drv.NewSession("rec")
+	ctx := context.Background()
+	_, err = sess.SaveData(ctx, "1.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	_, _, err = readFully(ctx, sess, "1.ts")
+	require.NoError(err)
+	_, err = sess.ListFiles(ctx, "rec/", "")
+	require.NoError(err)
+	require.NoError(sess.DeleteFile(ctx, "1.ts"))
+	require.Equal([]string{http.MethodPut, http.MethodGet, http.MethodGet, http.MethodDelete}, requests)
+
+	url, err := sess.Presign("1.ts", time.Minute)
+	require.NoError(err)
+	require.Contains(url, "X-Amz-Expected-Bucket-Owner=111122223333")
+	require.NotContains(url, "x-amz-request-payer")
+}
+
+func TestS3RequesterPaysReads(t *testing.T) {
+	require := require.New(t)
+	payers := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("prefix") {
+			payers["list"] = r.Header.Get("X-Amz-Request-Payer")
+			fmt.Fprint(w, `<ListBucketResult><Name>example-bucket</Name><IsTruncated>false</IsTruncated></ListBucketResult>`)
+			return
+		}
+		payers[r.Header.Get("Range")] = r.Header.Get("X-Amz-Request-Payer")
+		http.ServeContent(w, r, "1.ts", time.Time{}, strings.NewReader("segment"))
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	read := func() {
+		sess := drv.NewSession("rec")
+		_, _, err := readFully(context.Background(), sess, "1.ts")
+		require.NoError(err)
+		res, err := sess.ReadDataRange(context.Background(), "1.ts", "bytes=0-1")
+		require.NoError(err)
+		res.Body.Close()
+		_, err = sess.ListFiles(context.Background(), "rec/", "")
+		require.NoError(err)
+	}
+
+	read()
+	require.Equal(map[string]string{"": "", "bytes=0-1": "", "list": ""}, payers)
+	drv.(*S3OS).RequestPayer = "requester"
+	read()
+	require.Equal(map[string]string{"": "requester", "bytes=0-1": "requester", "list": "requester"}, payers)
+}
+
+func TestS3HealthCheck(t *testing.T) {
+	require := require.New(t)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(http.MethodHead, r.Method)
+		require.Equal("/example-bucket", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	require.NoError(drv.HealthCheck(context.Background()))
+	status = http.StatusForbidden
+	require.ErrorIs(drv.HealthCheck(context.Background()), ErrUnauthorized)
+	status = http.StatusNotFound
+	require.ErrorIs(drv.HealthCheck(context.Background()), ErrNotExist)
+
+	srv.Close()
+	err = drv.HealthCheck(context.Background())
+	require.ErrorContains(err, "unreachable")
+	require.NotErrorIs(err, ErrUnauthorized)
+
+	lite, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", false, false)
+	require.NoError(err)
+	require.ErrorIs(lite.HealthCheck(context.Background()), ErrNotSupported)
+	require.ErrorIs(newTestGsOS(t, "example-bucket").HealthCheck(context.Background()), ErrNotSupported)
+}
+
+func TestS3NewCheckedSession(t *testing.T) {
+	require := require.New(t)
+	status := http.StatusForbidden
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(http.MethodHead, r.Method)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess, err := NewCheckedSession(context.Background(), drv, "rec")
+	require.ErrorIs(err, ErrUnauthorized)
+	require.ErrorContains(err, "example-bucket")
+	require.Nil(sess)
+
+	status = http.StatusOK
+	sess, err = NewCheckedSession(context.Background(), drv, "rec")
+	require.NoError(err)
+	require.NotNil(sess)
+
+	// lite mode can't check the bucket
+	srv.Close()
+	lite, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", false, false)
+	require.NoError(err)
+	sess, err = NewCheckedSession(context.Background(), lite, "rec")
+	require.NoError(err)
+	require.NotNil(sess)
+}
+
+func TestS3ReadDataConditional(t *testing.T) {
+	require := require.New(t)
+	modified := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ims, _ := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if r.Header.Get("If-None-Match") == `"v1"` || (!ims.IsZero() && !modified.After(ims)) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		w.Write([]byte("#EXTM3U\n"))
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("rec").(ConditionalReader)
+	ctx := context.Background()
+
+	res, err := sess.ReadDataConditional(ctx, "index.m3u8", "", time.Time{})
+	require.NoError(err)
+	data, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("#EXTM3U\n", string(data))
+	require.Equal(`"v1"`, res.ETag)
+	require.Equal(modified, res.LastModified)
+
+	_, err = sess.ReadDataConditional(ctx, "index.m3u8", res.ETag, time.Time{})
+	require.ErrorIs(err, ErrNotModified)
+	_, err = sess.ReadDataConditional(ctx, "index.m3u8", "", res.LastModified)
+	require.ErrorIs(err, ErrNotModified)
+
+	res, err = sess.ReadDataConditional(ctx, "index.m3u8", `"v0"`, modified.Add(-time.Hour))
+	require.NoError(err)
+	res.Body.Close()
+}
+
+func TestS3CancelledContext(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// hang until the client gives up or the test ends
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", false, false)
+	require.NoError(err)
+	fullAPI, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	postSess := NewSession(drv.(*S3OS).PostPolicy("sess", time.Hour, 1024))
+	sess := fullAPI.NewSession("sess")
+
+	ops := map[string]func(ctx context.Context) error{
+		"post": func(ctx context.Context) error {
+			_, err := postSess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+			return err
+		},
+		"put": func(ctx context.Context) error {
+			_, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+			return err
+		},
+		"read": func(ctx context.Context) error {
+			_, err := sess.ReadData(ctx, "1.ts")
+			return err
+		},
+		"list": func(ctx context.Context) error {
+			_, err := sess.ListFiles(ctx, "", "")
+			return err
+		},
+		"delete": func(ctx context.Context) error {
+			return sess.DeleteFile(ctx, "1.ts")
+		},
+	}
+	for name, op := range ops {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := op(ctx)
+		cancel()
+		require.Error(err, name)
+		require.Less(time.Since(start), 2*time.Second, name)
+	}
+}
+
+func TestS3Rename(t *testing.T) {
+	require := require.New(t)
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Amz-Copy-Source"))
+		if r.Header.Get("X-Amz-Copy-Source") == "example-bucket%2Fprefix%2Fsess%2Fmissing.ts" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		if r.Method == "PUT" {
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "prefix/", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("sess")
+
+	require.NoError(sess.Rename(context.Background(), "1.ts.tmp", "1.ts"))
+	require.Equal([]string{
+		"PUT /example-bucket/prefix/sess/1.ts example-bucket%2Fprefix%2Fsess%2F1.ts.tmp",
+		"DELETE /example-bucket/prefix/sess/1.ts.tmp ",
+	}, requests)
+	require.ErrorIs(sess.Rename(context.Background(), "missing.ts", "1.ts"), ErrNotExist)
+}
+
+func TestS3SaveExpiresAfter(t *testing.T) {
+	require := require.New(t)
+	headers := map[string]http.Header{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		headers[r.URL.Path] = r.Header
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("rec")
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), &FileProperties{ExpiresAfter: 30*24*time.Hour - time.Minute}, 0)
+	require.NoError(err)
+	_, err = sess.SaveData(context.Background(), "2.ts", strings.NewReader("segment"), &FileProperties{}, 0)
+	require.NoError(err)
+
+	header := headers["/example-bucket/rec/1.ts"]
+	require.Equal("expire-after-days=30", header.Get("X-Amz-Tagging"))
+	expires, err := http.ParseTime(header.Get("Expires"))
+	require.NoError(err)
+	require.WithinDuration(time.Now().Add(30*24*time.Hour), expires, time.Minute)
+	require.Empty(headers["/example-bucket/rec/2.ts"].Get("X-Amz-Tagging"))
+	require.Empty(headers["/example-bucket/rec/2.ts"].Get("Expires"))
+	require.Equal(1, expiryDays(time.Hour))
+	require.Equal(2, expiryDays(25*time.Hour))
+}
+
+func TestS3SaveHeaders(t *testing.T) {
+	require := require.New(t)
+	headers := map[string]http.Header{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		headers[r.URL.Path] = r.Header
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("rec")
+	fields := &FileProperties{Headers: map[string]string{
+		"content-disposition": `attachment; filename="video.mp4"`,
+		"Content-Language":    "en",
+		"X-Unknown":           "ignored",
+	}}
+	_, err = sess.SaveData(context.Background(), "1.mp4", strings.NewReader("video"), fields, 0)
+	require.NoError(err)
+	header := headers["/example-bucket/rec/1.mp4"]
+	require.Equal(`attachment; filename="video.mp4"`, header.Get("Content-Disposition"))
+	require.Equal("en", header.Get("Content-Language"))
+	require.Empty(header.Get("X-Unknown"))
+
+	fields.StrictHeaders = true
+	_, err = sess.SaveData(context.Background(), "2.mp4", strings.NewReader("video"), fields, 0)
+	require.ErrorIs(err, ErrNotSupported)
+	require.ErrorContains(err, "X-Unknown")
+	require.NotContains(headers, "/example-bucket/rec/2.mp4")
+
+	// the POST policy of lite mode doesn't allow headers
+	lite, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", false, false)
+	require.NoError(err)
+	fields = &FileProperties{Headers: map[string]string{"Content-Language": "en"}, StrictHeaders: true}
+	_, err = lite.NewSession("rec").SaveData(context.Background(), "3.mp4", strings.NewReader("video"), fields, 0)
+	require.ErrorIs(err, ErrNotSupported)
+}
+
+func TestS3SaveSizeHint(t *testing.T) {
+	require := require.New(t)
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		query := r.URL.Query()
+		switch {
+		case r.Method == "POST" && query.Has("uploads"):
+			requests = append(requests, "create")
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload-id</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == "PUT" && query.Has("partNumber"):
+			requests = append(requests, "part")
+			w.Header().Set("ETag", `"etag"`)
+		case r.Method == "POST" && query.Has("uploadId"):
+			requests = append(requests, "complete")
+			fmt.Fprint(w, `<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`)
+		default:
+			requests = append(requests, "put")
+		}
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	drv.(*S3OS).UploadPartSize = 8 * 1024 * 1024
+	sess := drv.NewSession("rec").(*s3Session)
+
+	// the part size follows the hint
+	require.Equal(int64(8*1024*1024), sess.uploadPartSize(0))
+	require.Equal(int64(s3manager.MinUploadPartSize), sess.uploadPartSize(1024))
+	require.Equal(int64(6*1024*1024+1), sess.uploadPartSize(6*1024*1024))
+	require.Equal(int64(8*1024*1024), sess.uploadPartSize(50*1024*1024*1024))
+	require.Equal(int64(1024*1024*1024*1024/s3manager.MaxUploadParts+1), sess.uploadPartSize(1024*1024*1024*1024))
+
+	data := make([]byte, 12*1024*1024)
+	_, err = sess.SaveData(context.Background(), "1.mp4", bytes.NewReader(data), &FileProperties{SizeHint: int64(len(data))}, 0)
+	require.NoError(err)
+	require.Equal([]string{"create", "part", "part", "complete"}, requests)
+
+	// a file smaller than the part size is saved with a single request
+	requests = nil
+	data = make([]byte, 6*1024*1024)
+	_, err = sess.SaveData(context.Background(), "2.mp4", bytes.NewReader(data), &FileProperties{SizeHint: int64(len(data))}, 0)
+	require.NoError(err)
+	require.Equal([]string{"put"}, requests)
+
+	// a file bigger than a wrong hint is still saved, in parts of the min size
+	requests = nil
+	_, err = sess.SaveData(context.Background(), "3.mp4", bytes.NewReader(data), &FileProperties{SizeHint: 1024}, 0)
+	require.NoError(err)
+	require.Equal([]string{"create", "part", "part", "complete"}, requests)
+}
+
+func TestS3EmptyFile(t *testing.T) {
+	require := require.New(t)
+	objects := map[string][]byte{}
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch r.Method {
+		case "PUT":
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case "GET":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("rec")
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader(""), &FileProperties{Compress: true}, 0)
+	require.NoError(err)
+	require.Equal([]string{"PUT"}, methods)
+	require.Contains(objects, "/example-bucket/rec/1.ts")
+
+	data, info, err := ReadFile(context.Background(), sess, "1.ts")
+	require.NoError(err)
+	require.Empty(data)
+	require.Equal(int64(0), *info.Size)
+}
+
+func TestS3KeyRewrites(t *testing.T) {
+	require := require.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("prefix") == "new/" {
+			fmt.Fprint(w, `<ListBucketResult><Name>example-bucket</Name><IsTruncated>false</IsTruncated>`+
+				`<Contents><Key>new/x.ts</Key><ETag>"etag"</ETag><Size>7</Size><LastModified>2023-01-01T00:00:00.000Z</LastModified></Contents>`+
+				`<CommonPrefixes><Prefix>new/hls/</Prefix></CommonPrefixes></ListBucketResult>`)
+			return
+		}
+		if r.URL.Path != "/example-bucket/new/x.ts" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Write([]byte("segment"))
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	drv.(*S3OS).KeyRewrites = []S3KeyRewrite{{OldPrefix: "old/", NewPrefix: "new/"}}
+	sess := drv.NewSession("")
+
+	data, info, err := ReadFile(context.Background(), sess, "old/x.ts")
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal("old/x.ts", info.Name)
+	res, err := sess.ReadDataRange(context.Background(), "old/x.ts", "bytes=0-2")
+	require.NoError(err)
+	res.Body.Close()
+
+	pi, err := sess.ListFiles(context.Background(), "old/", "/")
+	require.NoError(err)
+	require.Len(pi.Files(), 1)
+	require.Equal("old/x.ts", pi.Files()[0].Name)
+	require.Equal([]string{"old/hls/"}, pi.Directories())
+
+	// the keys not matching any rewrite are read as given
+	_, err = sess.ReadData(context.Background(), "other/x.ts")
+	require.ErrorIs(err, ErrNotExist)
+}
+
+// shardMapper stores the files under a prefix made of the first byte of the hash of their key
+type shardMapper struct{}
+
+func (shardMapper) ObjectKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:1]) + "/" + key
+}
+
+func (m shardMapper) FileKey(objectKey string) (string, bool) {
+	_, key, ok := strings.Cut(objectKey, "/")
+	if !ok || m.ObjectKey(key) != objectKey {
+		return "", false
+	}
+	return key, true
+}
+
+func TestS3KeyMapper(t *testing.T) {
+	require := require.New(t)
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/example-bucket/")
+		switch {
+		case r.URL.Query().Has("prefix"):
+			fmt.Fprint(w, `<ListBucketResult><Name>example-bucket</Name><IsTruncated>false</IsTruncated>`)
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, `<Contents><Key>%s</Key><ETag>"etag"</ETag><Size>%d</Size><LastModified>2023-01-01T00:00:00.000Z</LastModified></Contents>`, k, len(objects[k]))
+				}
+			}
+			fmt.Fprint(w, `</ListBucketResult>`)
+		case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+			src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+			objects[key] = objects[strings.TrimPrefix(src, "example-bucket/")]
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+		case r.Method == "PUT":
+			objects[key], _ = io.ReadAll(r.Body)
+		case r.Method == "DELETE":
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	drv.(*S3OS).KeyMapper = shardMapper{}
+	sess := drv.NewSession("rec")
+	objectKey := shardMapper{}.ObjectKey("rec/1.ts")
+
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal(map[string][]byte{objectKey: []byte("segment")}, objects)
+	data, info, err := ReadFile(context.Background(), sess, "1.ts")
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal("rec/1.ts", info.Name)
+	publicURL, err := sess.PublicURL("1.ts")
+	require.NoError(err)
+	require.Equal(srv.URL+"/example-bucket/"+objectKey, publicURL)
+
+	// the files are listed from the prefixes of the shards
+	shard, _, _ := strings.Cut(objectKey, "/")
+	pi, err := drv.NewSession("").ListFiles(context.Background(), shard+"/", "")
+	require.NoError(err)
+	require.Len(pi.Files(), 1)
+	require.Equal("rec/1.ts", pi.Files()[0].Name)
+
+	require.NoError(sess.Rename(context.Background(), "1.ts", "2.ts"))
+	require.Contains(objects, shardMapper{}.ObjectKey("rec/2.ts"))
+	require.NotContains(objects, objectKey)
+	require.NoError(sess.DeleteFile(context.Background(), "2.ts"))
+	require.Empty(objects)
+	_, err = sess.ReadData(context.Background(), "2.ts")
+	require.ErrorIs(err, ErrNotExist)
+}
+
+func TestS3KeyNormalization(t *testing.T) {
+	require := require.New(t)
+	var paths []string
+	var listed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Query().Has("prefix") {
+			listed = r.URL.Query().Get("prefix")
+			fmt.Fprint(w, `<ListBucketResult><Name>example-bucket</Name><IsTruncated>false</IsTruncated></ListBucketResult>`)
+			return
+		}
+		paths = append(paths, r.Method+" "+r.URL.Path)
+	}))
+	defer srv.Close()
+
+	drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(err)
+	sess := drv.NewSession("rec")
+	for _, name := range []string{"a//b", "a/b/", "/a/b"} {
+		_, err = sess.SaveData(context.Background(), name, strings.NewReader("data"), nil, 0)
+		require.NoError(err)
+		res, err := sess.ReadData(context.Background(), name)
+		require.NoError(err)
+		res.Body.Close()
+		url, err := sess.PublicURL(name)
+		require.NoError(err)
+		require.True(strings.HasSuffix(url, "/example-bucket/rec/a/b"), url)
+	}
+	require.Equal([]string{
+		"PUT /example-bucket/rec/a/b", "GET /example-bucket/rec/a/b",
+		"PUT /example-bucket/rec/a/b", "GET /example-bucket/rec/a/b",
+		"PUT /example-bucket/rec/a/b", "GET /example-bucket/rec/a/b",
+	}, paths)
+
+	// the trailing slash of a listed prefix limits the listing to the directory
+	_, err = sess.ListFiles(context.Background(), "a//", "/")
+	require.NoError(err)
+	require.Equal("rec/a/", listed)
+	_, err = sess.ListFiles(context.Background(), "/a", "/")
+	require.NoError(err)
+	require.Equal("rec/a", listed)
+
+	// the deleted keys are normalized like the saved ones, with or without a session key
+	paths = nil
+	require.NoError(sess.DeleteFile(context.Background(), "rec/a//b"))
+	require.NoError(drv.NewSession("").DeleteFile(context.Background(), "a//b"))
+	require.Equal([]string{"DELETE /example-bucket/rec/a/b", "DELETE /example-bucket/a/b"}, paths)
+}
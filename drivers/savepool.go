@@ -0,0 +1,72 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+)
+
+// FileToSave is a file saved by ParallelSaveFiles
+type FileToSave struct {
+	Name   string
+	Data   []byte
+	Fields *FileProperties
+}
+
+type saveResult struct {
+	index int
+	out   *SaveDataOutput
+	err   error
+}
+
+type saveTask struct {
+	sess  OSSession
+	file  FileToSave
+	index int
+}
+
+func saveWorker(ctx context.Context, tasks chan *saveTask, resCh chan *saveResult) {
+	for task := range tasks {
+		res := &saveResult{
+			index: task.index,
+		}
+		if err := ctx.Err(); err != nil {
+			res.err = err
+		} else {
+			res.out, res.err = task.sess.SaveData(ctx, task.file.Name, bytes.NewReader(task.file.Data), task.file.Fields, 0)
+		}
+		resCh <- res
+	}
+}
+
+// ParallelSaveFiles saves files in parallel, using specified number of jobs. Returned slices are
+// indexed the same as files: the output of each successful save and the error of each failed one.
+func ParallelSaveFiles(ctx context.Context, sess OSSession, files []FileToSave, workers int) ([]*SaveDataOutput, []error) {
+	workersToStart := workers
+	if len(files) < workers {
+		workersToStart = len(files)
+	}
+	if workersToStart < 1 {
+		workersToStart = 1
+	}
+	resCh := make(chan *saveResult, len(files))
+	tasks := make(chan *saveTask, len(files))
+	for i, file := range files {
+		tasks <- &saveTask{
+			sess:  sess,
+			file:  file,
+			index: i,
+		}
+	}
+	close(tasks)
+	for i := 0; i < workersToStart; i++ {
+		go saveWorker(ctx, tasks, resCh)
+	}
+	outs := make([]*SaveDataOutput, len(files))
+	errs := make([]error, len(files))
+	for i := 0; i < len(files); i++ {
+		res := <-resCh
+		outs[res.index] = res.out
+		errs[res.index] = res.err
+	}
+	return outs, errs
+}
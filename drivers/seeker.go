@@ -0,0 +1,105 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rangeReadSeeker reads a file of a session with ranged reads. The body of the last read is read
+// until the next seek to another offset, after which the rest of the file is requested from there.
+type rangeReadSeeker struct {
+	ctx    context.Context
+	sess   OSSession
+	name   string
+	size   int64
+	offset int64
+	// body is read at offset, nil after seeking
+	body io.ReadCloser
+}
+
+// newRangeReadSeeker opens the file for random access with the ReadDataRange of the session. The
+// whole file is requested first, for sequential reads to only need a single request.
+func newRangeReadSeeker(ctx context.Context, sess OSSession, name string) (io.ReadSeekCloser, int64, error) {
+	res, err := sess.ReadDataRange(ctx, name, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.Size == nil {
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("unknown size of file %s", name)
+	}
+	return &rangeReadSeeker{ctx: ctx, sess: sess, name: name, size: *res.Size, body: res.Body}, *res.Size, nil
+}
+
+func (rs *rangeReadSeeker) Read(p []byte) (int, error) {
+	if rs.offset >= rs.size {
+		return 0, io.EOF
+	}
+	if rs.body == nil {
+		res, err := rs.sess.ReadDataRange(rs.ctx, rs.name, fmt.Sprintf("bytes=%d-", rs.offset))
+		if err != nil {
+			return 0, err
+		}
+		rs.body = res.Body
+		// the whole file is returned when the range is ignored
+		if res.ContentRange == "" {
+			if _, err := io.CopyN(io.Discard, rs.body, rs.offset); err != nil {
+				rs.closeBody()
+				return 0, err
+			}
+		}
+	}
+	n, err := rs.body.Read(p)
+	rs.offset += int64(n)
+	if err == io.EOF && rs.offset < rs.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (rs *rangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rs.offset
+	case io.SeekEnd:
+		offset += rs.size
+	case io.SeekStart:
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != rs.offset {
+		rs.closeBody()
+		rs.offset = offset
+	}
+	return offset, nil
+}
+
+func (rs *rangeReadSeeker) Close() error {
+	if rs.body == nil {
+		return nil
+	}
+	err := rs.body.Close()
+	rs.body = nil
+	return err
+}
+
+func (rs *rangeReadSeeker) closeBody() {
+	if rs.body != nil {
+		rs.body.Close()
+		rs.body = nil
+	}
+}
+
+// nopReadSeekCloser is a ReadSeeker with nothing to close
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error {
+	return nil
+}
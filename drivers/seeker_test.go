@@ -0,0 +1,97 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSeeker(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	var ranges []string
+	ignoreRange := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "file.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	s3drv, err := NewCustomS3Driver(strings.TrimPrefix(srv.URL, "http://"), "example-bucket", "user", "secret", "", true, false)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	fsSess := NewFSDriver(&url.URL{Path: dir}).NewSession("")
+	_, err = fsSess.SaveData(context.Background(), "file.mp4", bytes.NewReader(content), nil, 0)
+	require.NoError(t, err)
+
+	read := func(rs io.Reader, n int) string {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(rs, buf)
+		require.NoError(t, err)
+		return string(buf)
+	}
+	seek := func(rs io.Seeker, offset int64, whence int, expected int64) {
+		pos, err := rs.Seek(offset, whence)
+		require.NoError(t, err)
+		require.Equal(t, expected, pos)
+	}
+	check := func(sess OSSession, name string) {
+		rs, size, err := sess.ReadSeeker(context.Background(), name)
+		require.NoError(t, err)
+		defer rs.Close()
+		require.Equal(t, int64(len(content)), size)
+
+		require.Equal(t, "0123", read(rs, 4))
+		// forward
+		seek(rs, 6, io.SeekCurrent, 10)
+		require.Equal(t, "abc", read(rs, 3))
+		// backward
+		seek(rs, 2, io.SeekStart, 2)
+		require.Equal(t, "234", read(rs, 3))
+		seek(rs, -4, io.SeekEnd, 16)
+		data, err := io.ReadAll(rs)
+		require.NoError(t, err)
+		require.Equal(t, "ghij", string(data))
+		n, err := rs.Read(make([]byte, 1))
+		require.Equal(t, 0, n)
+		require.Equal(t, io.EOF, err)
+		_, err = rs.Seek(-1, io.SeekStart)
+		require.Error(t, err)
+	}
+
+	t.Run("fs", func(t *testing.T) {
+		check(fsSess, "file.mp4")
+	})
+	t.Run("fs with metrics", func(t *testing.T) {
+		oldMetrics := Metrics
+		Metrics = &testMetricsRecorder{}
+		defer func() {
+			Metrics = oldMetrics
+		}()
+		check(fsSess, "file.mp4")
+	})
+	t.Run("s3", func(t *testing.T) {
+		ranges = nil
+		check(s3drv.NewSession(""), "file.mp4")
+		// the whole file is requested first, then the rest from each offset read after a seek
+		require.Equal(t, []string{"", "bytes=10-", "bytes=2-", "bytes=16-"}, ranges)
+	})
+	t.Run("s3 ignoring ranges", func(t *testing.T) {
+		ignoreRange = true
+		check(s3drv.NewSession(""), "file.mp4")
+	})
+	t.Run("not found", func(t *testing.T) {
+		_, _, err := fsSess.ReadSeeker(context.Background(), "missing.mp4")
+		require.ErrorIs(t, err, ErrNotExist)
+	})
+}
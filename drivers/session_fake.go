@@ -0,0 +1,299 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeOSSession is an in-memory OSSession for the tests of the code using the drivers. Unlike
+// MockOSSession it needs no expectations: the saved files can be read, listed, renamed and deleted
+// like with a real storage. Failures are simulated with FailOn.
+type FakeOSSession struct {
+	files    map[string]*fakeFile
+	failures map[string]error
+	lock     sync.RWMutex
+}
+
+type fakeFile struct {
+	data         []byte
+	contentType  string
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+var _ OSSession = (*FakeOSSession)(nil)
+
+func NewFakeOSSession() *FakeOSSession {
+	return &FakeOSSession{
+		files:    map[string]*fakeFile{},
+		failures: map[string]error{},
+	}
+}
+
+// FailOn makes all the operations on the file with the given name fail with err. A nil err removes
+// the failure.
+func (s *FakeOSSession) FailOn(name string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		delete(s.failures, name)
+	} else {
+		s.failures[name] = err
+	}
+}
+
+// Files returns a copy of the data of all the saved files by name
+func (s *FakeOSSession) Files() map[string][]byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	files := make(map[string][]byte, len(s.files))
+	for name, f := range s.files {
+		files[name] = append([]byte(nil), f.data...)
+	}
+	return files
+}
+
+// OS returns nil, the fake session doesn't belong to any driver
+func (s *FakeOSSession) OS() OSDriver {
+	return nil
+}
+
+func (s *FakeOSSession) EndSession() {
+	// no op
+}
+
+func (s *FakeOSSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	if err := s.check(ctx, name); err != nil {
+		return nil, err
+	}
+	data, _ = withMaxBytes(data, fields)
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	file := &fakeFile{data: buf, lastModified: Now()}
+	if fields != nil {
+		file.contentType = fields.ContentType
+		file.metadata = fields.Metadata
+	}
+	s.lock.Lock()
+	s.files[name] = file
+	s.lock.Unlock()
+	checksum := sha256.Sum256(buf)
+	return &SaveDataOutput{
+		URL:               fakeURL(name),
+		Checksum:          hex.EncodeToString(checksum[:]),
+		ChecksumAlgorithm: ChecksumAlgorithmSHA256,
+	}, nil
+}
+
+func (s *FakeOSSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return s.ReadDataRange(ctx, name, "")
+}
+
+func (s *FakeOSSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	if err := s.check(ctx, name); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	file, ok := s.files[name]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, ErrNotExist
+	}
+	size := int64(len(file.data))
+	res := &FileInfoReader{
+		FileInfo:    file.info(name),
+		Metadata:    file.metadata,
+		ContentType: file.contentType,
+	}
+	data := file.data
+	if byteRange != "" {
+		start, end, err := parseByteRange(byteRange, size)
+		if err != nil {
+			return nil, err
+		}
+		data = data[start : end+1]
+		res.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	}
+	res.ContentLength = int64(len(data))
+	res.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return res, nil
+}
+
+// ListFiles lists the files with names starting with the prefix. With the "/" delimiter, the names
+// containing a "/" after the prefix are returned as directories.
+func (s *FakeOSSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	if err := s.check(ctx, prefix); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	pi := &singlePageInfo{files: []FileInfo{}, directories: []string{}}
+	dirs := map[string]bool{}
+	for name, file := range s.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], delim); delim != "" && i >= 0 {
+			dir := name[:len(prefix)+i+len(delim)]
+			if !dirs[dir] {
+				dirs[dir] = true
+				pi.directories = append(pi.directories, dir)
+			}
+			continue
+		}
+		pi.files = append(pi.files, file.info(name))
+	}
+	sort.Slice(pi.files, func(i, j int) bool { return pi.files[i].Name < pi.files[j].Name })
+	sort.Strings(pi.directories)
+	return pi, nil
+}
+
+func (s *FakeOSSession) DeleteFile(ctx context.Context, name string) error {
+	if err := s.check(ctx, name); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return ErrNotExist
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *FakeOSSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return listedPrefixSize(ctx, s, prefix)
+}
+
+func (s *FakeOSSession) Rename(ctx context.Context, oldName, newName string) error {
+	if err := s.check(ctx, oldName); err != nil {
+		return err
+	}
+	if err := s.check(ctx, newName); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, ok := s.files[oldName]
+	if !ok {
+		return ErrNotExist
+	}
+	delete(s.files, oldName)
+	s.files[newName] = file
+	return nil
+}
+
+func (s *FakeOSSession) Presign(name string, expire time.Duration) (string, error) {
+	return fakeURL(name), s.check(context.Background(), name)
+}
+
+func (s *FakeOSSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return fakeURL(name), http.Header{}, s.check(context.Background(), name)
+}
+
+func (s *FakeOSSession) PublicURL(name string) (string, error) {
+	return fakeURL(name), nil
+}
+
+func (s *FakeOSSession) ObjectURI(name string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (s *FakeOSSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return newRangeReadSeeker(ctx, s, name)
+}
+
+func (s *FakeOSSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, s, name, srcPath, fields)
+}
+
+func (s *FakeOSSession) IsExternal() bool {
+	return false
+}
+
+func (s *FakeOSSession) IsOwn(url string) bool {
+	return strings.HasPrefix(url, fakeURL(""))
+}
+
+func (s *FakeOSSession) GetInfo() *OSInfo {
+	return nil
+}
+
+// check returns the failure injected for the name, or the error of the context
+func (s *FakeOSSession) check(ctx context.Context, name string) error {
+	s.lock.RLock()
+	err := s.failures[name]
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (f *fakeFile) info(name string) FileInfo {
+	size := int64(len(f.data))
+	checksum := sha256.Sum256(f.data)
+	return FileInfo{
+		Name:         name,
+		ETag:         hex.EncodeToString(checksum[:]),
+		LastModified: f.lastModified,
+		Size:         &size,
+	}
+}
+
+func fakeURL(name string) string {
+	return "fake://" + name
+}
+
+// parseByteRange parses a single range of an HTTP Range header, like "bytes=0-99", "bytes=100-" or
+// "bytes=-100", into the offsets of the first and last bytes of the file of the given size
+func parseByteRange(byteRange string, size int64) (int64, int64, error) {
+	ok := strings.HasPrefix(byteRange, "bytes=")
+	spec := strings.TrimPrefix(byteRange, "bytes=")
+	from, to, found := strings.Cut(spec, "-")
+	if !ok || !found || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	var start, end int64
+	var err error
+	if from == "" {
+		var n int64
+		if n, err = strconv.ParseInt(to, 10, 64); err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	} else {
+		if start, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+		}
+		end = size - 1
+		if to != "" {
+			if end, err = strconv.ParseInt(to, 10, 64); err != nil || end < start {
+				return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+	if start >= size {
+		return 0, 0, fmt.Errorf("byte range %q not satisfiable for size %d", byteRange, size)
+	}
+	return start, end, nil
+}
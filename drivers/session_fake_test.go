@@ -0,0 +1,93 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeOSSession(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	sess := NewFakeOSSession()
+
+	out, err := sess.SaveData(ctx, "rec/1.ts", strings.NewReader("segment"), &FileProperties{ContentType: "video/mp2t"}, 0)
+	require.NoError(err)
+	require.Equal("fake://rec/1.ts", out.URL)
+	require.NotEmpty(out.Checksum)
+	_, err = sess.SaveData(ctx, "rec/hls/index.m3u8", strings.NewReader("#EXTM3U"), nil, 0)
+	require.NoError(err)
+	_, err = sess.SaveData(ctx, "big.ts", strings.NewReader("segment"), &FileProperties{MaxBytes: 3}, 0)
+	require.ErrorIs(err, ErrTooLarge)
+
+	data, info, err := ReadFile(ctx, sess, "rec/1.ts")
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal(int64(7), *info.Size)
+
+	res, err := sess.ReadDataRange(ctx, "rec/1.ts", "bytes=1-3")
+	require.NoError(err)
+	data, err = io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("egm", string(data))
+	require.Equal("bytes 1-3/7", res.ContentRange)
+	require.Equal("video/mp2t", res.ContentType)
+
+	pi, err := sess.ListFiles(ctx, "rec/", "/")
+	require.NoError(err)
+	require.Len(pi.Files(), 1)
+	require.Equal("rec/1.ts", pi.Files()[0].Name)
+	require.Equal([]string{"rec/hls/"}, pi.Directories())
+
+	require.NoError(sess.Rename(ctx, "rec/1.ts", "rec/2.ts"))
+	require.NoError(sess.DeleteFile(ctx, "rec/hls/index.m3u8"))
+	require.ErrorIs(sess.DeleteFile(ctx, "rec/hls/index.m3u8"), ErrNotExist)
+	_, err = sess.ReadData(ctx, "rec/1.ts")
+	require.ErrorIs(err, ErrNotExist)
+	require.Equal(map[string][]byte{"rec/2.ts": []byte("segment")}, sess.Files())
+}
+
+func TestFakeOSSessionFailOn(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	sess := NewFakeOSSession()
+	errFail := errors.New("injected failure")
+	sess.FailOn("fail.ts", errFail)
+
+	_, err := sess.SaveData(ctx, "fail.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorIs(err, errFail)
+	_, err = sess.SaveData(ctx, "ok.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.ErrorIs(sess.Rename(ctx, "ok.ts", "fail.ts"), errFail)
+
+	sess.FailOn("fail.ts", nil)
+	_, err = sess.SaveData(ctx, "fail.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = sess.ReadData(cancelled, "ok.ts")
+	require.ErrorIs(err, context.Canceled)
+}
+
+func TestParseByteRange(t *testing.T) {
+	require := require.New(t)
+	for byteRange, expected := range map[string][2]int64{
+		"bytes=0-99":   {0, 99},
+		"bytes=10-":    {10, 99},
+		"bytes=-10":    {90, 99},
+		"bytes=50-500": {50, 99},
+	} {
+		start, end, err := parseByteRange(byteRange, 100)
+		require.NoError(err, byteRange)
+		require.Equal(expected, [2]int64{start, end}, byteRange)
+	}
+	for _, byteRange := range []string{"0-99", "bytes=5-1", "bytes=100-", "bytes=0-1,5-6", "bytes=a-b"} {
+		_, _, err := parseByteRange(byteRange, 100)
+		require.Error(err, byteRange)
+	}
+}
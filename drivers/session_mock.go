@@ -3,6 +3,7 @@ package drivers
 import (
 	"context"
 	"io"
+	"net/http"
 	"time"
 
 	"github.com/stretchr/testify/mock"
@@ -13,6 +14,14 @@ type MockOSSession struct {
 	waitForCh bool
 	waitCh    chan struct{}
 	back      chan struct{}
+
+	// Delay makes SaveData and ReadData wait before returning the mocked results, or fail with the
+	// error of the context if it is done first
+	Delay time.Duration
+	// ChunkSize makes the body returned by ReadData read at most this many bytes at once, waiting
+	// ChunkDelay before each read. Reads fail with the error of the ReadData context once it is done.
+	ChunkSize  int
+	ChunkDelay time.Duration
 }
 
 func NewMockOSSession() *MockOSSession {
@@ -29,9 +38,25 @@ func (s *MockOSSession) SaveData(ctx context.Context, name string, data io.Reade
 		<-s.waitCh
 		s.waitForCh = false
 	}
+	if err := s.delay(ctx); err != nil {
+		return nil, err
+	}
 	return &SaveDataOutput{URL: args.String(0)}, args.Error(1)
 }
 
+// delay waits for Delay or until the context is done
+func (s *MockOSSession) delay(ctx context.Context) error {
+	if s.Delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.Delay):
+		return nil
+	}
+}
+
 func (s *MockOSSession) EndSession() {
 	s.Called()
 }
@@ -62,14 +87,52 @@ func (s *MockOSSession) DeleteFile(ctx context.Context, name string) error {
 	return nil
 }
 
+func (s *MockOSSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return 0, nil
+}
+
+func (s *MockOSSession) Rename(ctx context.Context, oldName, newName string) error {
+	return nil
+}
+
 func (s *MockOSSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
 	args := s.Called(ctx, name)
 	var fi *FileInfoReader
 	if args.Get(0) != nil {
 		fi = args.Get(0).(*FileInfoReader)
 	}
+	if err := s.delay(ctx); err != nil {
+		return nil, err
+	}
+	if fi != nil && fi.Body != nil && s.ChunkSize > 0 {
+		fi.Body = &chunkedBody{ReadCloser: fi.Body, ctx: ctx, size: s.ChunkSize, gap: s.ChunkDelay}
+	}
 	return fi, args.Error(1)
 }
+
+// chunkedBody simulates a slow download, reading the body in small chunks with a gap before each
+type chunkedBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	size int
+	gap  time.Duration
+}
+
+func (cb *chunkedBody) Read(p []byte) (int, error) {
+	if cb.gap > 0 {
+		select {
+		case <-cb.ctx.Done():
+			return 0, cb.ctx.Err()
+		case <-time.After(cb.gap):
+		}
+	} else if err := cb.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > cb.size {
+		p = p[:cb.size]
+	}
+	return cb.ReadCloser.Read(p)
+}
 func (s *MockOSSession) OS() OSDriver {
 	return nil
 }
@@ -78,6 +141,26 @@ func (s *MockOSSession) Presign(name string, expire time.Duration) (string, erro
 	return "", ErrNotSupported
 }
 
+func (s *MockOSSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (s *MockOSSession) PublicURL(name string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (s *MockOSSession) ObjectURI(name string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (s *MockOSSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+func (s *MockOSSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, s, name, srcPath, fields)
+}
+
 func (s *MockOSSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
 	return nil, ErrNotSupported
 }
@@ -0,0 +1,60 @@
+package drivers
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockOSSessionDelay(t *testing.T) {
+	require := require.New(t)
+	mos := NewMockOSSession()
+	mos.Delay = 100 * time.Millisecond
+	mos.On("SaveData", "1.ts", mock.Anything, mock.Anything, mock.Anything).Return("s3://1.ts", nil)
+
+	start := time.Now()
+	out, err := mos.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal("s3://1.ts", out.URL)
+	require.GreaterOrEqual(time.Since(start), 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = mos.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func TestMockOSSessionChunkedRead(t *testing.T) {
+	require := require.New(t)
+	mos := NewMockOSSession()
+	mos.ChunkSize = 2
+	mos.ChunkDelay = 20 * time.Millisecond
+	newBody := func() *FileInfoReader {
+		return &FileInfoReader{Body: io.NopCloser(strings.NewReader("segment"))}
+	}
+	mos.On("ReadData", mock.Anything, "1.ts").Return(newBody(), nil).Once()
+	mos.On("ReadData", mock.Anything, "1.ts").Return(newBody(), nil).Once()
+
+	res, err := mos.ReadData(context.Background(), "1.ts")
+	require.NoError(err)
+	buf := make([]byte, 100)
+	n, err := res.Body.Read(buf)
+	require.NoError(err)
+	require.Equal("se", string(buf[:n]))
+	rest, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("gment", string(rest))
+
+	// the deadline expires in the middle of the download
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	res, err = mos.ReadData(ctx, "1.ts")
+	require.NoError(err)
+	_, err = io.ReadAll(res.Body)
+	require.ErrorIs(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,120 @@
+package drivers
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rateLimitedReader limits the throughput of the reader with a token bucket holding up to one
+// second worth of bytes, so a transfer can't burst above the rate for longer than that
+type rateLimitedReader struct {
+	io.Reader
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > rl.rate {
+		p = p[:rl.rate]
+	}
+	n, err := rl.Reader.Read(p)
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+	if rl.tokens > float64(rl.rate) {
+		rl.tokens = float64(rl.rate)
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	if rl.tokens < 0 {
+		time.Sleep(time.Duration(-rl.tokens / float64(rl.rate) * float64(time.Second)))
+	}
+	return n, err
+}
+
+// withRateLimit limits the reading of the data to bytesPerSecond. Zero or negative means no limit.
+func withRateLimit(data io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return data
+	}
+	return &rateLimitedReader{
+		Reader: data,
+		rate:   bytesPerSecond,
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// saveRateLimit returns the FileProperties.MaxBytesPerSecond limit of SaveData
+func saveRateLimit(fields *FileProperties) int64 {
+	if fields == nil {
+		return 0
+	}
+	return fields.MaxBytesPerSecond
+}
+
+// rateLimitedReadCloser limits the throughput of a file body returned by ReadData
+type rateLimitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ThrottledSession limits the bandwidth used by SaveData and ReadData of the wrapped session. The
+// optional interfaces of the wrapped session, like ResumableUploader, are not exposed.
+type ThrottledSession struct {
+	OSSession
+	// SaveBytesPerSecond limits the uploads, unless overridden by FileProperties.MaxBytesPerSecond.
+	// Zero means no limit.
+	SaveBytesPerSecond int64
+	// ReadBytesPerSecond limits the reading of the file bodies returned by ReadData and
+	// ReadDataRange. Zero means no limit.
+	ReadBytesPerSecond int64
+}
+
+var _ OSSession = (*ThrottledSession)(nil)
+
+// NewThrottledSession wraps the session to limit the bandwidth of its uploads and downloads, in
+// bytes per second. Zero means no limit.
+func NewThrottledSession(sess OSSession, saveBytesPerSecond, readBytesPerSecond int64) *ThrottledSession {
+	return &ThrottledSession{
+		OSSession:          sess,
+		SaveBytesPerSecond: saveBytesPerSecond,
+		ReadBytesPerSecond: readBytesPerSecond,
+	}
+}
+
+func (ts *ThrottledSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	if ts.SaveBytesPerSecond > 0 && saveRateLimit(fields) == 0 {
+		limited := FileProperties{}
+		if fields != nil {
+			limited = *fields
+		}
+		limited.MaxBytesPerSecond = ts.SaveBytesPerSecond
+		fields = &limited
+	}
+	return ts.OSSession.SaveData(ctx, name, data, fields, timeout)
+}
+
+func (ts *ThrottledSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, ts, name, srcPath, fields)
+}
+
+func (ts *ThrottledSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return ts.throttleRead(ts.OSSession.ReadData(ctx, name))
+}
+
+func (ts *ThrottledSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	return ts.throttleRead(ts.OSSession.ReadDataRange(ctx, name, byteRange))
+}
+
+func (ts *ThrottledSession) throttleRead(res *FileInfoReader, err error) (*FileInfoReader, error) {
+	if err != nil || res == nil || res.Body == nil || ts.ReadBytesPerSecond <= 0 {
+		return res, err
+	}
+	res.Body = &rateLimitedReadCloser{
+		Reader: withRateLimit(res.Body, ts.ReadBytesPerSecond),
+		Closer: res.Body,
+	}
+	return res, nil
+}
@@ -0,0 +1,56 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottledSession(t *testing.T) {
+	require := require.New(t)
+	const rate = 100 * 1024
+	data := make([]byte, rate*3/2)
+	sess := NewThrottledSession(NewFSDriver(&url.URL{Path: t.TempDir()}).NewSession(""), rate, rate)
+
+	// the first second worth of bytes is the allowed burst, the rest is throttled
+	start := time.Now()
+	_, err := sess.SaveData(context.Background(), "1.ts", bytes.NewReader(data), nil, 0)
+	require.NoError(err)
+	require.GreaterOrEqual(time.Since(start), 450*time.Millisecond)
+
+	start = time.Now()
+	res, err := sess.ReadData(context.Background(), "1.ts")
+	require.NoError(err)
+	read, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.NoError(res.Body.Close())
+	require.Equal(data, read)
+	require.GreaterOrEqual(time.Since(start), 450*time.Millisecond)
+
+	// the per call limit overrides the session one
+	start = time.Now()
+	_, err = sess.SaveData(context.Background(), "2.ts", bytes.NewReader(data), &FileProperties{MaxBytesPerSecond: 10 * rate}, 0)
+	require.NoError(err)
+	require.Less(time.Since(start), 400*time.Millisecond)
+}
+
+func TestWithRateLimit(t *testing.T) {
+	require := require.New(t)
+	const rate = 50 * 1024
+	data := make([]byte, rate*2)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, withRateLimit(bytes.NewReader(data), rate))
+	require.NoError(err)
+	require.Equal(int64(len(data)), n)
+	elapsed := time.Since(start)
+	// one second of burst, one more second throttled
+	require.GreaterOrEqual(elapsed, 950*time.Millisecond)
+	require.Less(float64(n)/elapsed.Seconds(), 2.1*rate)
+
+	require.Equal(bytes.NewReader(data), withRateLimit(bytes.NewReader(data), 0))
+}
@@ -0,0 +1,48 @@
+package drivers
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	storageClient     = http.DefaultClient
+	storageClientLock sync.RWMutex
+)
+
+// SetDialTimeouts limits the time to connect to the storage services, and the time of the TLS
+// handshake, separately from the timeout of the whole operation, so that an endpoint which is down
+// is detected in seconds. Zero keeps the defaults of the net/http default transport, 30s and 10s.
+//
+// It applies to the S3 and B2 drivers created afterwards, and to the requests of all the S3 lite
+// mode, IPFS gateway, Arweave and direct sessions. The GS and Pinata API clients keep their own
+// transports.
+func SetDialTimeouts(dialTimeout, tlsHandshakeTimeout time.Duration) {
+	client := http.DefaultClient
+	if dialTimeout > 0 || tlsHandshakeTimeout > 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if dialTimeout > 0 {
+			transport.DialContext = (&net.Dialer{
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext
+		}
+		if tlsHandshakeTimeout > 0 {
+			transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+		}
+		client = &http.Client{Transport: transport}
+	}
+	storageClientLock.Lock()
+	storageClient = client
+	storageClientLock.Unlock()
+}
+
+// httpClient returns the client for the requests to the storage services, with the timeouts of
+// SetDialTimeouts
+func httpClient() *http.Client {
+	storageClientLock.RLock()
+	defer storageClientLock.RUnlock()
+	return storageClient
+}
@@ -0,0 +1,36 @@
+package drivers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetDialTimeouts(t *testing.T) {
+	require := require.New(t)
+	defer SetDialTimeouts(0, 0)
+	require.Same(http.DefaultClient, httpClient())
+
+	SetDialTimeouts(200*time.Millisecond, time.Second)
+	transport := httpClient().Transport.(*http.Transport)
+	require.Equal(time.Second, transport.TLSHandshakeTimeout)
+
+	// a non-routable address, which doesn't answer the connection attempts
+	sess := NewSession(&OSInfo{StorageType: OSInfo_DIRECT, DirectInfo: &DirectOSInfo{URL: "http://10.255.255.1/upload"}})
+	start := time.Now()
+	_, err := sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, time.Minute)
+	require.Error(err)
+	require.Less(time.Since(start), 5*time.Second)
+
+	drv, err := NewS3Driver("us-west-2", "example-bucket", "user", "secret", "", true)
+	require.NoError(err)
+	require.Same(httpClient(), drv.(*S3OS).s3sess.Config.HTTPClient)
+	require.Same(httpClient(), NewB2Driver("key", "secret", "bucket", "").client.HTTPClient)
+
+	SetDialTimeouts(0, 0)
+	require.Same(http.DefaultClient, httpClient())
+}
@@ -1,19 +1,18 @@
 package drivers
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	bserv "github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
-	ds "github.com/ipfs/go-datastore"
-	dssync "github.com/ipfs/go-datastore/sync"
-	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	format "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-unixfs"
 	"github.com/ipld/go-car"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
@@ -22,7 +21,18 @@ import (
 	"time"
 )
 
-const w3SDefaultSaveTimeout = 5 * time.Minute
+const (
+	w3SDefaultSaveTimeout = 5 * time.Minute
+	// defaultW3CommandRetries is the number of times a livepeer-w3 command is retried on a
+	// transient failure
+	defaultW3CommandRetries = 3
+	// defaultW3CommandBackoff is the delay before the first retry, doubled on each subsequent one
+	defaultW3CommandBackoff = 500 * time.Millisecond
+)
+
+// w3PermanentFailure matches the output of the livepeer-w3 commands failing for reasons which
+// retrying can't fix, like rejected credentials or invalid input
+var w3PermanentFailure = regexp.MustCompile(`(?i)unauthori[sz]ed|forbidden|\b40[013]\b|invalid|malformed|expired|missing capabilit|no such file`)
 
 var base64Url = base64.URLEncoding.WithPadding(base64.NoPadding)
 
@@ -43,12 +53,15 @@ type rootCar struct {
 	dag     format.DAGService
 	carCids []string
 	mu      sync.Mutex
+
+	cidBuilder cid.Builder
 }
 
-func newRootCar() *rootCar {
+func newRootCar(cidBuilder cid.Builder) *rootCar {
 	return &rootCar{
-		root: newDir(),
-		dag:  merkledag.NewDAGService(bserv.New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)),
+		root:       newDir(cidBuilder),
+		dag:        newDagService(),
+		cidBuilder: cidBuilder,
 	}
 }
 
@@ -56,6 +69,45 @@ type W3sOS struct {
 	ucanProof string
 	dirPath   string
 	pubId     string
+
+	// DagOptions control the chunking and CIDs of the saved files and the published directory.
+	// Files are packed with ipfs-car unless non-default options are set.
+	DagOptions W3sDagOptions
+	// CommandTimeout limits the time each of the ipfs-car and livepeer-w3 commands run by SaveData
+	// and Publish can take, the command is killed when it runs longer. Zero means the commands are
+	// only limited by the context of the call.
+	CommandTimeout time.Duration
+	// CommandRetries is the number of times the livepeer-w3 commands storing and uploading the CARs
+	// are retried when they fail transiently, e.g. on network errors. Failures caused by the
+	// credentials or the input are not retried. Zero means the default of 3, negative disables the
+	// retries.
+	CommandRetries int
+	// CommandRetryBackoff is the delay before the first retry, doubled on each subsequent one. Zero
+	// means the default of 500ms.
+	CommandRetryBackoff time.Duration
+	// Uploader stores the CARs in web3.storage. Nil means the livepeer-w3 CLI, run with the UCAN
+	// proof of the driver. Together with DagOptions packing the files natively, a Go uploader
+	// removes the need for any external binary.
+	Uploader W3sUploader
+	// IpfsCarBinary is the path of the ipfs-car binary. Empty means ipfs-car is looked up in PATH.
+	IpfsCarBinary string
+	// W3Binary is the path of the livepeer-w3 binary. Empty means livepeer-w3 is looked up in PATH.
+	W3Binary string
+	// GatewayURL is the IPFS gateway ListFiles fetches the blocks of the published directories
+	// from, with the trustless gateway API. Empty means https://w3s.link/ipfs/.
+	GatewayURL string
+
+	// depsFound is set once the external binaries needed by SaveData were found
+	depsFound bool
+	depsMu    sync.Mutex
+}
+
+// W3sUploader stores CAR files in web3.storage on behalf of the W3S driver
+type W3sUploader interface {
+	// StoreCar stores the CAR file at carPath and returns the CID of the CAR
+	StoreCar(ctx context.Context, carPath string) (string, error)
+	// UploadCar registers the upload of the DAG with the given root, stored in the given CARs
+	UploadCar(ctx context.Context, rootCid string, carCids []string) error
 }
 
 var _ OSSession = (*W3sSession)(nil)
@@ -83,13 +135,18 @@ func (ostore *W3sOS) NewSession(filename string) OSSession {
 }
 
 func (ostore *W3sOS) UriSchemes() []string {
-	return []string{}
+	return []string{"w3s"}
 }
 
 func (ostore *W3sOS) Description() string {
 	return "Web3 Storage driver."
 }
 
+// String describes the driver with the UCAN proof masked, so it's safe to log
+func (ostore *W3sOS) String() string {
+	return fmt.Sprintf("W3sOS{pubId: %s, dirPath: %s, ucanProof: %s}", ostore.pubId, ostore.dirPath, redactSecret(ostore.ucanProof))
+}
+
 func (session *W3sSession) OS() OSDriver {
 	return session.os
 }
@@ -98,10 +155,6 @@ func (session *W3sSession) EndSession() {
 	// no op
 }
 
-func (session *W3sSession) ListFiles(ctx context.Context, cid, delim string) (PageInfo, error) {
-	return nil, ErrNotSupported
-}
-
 func (session *W3sSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
 	return nil, ErrNotSupported
 }
@@ -114,6 +167,28 @@ func (session *W3sSession) Presign(name string, expire time.Duration) (string, e
 	return "", ErrNotSupported
 }
 
+func (session *W3sSession) PresignUpload(name string, expire time.Duration, fields *FileProperties) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+// PublicURL returns the URL of a file CID returned by SaveData. The URL of the file within the
+// directory structure is only known after Publish.
+func (session *W3sSession) PublicURL(name string) (string, error) {
+	return "ipfs://" + name, nil
+}
+
+func (session *W3sSession) ObjectURI(name string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (session *W3sSession) ReadSeeker(ctx context.Context, name string) (io.ReadSeekCloser, int64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+func (session *W3sSession) SaveFile(ctx context.Context, name, srcPath string, fields *FileProperties) (*SaveDataOutput, error) {
+	return saveFile(ctx, session, name, srcPath, fields)
+}
+
 func (session *W3sSession) IsExternal() bool {
 	return false
 }
@@ -123,8 +198,23 @@ func (session *W3sSession) IsOwn(url string) bool {
 	return false
 }
 
+// GetInfo carries the UCAN proof, so it should only be handed to trusted nodes
 func (session *W3sSession) GetInfo() *OSInfo {
-	return nil
+	return &OSInfo{
+		StorageType: OSInfo_W3S,
+		W3sInfo: &W3sOSInfo{
+			UcanProof: session.os.ucanProof,
+			DirPath:   session.os.dirPath,
+			PubId:     session.os.pubId,
+		},
+	}
+}
+
+func newW3sSession(info *W3sOSInfo) OSSession {
+	if info == nil {
+		return nil
+	}
+	return NewW3sDriver(info.UcanProof, info.DirPath, info.PubId).NewSession("")
 }
 
 func (session *W3sSession) getAbsolutePath(name string) string {
@@ -136,26 +226,51 @@ func (session *W3sSession) DeleteFile(ctx context.Context, name string) error {
 	return ErrNotSupported
 }
 
-func (session *W3sSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
-	if timeout <= 0 {
-		timeout = w3SDefaultSaveTimeout
-	}
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+// Rename is not supported, the content is addressed by its CID
+func (session *W3sSession) Rename(ctx context.Context, oldName, newName string) error {
+	return ErrNotSupported
+}
+
+func (session *W3sSession) PrefixSize(ctx context.Context, prefix string) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+// SaveData packs the data into a CAR and stores it in web3.storage, then adds the file to the
+// directory published for the pubId. Concurrent calls pack and store their files in parallel, only
+// adding the files to the directory is serialized.
+func (session *W3sSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (out *SaveDataOutput, err error) {
+	data, counter := countSave(withRateLimit(data, saveRateLimit(fields)))
+	defer recordSave("w3s", time.Now(), counter, &err)
+	ctx, cancel := withSaveTimeout(ctx, timeout, w3SDefaultSaveTimeout)
 	defer cancel()
 
+	if err := session.os.checkDependencies(); err != nil {
+		return nil, err
+	}
 	filePath, err := toFile(data)
 	if err != nil {
 		return nil, err
 	}
 	defer deleteFile(filePath)
 
-	carPath, fileCid, err := ipfsCarPack(ctx, filePath)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var carPath, fileCid string
+	// the DAG of an empty file is a single empty leaf, packed natively as ipfs-car may fail on it
+	if session.os.DagOptions.packsNatively() || info.Size() == 0 {
+		carPath, fileCid, err = dagPackCar(ctx, filePath, session.os.DagOptions)
+	} else {
+		carPath, fileCid, err = ipfsCarPack(ctx, session.os.ipfsCarBinary(), session.os.CommandTimeout, filePath)
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer deleteFile(carPath)
 
-	carCid, err := w3StoreCar(ctx, session.os.ucanProof, carPath)
+	carCid, err := session.os.uploader().StoreCar(ctx, carPath)
 	if err != nil {
 		return nil, err
 	}
@@ -192,6 +307,9 @@ func (rc *rootCar) addFile(ctx context.Context, dirPath, filename, fileCid, carC
 // - create directory defined by the first element in dirPaths
 // - recursively create the rest of directories defined with the remaining dirPaths
 // - recalculate the CID of the current node (it changed because its children have changed)
+//
+// The links of a node are encoded sorted by name, so the resulting root CID only depends on the
+// set of saved files and not on the order in which they were added.
 func (rc *rootCar) addFileToDagRecursive(ctx context.Context, n *merkledag.ProtoNode, dirPaths []string, filename, fileCid string) (*merkledag.ProtoNode, error) {
 	if len(dirPaths) == 0 {
 		// n is a leaf
@@ -199,6 +317,11 @@ func (rc *rootCar) addFileToDagRecursive(ctx context.Context, n *merkledag.Proto
 		if err != nil {
 			return nil, err
 		}
+		// saving the same name again replaces the file, so that the directory doesn't end up with
+		// duplicate entries whose order would depend on the order of the SaveData calls
+		if err = n.RemoveNodeLink(filename); err != nil && err != merkledag.ErrLinkNotFound {
+			return nil, err
+		}
 		n.AddRawLink(filename, &format.Link{Cid: fCid})
 		rc.dag.Add(ctx, n)
 		return n, nil
@@ -233,7 +356,7 @@ func (rc *rootCar) addFileToDagRecursive(ctx context.Context, n *merkledag.Proto
 func (rc *rootCar) getOrCreateChild(ctx context.Context, n *merkledag.ProtoNode, linkName string) (*merkledag.ProtoNode, error) {
 	child, err := n.GetLinkedProtoNode(ctx, rc.dag, linkName)
 	if err == merkledag.ErrLinkNotFound {
-		child = newDir()
+		child = newDir(rc.cidBuilder)
 		n.AddNodeLink(linkName, child)
 	} else if err != nil {
 		return nil, err
@@ -241,18 +364,28 @@ func (rc *rootCar) getOrCreateChild(ctx context.Context, n *merkledag.ProtoNode,
 	return child, nil
 }
 
+// Publish stores the CAR of the directory of the pubId and uploads the DAG with all the CARs
+// stored by SaveData. It returns as soon as ctx is done, leaving no temp files behind. The data of
+// a failed or cancelled Publish is kept, for it to be retried.
 func (ostore *W3sOS) Publish(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	rCar := ostore.getRootCar()
-	rootCid := rCar.root.Cid().String()
 
 	rCar.mu.Lock()
-	if err := rCar.storeDir(ctx, ostore.ucanProof); err != nil {
+	rootCid := rCar.root.Cid().String()
+	dirCarCid, err := rCar.storeDir(ctx, ostore)
+	carCids := append(append([]string{}, rCar.carCids...), dirCarCid)
+	rCar.mu.Unlock()
+	if err != nil {
 		return "", err
 	}
-	carCids := rCar.carCids
-	rCar.mu.Unlock()
 
-	if err := w3UploadCar(ctx, ostore.ucanProof, rootCid, carCids); err != nil {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := ostore.uploader().UploadCar(ctx, rootCid, carCids); err != nil {
 		return "", err
 	}
 
@@ -260,22 +393,114 @@ func (ostore *W3sOS) Publish(ctx context.Context) (string, error) {
 	return fmt.Sprintf("ipfs://%s", rootCid), nil
 }
 
-func (rc *rootCar) storeDir(ctx context.Context, proof string) error {
-	carFile, err := os.CreateTemp("", "car")
+// HealthCheck checks that the w3 CLI accepts the agent key and the UCAN proof. With a custom
+// Uploader, the check is delegated to its HealthCheck method, if it has one.
+func (ostore *W3sOS) HealthCheck(ctx context.Context) error {
+	if hc, ok := ostore.uploader().(interface{ HealthCheck(context.Context) error }); ok {
+		return hc.HealthCheck(ctx)
+	}
+	return ErrNotSupported
+}
+
+// checkDependencies returns ErrMissingDependency if the binaries run by SaveData with the options
+// of the driver are not installed. Once they're found, they're not looked up again. Failed checks
+// are repeated, for the driver to work once the binaries are installed.
+func (ostore *W3sOS) checkDependencies() error {
+	ostore.depsMu.Lock()
+	defer ostore.depsMu.Unlock()
+	if ostore.depsFound {
+		return nil
+	}
+	var binaries []string
+	if !ostore.DagOptions.packsNatively() {
+		binaries = append(binaries, ostore.ipfsCarBinary())
+	}
+	if ostore.Uploader == nil {
+		binaries = append(binaries, ostore.w3Binary())
+	}
+	for _, binary := range binaries {
+		if _, err := exec.LookPath(binary); err != nil {
+			return missingDependency(binary, err)
+		}
+	}
+	ostore.depsFound = true
+	return nil
+}
+
+func (ostore *W3sOS) ipfsCarBinary() string {
+	if ostore.IpfsCarBinary != "" {
+		return ostore.IpfsCarBinary
+	}
+	return "ipfs-car"
+}
+
+func (ostore *W3sOS) w3Binary() string {
+	if ostore.W3Binary != "" {
+		return ostore.W3Binary
+	}
+	return "livepeer-w3"
+}
+
+// missingDependency describes the failure to find the binary, wrapping ErrMissingDependency
+func missingDependency(binary string, err error) error {
+	return fmt.Errorf("%w: %s is not installed: %v", ErrMissingDependency, binary, err)
+}
+
+func (ostore *W3sOS) uploader() W3sUploader {
+	if ostore.Uploader != nil {
+		return ostore.Uploader
+	}
+	return w3CLI{os: ostore}
+}
+
+// w3CLI is the default W3sUploader running the livepeer-w3 CLI
+type w3CLI struct {
+	os *W3sOS
+}
+
+func (cli w3CLI) StoreCar(ctx context.Context, carPath string) (string, error) {
+	return cli.os.w3StoreCar(ctx, carPath)
+}
+
+func (cli w3CLI) UploadCar(ctx context.Context, rootCid string, carCids []string) error {
+	return cli.os.w3UploadCar(ctx, rootCid, carCids)
+}
+
+func (cli w3CLI) HealthCheck(ctx context.Context) error {
+	return w3Whoami(ctx, cli.os.w3Binary(), cli.os.ucanProof)
+}
+
+// Shutdown drops the data collected for the pubId which was not published yet
+func (ostore *W3sOS) Shutdown(ctx context.Context) error {
+	dataToPublishMu.Lock()
+	if rCar, ok := dataToPublish[ostore.pubId]; ok {
+		Log.Infof("Dropping unpublished W3S data pubId=%s files=%d", ostore.pubId, len(rCar.carCids))
+	}
+	dataToPublishMu.Unlock()
+	ostore.deleteRootCar()
+	return nil
+}
+
+// storeDir stores the CAR of the directory DAG and returns its CID. The CID is not added to the
+// CARs of the rootCar, as the directory changes with each saved file.
+func (rc *rootCar) storeDir(ctx context.Context, ostore *W3sOS) (string, error) {
+	carFile, err := os.CreateTemp(TempDir, "car")
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer deleteFile(carFile.Name())
-	car.WriteCar(ctx, rc.dag, []cid.Cid{rc.root.Cid()}, carFile, merkledag.IgnoreMissing())
-	carFile.Close()
-
-	storedCid, err := w3StoreCar(ctx, proof, carFile.Name())
+	err = car.WriteCar(ctx, rc.dag, []cid.Cid{rc.root.Cid()}, carFile, merkledag.IgnoreMissing())
+	if closeErr := carFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return err
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
-	rc.carCids = append(rc.carCids, storedCid)
 
-	return nil
+	return ostore.uploader().StoreCar(ctx, carFile.Name())
 }
 
 func (ostore *W3sOS) getRootCar() *rootCar {
@@ -283,7 +508,7 @@ func (ostore *W3sOS) getRootCar() *rootCar {
 	defer dataToPublishMu.Unlock()
 
 	if _, ok := dataToPublish[ostore.pubId]; !ok {
-		dataToPublish[ostore.pubId] = newRootCar()
+		dataToPublish[ostore.pubId] = newRootCar(ostore.DagOptions.cidBuilder())
 	}
 	return dataToPublish[ostore.pubId]
 }
@@ -295,14 +520,14 @@ func (ostore *W3sOS) deleteRootCar() {
 	delete(dataToPublish, ostore.pubId)
 }
 
-func newDir() *merkledag.ProtoNode {
+func newDir(cidBuilder cid.Builder) *merkledag.ProtoNode {
 	n := unixfs.EmptyDirNode()
-	n.SetCidBuilder(cidV1)
+	n.SetCidBuilder(cidBuilder)
 	return n
 }
 
 func toFile(data io.Reader) (string, error) {
-	fRaw, err := os.CreateTemp("", "w3s-raw")
+	fRaw, err := os.CreateTemp(TempDir, "w3s-raw")
 	if err != nil {
 		return "", err
 	}
@@ -321,16 +546,19 @@ func deleteFile(filePath string) {
 }
 
 // ipfsCarPack uses external binary 'ipfs-car' to convert a file into a CAR.
-func ipfsCarPack(ctx context.Context, filePath string) (string, string, error) {
-	fCar, err := os.CreateTemp("", "w3s-car")
+func ipfsCarPack(ctx context.Context, binary string, timeout time.Duration, filePath string) (string, string, error) {
+	fCar, err := os.CreateTemp(TempDir, "w3s-car")
 	if err != nil {
 		return "", "", err
 	}
 
-	out, err := exec.CommandContext(ctx, "ipfs-car", "--wrapWithDirectory", "false", "--pack", filePath, "--output", fCar.Name()).CombinedOutput()
+	ctx, cancel := commandContext(ctx, timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, binary, "--wrapWithDirectory", "false", "--pack", filePath, "--output", fCar.Name()).CombinedOutput()
 	if err != nil {
+		fCar.Close()
 		deleteFile(fCar.Name())
-		return "", "", fmt.Errorf("executing 'ipfs-car' failed, command output: %s, err: %v", string(out), err)
+		return "", "", commandError(ctx, "ipfs-car", out, err)
 	}
 
 	r := regexp.MustCompile(`root CID: ([A-Za-z0-9]+)`)
@@ -345,27 +573,108 @@ func ipfsCarPack(ctx context.Context, filePath string) (string, string, error) {
 	return fCar.Name(), fileCid, nil
 }
 
+// w3Whoami uses external binary `w3` to check that the agent key and the UCAN proof are valid
+func w3Whoami(ctx context.Context, binary, proof string) error {
+	out, err := runWithCredentials(exec.CommandContext(ctx, binary, "whoami"), proof)
+	if errors.Is(err, exec.ErrNotFound) {
+		return missingDependency(binary, err)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("executing 'livepeer-w3 whoami' failed: %w, command output: %s", ErrUnauthorized, string(out))
+	}
+	return err
+}
+
 // w3StoreCar uses external binary `w3` to store a CAR file in web3.storage.
-func w3StoreCar(ctx context.Context, proof, carPath string) (string, error) {
-	out, err := runWithCredentials(exec.CommandContext(ctx, "livepeer-w3", "can", "store", "add", carPath), proof)
+func (ostore *W3sOS) w3StoreCar(ctx context.Context, carPath string) (string, error) {
+	out, err := ostore.runW3Retried(ctx, "livepeer-w3 can store add", "can", "store", "add", carPath)
 	if err != nil {
-		return "", fmt.Errorf("executing 'livepeer-w3 can store add' failed, command output: %s, err: %v", string(out), err)
+		return "", err
+	}
+	return parseStoredCid(out)
+}
+
+// parseStoredCid finds the CID of the stored CAR in the output of 'livepeer-w3 can store add'. The
+// output may contain other lines, like banners and warnings, so the CID is the last word of the
+// output which is a valid CID.
+func parseStoredCid(out []byte) (string, error) {
+	words := strings.Fields(string(out))
+	for i := len(words) - 1; i >= 0; i-- {
+		if c, err := cid.Decode(words[i]); err == nil {
+			return c.String(), nil
+		}
 	}
-	return strings.TrimSpace(string(out)), nil
+	return "", fmt.Errorf("cannot find stored CAR CID in the output: %s", string(out))
 }
 
 // w3StoreCar uses external binary `w3` to bind and publish multiple CARs.
-func w3UploadCar(ctx context.Context, proof, rootCid string, carCids []string) error {
+func (ostore *W3sOS) w3UploadCar(ctx context.Context, rootCid string, carCids []string) error {
 	args := []string{"can", "upload", "add"}
 	args = append(args, rootCid)
 	args = append(args, carCids...)
-	out, err := runWithCredentials(exec.CommandContext(ctx, "livepeer-w3", args...), proof)
-	if err != nil {
-		return fmt.Errorf("executing 'livepeer-w3 can store upload' failed, command output: %s, err: %v", string(out), err)
+	_, err := ostore.runW3Retried(ctx, "livepeer-w3 can store upload", args...)
+	return err
+}
+
+// runW3Retried runs livepeer-w3 with the given arguments, retrying with exponential backoff while
+// it fails transiently. Each attempt is limited by CommandTimeout.
+func (ostore *W3sOS) runW3Retried(ctx context.Context, name string, args ...string) ([]byte, error) {
+	retries, backoff := ostore.CommandRetries, ostore.CommandRetryBackoff
+	if retries == 0 {
+		retries = defaultW3CommandRetries
+	}
+	if backoff == 0 {
+		backoff = defaultW3CommandBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		cmdCtx, cancel := commandContext(ctx, ostore.CommandTimeout)
+		out, err := runWithCredentials(exec.CommandContext(cmdCtx, ostore.w3Binary(), args...), ostore.ucanProof)
+		if err == nil {
+			cancel()
+			return out, nil
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			cancel()
+			return nil, missingDependency(ostore.w3Binary(), err)
+		}
+		var exitErr *exec.ExitError
+		transient := errors.As(err, &exitErr) || errors.Is(cmdCtx.Err(), context.DeadlineExceeded)
+		err = commandError(cmdCtx, name, out, err)
+		cancel()
+		if !transient || w3PermanentFailure.Match(out) || ctx.Err() != nil || attempt >= retries {
+			return nil, err
+		}
+		Log.Warnf("Retrying W3S command=%q attempt=%d err=%v", name, attempt+1, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
-	return nil
 }
 
+// commandContext returns the context for running a single external command, which is killed when
+// the context is done. A zero timeout leaves the command only limited by ctx.
+func commandContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// commandError describes the failure of an external command run with the given context
+func commandError(ctx context.Context, name string, out []byte, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("executing '%s' timed out, command output: %s: %w", name, string(out), ctx.Err())
+	}
+	return fmt.Errorf("executing '%s' failed, command output: %s, err: %v", name, string(out), err)
+}
+
+// runWithCredentials passes the UCAN proof to the command through the environment, so it never
+// appears in the command arguments or exec errors. Any credentials echoed by the command itself are
+// masked in the returned output, as callers include it in their error messages.
 func runWithCredentials(cmd *exec.Cmd, proof string) ([]byte, error) {
 	if proof == "" {
 		return nil, fmt.Errorf("UCAN proof not found")
@@ -375,8 +684,18 @@ func runWithCredentials(cmd *exec.Cmd, proof string) ([]byte, error) {
 		return nil, fmt.Errorf("invalid UCAN proof format: %s", err)
 	}
 	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, fmt.Sprintf("W3_DELEGATION_PROOF='%s'", base64Proof))
-	return cmd.CombinedOutput()
+	cmd.Env = append(cmd.Env, "W3_DELEGATION_PROOF="+base64Proof)
+	out, err := cmd.CombinedOutput()
+	return redactOutput(out, proof, base64Proof, os.Getenv("W3_PRINCIPAL_KEY")), err
+}
+
+func redactOutput(out []byte, secrets ...string) []byte {
+	for _, secret := range secrets {
+		if secret != "" {
+			out = bytes.ReplaceAll(out, []byte(secret), []byte(redacted))
+		}
+	}
+	return out
 }
 
 func base64UrlToBase64(proof string) (string, error) {
@@ -6,13 +6,18 @@ import (
 	"crypto/rand"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/ipld/go-car"
 	require2 "github.com/stretchr/testify/require"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testFile struct {
@@ -128,3 +133,368 @@ func TestBase64UrlToBase64(t *testing.T) {
 		})
 	}
 }
+
+func TestRunWithCredentialsEnv(t *testing.T) {
+	require := require2.New(t)
+	if _, err := exec.LookPath("true"); err != nil {
+		t.Skip("No 'true' binary, test skipped")
+	}
+
+	proof := "_-HCmI596rRX4xY"
+	cmd := exec.Command("true")
+	_, err := runWithCredentials(cmd, proof)
+	require.NoError(err)
+
+	var found []string
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, "W3_DELEGATION_PROOF=") {
+			found = append(found, env)
+		}
+	}
+	require.Equal([]string{"W3_DELEGATION_PROOF=/+HCmI596rRX4xY="}, found)
+}
+
+func TestToFileUsesTempDir(t *testing.T) {
+	require := require2.New(t)
+
+	oldTempDir := TempDir
+	TempDir = t.TempDir()
+	defer func() {
+		TempDir = oldTempDir
+	}()
+
+	filePath, err := toFile(bytes.NewReader([]byte("some data")))
+	require.NoError(err)
+	defer deleteFile(filePath)
+	require.Equal(TempDir, filepath.Dir(filePath))
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(err)
+	require.Equal("some data", string(data))
+}
+
+func TestW3sHealthCheck(t *testing.T) {
+	require := require2.New(t)
+	// fake livepeer-w3 CLI accepting only the delegation proof "proof", base64 encoded as "cHJvb2Y="
+	bin := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = whoami ] && [ \"$W3_DELEGATION_PROOF\" = cHJvb2Y= ] && echo did:key:agent && exit 0\necho invalid proof >&2\nexit 1\n"
+	require.NoError(os.WriteFile(filepath.Join(bin, "livepeer-w3"), []byte(script), 0755))
+	t.Setenv("PATH", bin)
+
+	proof := base64Url.EncodeToString([]byte("proof"))
+	require.NoError(NewW3sDriver(proof, "", "pub").HealthCheck(context.Background()))
+	wrong := base64Url.EncodeToString([]byte("wrong"))
+	require.ErrorIs(NewW3sDriver(wrong, "", "pub").HealthCheck(context.Background()), ErrUnauthorized)
+
+	t.Setenv("PATH", t.TempDir())
+	err := NewW3sDriver(proof, "", "pub").HealthCheck(context.Background())
+	require.ErrorIs(err, ErrMissingDependency)
+	require.ErrorContains(err, "livepeer-w3 is not installed")
+	require.NotErrorIs(err, ErrUnauthorized)
+}
+
+func TestW3sMissingDependency(t *testing.T) {
+	require := require2.New(t)
+	t.Setenv("PATH", "")
+	proof := base64Url.EncodeToString([]byte("proof"))
+	drv := NewW3sDriver(proof, "", "missing-dependency-test")
+	defer drv.Shutdown(context.Background())
+
+	_, err := drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.ErrorIs(err, ErrMissingDependency)
+	require.ErrorContains(err, "ipfs-car is not installed")
+
+	// packing natively only needs livepeer-w3
+	drv.DagOptions = W3sDagOptions{ChunkSize: 1024}
+	_, err = drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.ErrorIs(err, ErrMissingDependency)
+	require.ErrorContains(err, "livepeer-w3 is not installed")
+	_, err = drv.Publish(context.Background())
+	require.ErrorIs(err, ErrMissingDependency)
+
+	// the binaries at the configured paths are found without PATH
+	bin := t.TempDir()
+	ipfsCar := "#!/bin/sh\necho 'root CID: bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy'\n"
+	w3 := "#!/bin/sh\necho bagbaieratjrgzdsmoen2bndcg5snipm6jjmcdyqxn6tnnoymkdk7agu7rgpq\n"
+	require.NoError(os.WriteFile(filepath.Join(bin, "car"), []byte(ipfsCar), 0755))
+	require.NoError(os.WriteFile(filepath.Join(bin, "w3"), []byte(w3), 0755))
+	drv.DagOptions = W3sDagOptions{}
+	drv.IpfsCarBinary = filepath.Join(bin, "car")
+	drv.W3Binary = filepath.Join(bin, "w3")
+	out, err := drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	require.Equal("bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy", out.URL)
+}
+
+func TestW3sCommandTimeout(t *testing.T) {
+	require := require2.New(t)
+	bin, tmp := t.TempDir(), t.TempDir()
+	oldTempDir := TempDir
+	TempDir = tmp
+	defer func() { TempDir = oldTempDir }()
+	writeScript := func(name, script string) {
+		require.NoError(os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script), 0755))
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	proof := base64Url.EncodeToString([]byte("proof"))
+	drv := NewW3sDriver(proof, "", "timeout-test")
+	drv.CommandTimeout = 200 * time.Millisecond
+	drv.CommandRetries = -1
+	defer drv.Shutdown(context.Background())
+
+	// packing the file hangs
+	writeScript("ipfs-car", "exec sleep 30\n")
+	writeScript("livepeer-w3", "exit 1\n")
+	start := time.Now()
+	_, err := drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, time.Minute)
+	require.ErrorIs(err, context.DeadlineExceeded)
+	require.Less(time.Since(start), 10*time.Second)
+	entries, err := os.ReadDir(tmp)
+	require.NoError(err)
+	require.Empty(entries)
+
+	// storing the packed file hangs
+	writeScript("ipfs-car", "echo 'root CID: bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy'\n")
+	writeScript("livepeer-w3", "exec sleep 30\n")
+	start = time.Now()
+	_, err = drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, time.Minute)
+	require.ErrorIs(err, context.DeadlineExceeded)
+	require.Less(time.Since(start), 10*time.Second)
+	entries, err = os.ReadDir(tmp)
+	require.NoError(err)
+	require.Empty(entries)
+}
+
+func TestParseStoredCid(t *testing.T) {
+	require := require2.New(t)
+	carCid := "bagbaieratjrgzdsmoen2bndcg5snipm6jjmcdyqxn6tnnoymkdk7agu7rgpq"
+
+	c, err := parseStoredCid([]byte(carCid + "\n"))
+	require.NoError(err)
+	require.Equal(carCid, c)
+
+	noisy := "livepeer-w3 v2.0.0 - a new version is available\n" +
+		"Warning: the space is almost full (95% used)\n" +
+		carCid + "\n"
+	c, err = parseStoredCid([]byte(noisy))
+	require.NoError(err)
+	require.Equal(carCid, c)
+
+	_, err = parseStoredCid([]byte("Error: nothing stored\n"))
+	require.ErrorContains(err, "cannot find stored CAR CID")
+	_, err = parseStoredCid(nil)
+	require.Error(err)
+}
+
+// BenchmarkW3sSaveDataBatch saves a batch of segments for one pubId with fake CLIs that take 20ms
+// per command, sequentially and concurrently
+func BenchmarkW3sSaveDataBatch(b *testing.B) {
+	const batch = 16
+	bin := b.TempDir()
+	scripts := map[string]string{
+		"ipfs-car":    "sleep 0.02\necho 'root CID: bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy'\n",
+		"livepeer-w3": "sleep 0.02\necho bagbaieratjrgzdsmoen2bndcg5snipm6jjmcdyqxn6tnnoymkdk7agu7rgpq\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	proof := base64Url.EncodeToString([]byte("proof"))
+
+	save := func(b *testing.B, sess OSSession, i int) {
+		if _, err := sess.SaveData(context.Background(), fmt.Sprintf("%d.ts", i), strings.NewReader("data"), nil, 0); err != nil {
+			b.Error(err)
+		}
+	}
+	b.Run("sequential", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			drv := NewW3sDriver(proof, "", "bench-sequential")
+			sess := drv.NewSession("")
+			for i := 0; i < batch; i++ {
+				save(b, sess, i)
+			}
+			drv.Shutdown(context.Background())
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			drv := NewW3sDriver(proof, "", "bench-concurrent")
+			sess := drv.NewSession("")
+			var wg sync.WaitGroup
+			for i := 0; i < batch; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					save(b, sess, i)
+				}(i)
+			}
+			wg.Wait()
+			drv.Shutdown(context.Background())
+		}
+	})
+}
+
+func TestW3sCommandRetries(t *testing.T) {
+	require := require2.New(t)
+	bin, state := t.TempDir(), t.TempDir()
+	attempts := filepath.Join(state, "attempts")
+	// fake CLIs: ipfs-car always succeeds, livepeer-w3 fails printing the next line of the failure
+	// file for as long as the file is not empty
+	ipfsCar := "#!/bin/sh\necho 'root CID: bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy'\n"
+	failure := filepath.Join(state, "failure")
+	w3 := "#!/bin/sh\necho x >> " + attempts + "\n" +
+		"if [ -s " + failure + " ]; then head -n 1 " + failure + "; tail -n +2 " + failure + " > " + failure + ".next; mv " + failure + ".next " + failure + "; exit 1; fi\n" +
+		"echo bagbaieratjrgzdsmoen2bndcg5snipm6jjmcdyqxn6tnnoymkdk7agu7rgpq\n"
+	require.NoError(os.WriteFile(filepath.Join(bin, "ipfs-car"), []byte(ipfsCar), 0755))
+	require.NoError(os.WriteFile(filepath.Join(bin, "livepeer-w3"), []byte(w3), 0755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	drv := NewW3sDriver(base64Url.EncodeToString([]byte("proof")), "", "retries-test")
+	drv.CommandRetryBackoff = time.Millisecond
+	defer drv.Shutdown(context.Background())
+	save := func(failures string) (int, error) {
+		require.NoError(os.WriteFile(failure, []byte(failures), 0644))
+		os.Remove(attempts)
+		_, err := drv.NewSession("").SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+		out, _ := os.ReadFile(attempts)
+		return strings.Count(string(out), "x"), err
+	}
+
+	// transient failures are retried
+	count, err := save("Error: fetch failed: ECONNRESET\nError: 502 Bad Gateway\n")
+	require.NoError(err)
+	require.Equal(3, count)
+
+	// until the retries run out
+	count, err = save(strings.Repeat("Error: fetch failed: ECONNRESET\n", 5))
+	require.ErrorContains(err, "ECONNRESET")
+	require.Equal(4, count)
+
+	// rejected credentials are not retried
+	count, err = save("Error: 401 Unauthorized\n")
+	require.ErrorContains(err, "Unauthorized")
+	require.Equal(1, count)
+}
+
+type fakeW3sUploader struct {
+	mu      sync.Mutex
+	stored  map[string][]byte
+	rootCid string
+	carCids []string
+}
+
+func (u *fakeW3sUploader) StoreCar(ctx context.Context, carPath string) (string, error) {
+	data, err := os.ReadFile(carPath)
+	if err != nil {
+		return "", err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	carCid := fmt.Sprintf("car-%d", len(u.stored))
+	u.stored[carCid] = data
+	return carCid, nil
+}
+
+func (u *fakeW3sUploader) UploadCar(ctx context.Context, rootCid string, carCids []string) error {
+	u.rootCid, u.carCids = rootCid, carCids
+	return nil
+}
+
+func TestW3sCustomUploader(t *testing.T) {
+	require := require2.New(t)
+	// no external binaries are needed when packing natively with a custom uploader
+	t.Setenv("PATH", t.TempDir())
+	uploader := &fakeW3sUploader{stored: map[string][]byte{}}
+	drv := NewW3sDriver(base64Url.EncodeToString([]byte("proof")), "/video/hls", "custom-uploader-test")
+	drv.DagOptions = W3sDagOptions{ChunkSize: 1024}
+	drv.Uploader = uploader
+	defer drv.Shutdown(context.Background())
+
+	out, err := drv.NewSession("").SaveData(context.Background(), "1.ts", bytes.NewReader(make([]byte, 4096)), nil, 0)
+	require.NoError(err)
+	require.NotEmpty(out.URL)
+	url, err := drv.Publish(context.Background())
+	require.NoError(err)
+	require.Equal("ipfs://"+uploader.rootCid, url)
+	require.Equal([]string{"car-0", "car-1"}, uploader.carCids)
+	require.Len(uploader.stored, 2)
+	require.ErrorIs(drv.HealthCheck(context.Background()), ErrNotSupported)
+}
+
+// blockingW3sUploader blocks UploadCar until the context is done
+type blockingW3sUploader struct {
+	*fakeW3sUploader
+	uploading chan struct{}
+}
+
+func (u *blockingW3sUploader) UploadCar(ctx context.Context, rootCid string, carCids []string) error {
+	close(u.uploading)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestW3sPublishCancel(t *testing.T) {
+	require := require2.New(t)
+	tmp := t.TempDir()
+	oldTempDir := TempDir
+	TempDir = tmp
+	defer func() { TempDir = oldTempDir }()
+	uploader := &fakeW3sUploader{stored: map[string][]byte{}}
+	blocking := &blockingW3sUploader{fakeW3sUploader: uploader, uploading: make(chan struct{})}
+	drv := NewW3sDriver(base64Url.EncodeToString([]byte("proof")), "/video/hls", "publish-cancel-test")
+	drv.DagOptions = W3sDagOptions{ChunkSize: 1024}
+	drv.Uploader = blocking
+	defer drv.Shutdown(context.Background())
+
+	_, err := drv.NewSession("").SaveData(context.Background(), "1.ts", bytes.NewReader(make([]byte, 4096)), nil, 0)
+	require.NoError(err)
+
+	// cancelled while uploading
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-blocking.uploading
+		cancel()
+	}()
+	_, err = drv.Publish(ctx)
+	require.ErrorIs(err, context.Canceled)
+	entries, err := os.ReadDir(tmp)
+	require.NoError(err)
+	require.Empty(entries)
+
+	// cancelled before starting
+	_, err = drv.Publish(ctx)
+	require.ErrorIs(err, context.Canceled)
+	require.Len(uploader.stored, 2)
+
+	// retried, without the CAR of the directory stored by the cancelled Publish
+	drv.Uploader = uploader
+	url, err := drv.Publish(context.Background())
+	require.NoError(err)
+	require.Equal("ipfs://"+uploader.rootCid, url)
+	require.Equal([]string{"car-0", "car-2"}, uploader.carCids)
+}
+
+func TestW3sEmptyFile(t *testing.T) {
+	require := require2.New(t)
+	// the empty files are packed natively, without running the failing ipfs-car
+	bin := t.TempDir()
+	require.NoError(os.WriteFile(filepath.Join(bin, "ipfs-car"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	t.Setenv("PATH", bin)
+	uploader := &fakeW3sUploader{stored: map[string][]byte{}}
+	drv := NewW3sDriver(base64Url.EncodeToString([]byte("proof")), "", "empty-file-test")
+	drv.Uploader = uploader
+	defer drv.Shutdown(context.Background())
+
+	out, err := drv.NewSession("").SaveData(context.Background(), "1.ts", bytes.NewReader(nil), nil, 0)
+	require.NoError(err)
+	// the CID of the empty file added with ipfs-car
+	require.Equal("bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", out.URL)
+	cr, err := car.NewCarReader(bytes.NewReader(uploader.stored["car-0"]))
+	require.NoError(err)
+	blk, err := cr.Next()
+	require.NoError(err)
+	require.Equal(out.URL, blk.Cid().String())
+	require.Empty(blk.RawData())
+}
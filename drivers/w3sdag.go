@@ -0,0 +1,172 @@
+package drivers
+
+import (
+	"context"
+	"io"
+	"os"
+
+	bserv "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipld/go-car"
+)
+
+const (
+	// w3sDefaultChunkSize is the size of the file leaves used by ipfs-car
+	w3sDefaultChunkSize = 256 * 1024
+	// w3sLinksPerNode is the max number of children of an intermediate file node
+	w3sLinksPerNode = 174
+)
+
+// W3sDagOptions control how the W3S driver lays out the saved files and the published directory
+// in the IPFS DAG. Different options produce different CIDs for the same data, which affects
+// deduplication with content added elsewhere. The zero value keeps the defaults of ipfs-car:
+// CIDv1, 256KiB chunks and raw leaves.
+type W3sDagOptions struct {
+	// CidBuilder builds the CIDs of the DAG nodes, e.g. cid.V0Builder{} for CIDv0. Nil means CIDv1.
+	CidBuilder cid.Builder
+	// ChunkSize is the size in bytes of the file leaves. Zero means 256KiB.
+	ChunkSize int
+	// ProtobufLeaves stores the file leaves as UnixFS protobuf nodes instead of raw blocks.
+	ProtobufLeaves bool
+}
+
+func (opts W3sDagOptions) cidBuilder() cid.Builder {
+	if opts.CidBuilder == nil {
+		return cidV1
+	}
+	return opts.CidBuilder
+}
+
+// packsNatively returns true if the files can't be packed by ipfs-car with these options
+func (opts W3sDagOptions) packsNatively() bool {
+	return opts.CidBuilder != nil || opts.ChunkSize > 0 || opts.ProtobufLeaves
+}
+
+type dagFileNode struct {
+	node     format.Node
+	fileSize uint64
+}
+
+func newDagService() format.DAGService {
+	return merkledag.NewDAGService(bserv.New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil))
+}
+
+// dagPackCar converts a file into a CAR with a balanced UnixFS DAG built according to the options.
+// Returns the path of the CAR and the root CID of the file.
+func dagPackCar(ctx context.Context, filePath string, opts W3sDagOptions) (string, string, error) {
+	root, dag, err := dagBuildFile(ctx, filePath, opts)
+	if err != nil {
+		return "", "", err
+	}
+	fCar, err := os.CreateTemp(TempDir, "w3s-car")
+	if err != nil {
+		return "", "", err
+	}
+	defer fCar.Close()
+	if err = car.WriteCar(ctx, dag, []cid.Cid{root.Cid()}, fCar); err != nil {
+		deleteFile(fCar.Name())
+		return "", "", err
+	}
+	return fCar.Name(), root.Cid().String(), nil
+}
+
+func dagBuildFile(ctx context.Context, filePath string, opts W3sDagOptions) (format.Node, format.DAGService, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = w3sDefaultChunkSize
+	}
+	dag := newDagService()
+	var nodes []dagFileNode
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := io.ReadFull(f, buf)
+		if readErr == io.EOF && len(nodes) > 0 {
+			break
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return nil, nil, readErr
+		}
+		leaf, err := opts.newLeaf(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = dag.Add(ctx, leaf.node); err != nil {
+			return nil, nil, err
+		}
+		nodes = append(nodes, leaf)
+		if readErr != nil {
+			break
+		}
+	}
+
+	// build the tree bottom up, so that all the leaves are at the same depth
+	for len(nodes) > 1 {
+		var parents []dagFileNode
+		for start := 0; start < len(nodes); start += w3sLinksPerNode {
+			end := start + w3sLinksPerNode
+			if end > len(nodes) {
+				end = len(nodes)
+			}
+			parent, err := opts.newParent(nodes[start:end])
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = dag.Add(ctx, parent.node); err != nil {
+				return nil, nil, err
+			}
+			parents = append(parents, parent)
+		}
+		nodes = parents
+	}
+	return nodes[0].node, dag, nil
+}
+
+func (opts W3sDagOptions) newLeaf(data []byte) (dagFileNode, error) {
+	if !opts.ProtobufLeaves {
+		n, err := merkledag.NewRawNodeWPrefix(data, opts.cidBuilder())
+		return dagFileNode{node: n, fileSize: uint64(len(data))}, err
+	}
+	fsn := unixfs.NewFSNode(unixfs.TFile)
+	fsn.SetData(data)
+	pbData, err := fsn.GetBytes()
+	if err != nil {
+		return dagFileNode{}, err
+	}
+	n := merkledag.NodeWithData(pbData)
+	if err = n.SetCidBuilder(opts.cidBuilder()); err != nil {
+		return dagFileNode{}, err
+	}
+	return dagFileNode{node: n, fileSize: fsn.FileSize()}, nil
+}
+
+func (opts W3sDagOptions) newParent(children []dagFileNode) (dagFileNode, error) {
+	fsn := unixfs.NewFSNode(unixfs.TFile)
+	n := &merkledag.ProtoNode{}
+	if err := n.SetCidBuilder(opts.cidBuilder()); err != nil {
+		return dagFileNode{}, err
+	}
+	for _, child := range children {
+		if err := n.AddNodeLink("", child.node); err != nil {
+			return dagFileNode{}, err
+		}
+		fsn.AddBlockSize(child.fileSize)
+	}
+	pbData, err := fsn.GetBytes()
+	if err != nil {
+		return dagFileNode{}, err
+	}
+	n.SetData(pbData)
+	return dagFileNode{node: n, fileSize: fsn.FileSize()}, nil
+}
@@ -0,0 +1,128 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipld/go-car"
+	require2 "github.com/stretchr/testify/require"
+)
+
+func TestDagPackCar(t *testing.T) {
+	require := require2.New(t)
+	ctx := context.Background()
+	TempDir = t.TempDir()
+	defer func() { TempDir = "" }()
+
+	data := bytes.Repeat([]byte("0123456789"), 2000)
+	filePath := filepath.Join(TempDir, "data")
+	require.NoError(os.WriteFile(filePath, data, 0644))
+
+	readBack := func(carPath, fileCid string) []byte {
+		f, err := os.Open(carPath)
+		require.NoError(err)
+		defer f.Close()
+		cr, err := car.NewCarReader(f)
+		require.NoError(err)
+		require.Len(cr.Header.Roots, 1)
+		require.Equal(fileCid, cr.Header.Roots[0].String())
+		blocks := map[cid.Cid][]byte{}
+		for {
+			b, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			blocks[b.Cid()] = b.RawData()
+		}
+		var content []byte
+		var walk func(c cid.Cid)
+		walk = func(c cid.Cid) {
+			raw, ok := blocks[c]
+			require.True(ok)
+			if c.Type() == cid.Raw {
+				content = append(content, raw...)
+				return
+			}
+			n, err := merkledag.DecodeProtobuf(raw)
+			require.NoError(err)
+			fsn, err := unixfs.FSNodeFromBytes(n.Data())
+			require.NoError(err)
+			content = append(content, fsn.Data()...)
+			for _, l := range n.Links() {
+				walk(l.Cid)
+			}
+		}
+		walk(cr.Header.Roots[0])
+		return content
+	}
+
+	cids := map[string]bool{}
+	for _, opts := range []W3sDagOptions{
+		{ChunkSize: 100},
+		{ChunkSize: 100, ProtobufLeaves: true},
+		{ChunkSize: 1000},
+		{ChunkSize: 100, CidBuilder: cid.V0Builder{}, ProtobufLeaves: true},
+	} {
+		carPath, fileCid, err := dagPackCar(ctx, filePath, opts)
+		require.NoError(err)
+		require.Equal(data, readBack(carPath, fileCid))
+		cids[fileCid] = true
+
+		// packing is deterministic
+		_, again, err := dagPackCar(ctx, filePath, opts)
+		require.NoError(err)
+		require.Equal(fileCid, again)
+	}
+	require.Len(cids, 4)
+
+	_, fileCid, err := dagPackCar(ctx, filePath, W3sDagOptions{CidBuilder: cid.V0Builder{}, ProtobufLeaves: true})
+	require.NoError(err)
+	c, err := cid.Parse(fileCid)
+	require.NoError(err)
+	require.Equal(uint64(0), c.Version())
+}
+
+func TestW3sDagOptionsDirectories(t *testing.T) {
+	require := require2.New(t)
+	rc := newRootCar(cid.V0Builder{})
+	leaf := merkledag.NewRawNode([]byte("data"))
+	require.NoError(rc.addFile(context.Background(), "/foo/bar", "1.ts", leaf.Cid().String(), "carCid"))
+	require.Equal(uint64(0), rc.root.Cid().Version())
+
+	rc = newRootCar(W3sDagOptions{}.cidBuilder())
+	require.NoError(rc.addFile(context.Background(), "/foo/bar", "1.ts", leaf.Cid().String(), "carCid"))
+	require.Equal(uint64(1), rc.root.Cid().Version())
+}
+
+func TestW3sRootCidIsDeterministic(t *testing.T) {
+	require := require2.New(t)
+	type file struct{ dirPath, name, data string }
+	files := []file{
+		{"/foo/video/hls/", "1.ts", "segment 1"},
+		{"/foo/video/", "index.m3u8", "playlist"},
+		{"/foo/video/hls/", "2.ts", "segment 2"},
+		{"", "thumbnail.jpg", "thumbnail"},
+		{"/bar/", "1.ts", "other segment"},
+	}
+	rootCid := func(order []int) string {
+		rc := newRootCar(cidV1)
+		for _, i := range order {
+			fileCid := merkledag.NewRawNode([]byte(files[i].data)).Cid().String()
+			require.NoError(rc.addFile(context.Background(), files[i].dirPath, files[i].name, fileCid, "carCid"))
+		}
+		return rc.root.Cid().String()
+	}
+	expected := rootCid([]int{0, 1, 2, 3, 4})
+	require.Equal(expected, rootCid([]int{4, 3, 2, 1, 0}))
+	require.Equal(expected, rootCid([]int{2, 4, 0, 3, 1}))
+	// saving a file twice doesn't add a duplicate entry
+	require.Equal(expected, rootCid([]int{0, 1, 2, 0, 3, 4, 3}))
+}
@@ -0,0 +1,151 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	unixfspb "github.com/ipfs/go-unixfs/pb"
+)
+
+// defaultW3sGatewayURL is the gateway the published directories are listed from
+const defaultW3sGatewayURL = "https://w3s.link/ipfs/"
+
+// w3sEntry is a file or directory of a published DAG
+type w3sEntry struct {
+	node *merkledag.ProtoNode
+	dir  bool
+	size int64
+}
+
+// ListFiles lists a directory published with Publish, walking its UnixFS DAG block by block
+// through the gateway. The dir is the root CID returned by Publish, optionally followed by the path
+// of a subdirectory, like "bafy.../video/hls". The files and subdirectories directly in it are
+// returned in a single page, the files with their CID as the ETag.
+func (session *W3sSession) ListFiles(ctx context.Context, dir, delim string) (PageInfo, error) {
+	segments := strings.FieldsFunc(strings.TrimPrefix(dir, "ipfs://"), func(c rune) bool { return c == '/' })
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("the root CID of the directory is required")
+	}
+	rootCid, err := cid.Decode(segments[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid root CID %s: %w", segments[0], err)
+	}
+	node, err := session.os.fetchDir(ctx, rootCid)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segments[1:] {
+		link, err := node.GetNodeLink(name)
+		if err == merkledag.ErrLinkNotFound {
+			return nil, ErrNotExist
+		} else if err != nil {
+			return nil, err
+		}
+		if node, err = session.os.fetchDir(ctx, link.Cid); err != nil {
+			return nil, err
+		}
+	}
+
+	pi := &singlePageInfo{
+		files:       []FileInfo{},
+		directories: []string{},
+	}
+	for _, link := range node.Links() {
+		entry, err := session.os.fetchEntry(ctx, link.Cid)
+		if err != nil {
+			return nil, err
+		}
+		if entry.dir {
+			pi.directories = append(pi.directories, link.Name)
+			continue
+		}
+		size := entry.size
+		pi.files = append(pi.files, FileInfo{
+			Name: link.Name,
+			ETag: link.Cid.String(),
+			Size: &size,
+		})
+	}
+	return pi, nil
+}
+
+func (ostore *W3sOS) fetchDir(ctx context.Context, c cid.Cid) (*merkledag.ProtoNode, error) {
+	entry, err := ostore.fetchEntry(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.dir {
+		return nil, fmt.Errorf("%s is not a directory", c)
+	}
+	return entry.node, nil
+}
+
+// fetchEntry fetches the root block of a file or directory to tell which one it is. The size of a
+// file is the one recorded in its root block, its other blocks are not fetched.
+func (ostore *W3sOS) fetchEntry(ctx context.Context, c cid.Cid) (*w3sEntry, error) {
+	data, err := ostore.fetchBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Type() {
+	case cid.Raw:
+		return &w3sEntry{size: int64(len(data))}, nil
+	case cid.DagProtobuf:
+	default:
+		return nil, fmt.Errorf("unsupported codec of %s", c)
+	}
+	node, err := merkledag.DecodeProtobuf(data)
+	if err != nil {
+		return nil, err
+	}
+	fsNode, err := unixfs.FSNodeFromBytes(node.Data())
+	if err != nil {
+		return nil, err
+	}
+	switch fsNode.Type() {
+	case unixfspb.Data_Directory:
+		return &w3sEntry{node: node, dir: true}, nil
+	case unixfspb.Data_File, unixfspb.Data_Raw:
+		return &w3sEntry{node: node, size: int64(fsNode.FileSize())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported UnixFS node type %s of %s", fsNode.Type(), c)
+	}
+}
+
+// fetchBlock fetches a block from the trustless gateway API, checking that it matches its CID
+func (ostore *W3sOS) fetchBlock(ctx context.Context, c cid.Cid) ([]byte, error) {
+	gateway := ostore.GatewayURL
+	if gateway == "" {
+		gateway = defaultW3sGatewayURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", gateway+c.String()+"?format=raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch block %s: %s", c, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if sum, err := c.Prefix().Sum(data); err != nil || !sum.Equals(c) {
+		return nil, fmt.Errorf("the gateway returned invalid data for block %s", c)
+	}
+	return data, nil
+}
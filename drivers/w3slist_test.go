@@ -0,0 +1,94 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipld/go-car"
+	"github.com/stretchr/testify/require"
+)
+
+func TestW3sListFiles(t *testing.T) {
+	require := require.New(t)
+	uploader := &fakeW3sUploader{stored: map[string][]byte{}}
+	proof := base64Url.EncodeToString([]byte("proof"))
+	newDriver := func(dirPath string) *W3sOS {
+		drv := NewW3sDriver(proof, dirPath, "list-files-test")
+		drv.DagOptions = W3sDagOptions{ChunkSize: 1024}
+		drv.Uploader = uploader
+		return drv
+	}
+	// the drivers of the same pubId publish a single tree
+	hls, video := newDriver("/video/hls"), newDriver("/video")
+	defer hls.Shutdown(context.Background())
+	save := func(drv *W3sOS, name string, size int) {
+		_, err := drv.NewSession("").SaveData(context.Background(), name, bytes.NewReader(make([]byte, size)), nil, 0)
+		require.NoError(err)
+	}
+	save(hls, "1.ts", 4096)
+	save(hls, "2.ts", 10)
+	save(video, "index.m3u8", 100)
+	url, err := hls.Publish(context.Background())
+	require.NoError(err)
+	rootCid := strings.TrimPrefix(url, "ipfs://")
+
+	// fake trustless gateway serving the blocks of the stored CARs
+	blocks := map[string][]byte{}
+	for _, data := range uploader.stored {
+		cr, err := car.NewCarReader(bytes.NewReader(data))
+		require.NoError(err)
+		for {
+			blk, err := cr.Next()
+			if err != nil {
+				break
+			}
+			blocks[blk.Cid().String()] = blk.RawData()
+		}
+	}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := blocks[strings.TrimPrefix(r.URL.Path, "/ipfs/")]
+		if !ok || r.URL.Query().Get("format") != "raw" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	defer gateway.Close()
+	drv := NewW3sDriver(proof, "", "list-files-test")
+	drv.GatewayURL = gateway.URL + "/ipfs/"
+	sess := drv.NewSession("")
+
+	pi, err := sess.ListFiles(context.Background(), rootCid, "/")
+	require.NoError(err)
+	require.Empty(pi.Files())
+	require.Equal([]string{"video"}, pi.Directories())
+
+	pi, err = sess.ListFiles(context.Background(), "ipfs://"+rootCid+"/video/", "/")
+	require.NoError(err)
+	require.Equal([]string{"hls"}, pi.Directories())
+	require.Len(pi.Files(), 1)
+	require.Equal("index.m3u8", pi.Files()[0].Name)
+	require.Equal(int64(100), *pi.Files()[0].Size)
+
+	pi, err = sess.ListFiles(context.Background(), rootCid+"/video/hls", "/")
+	require.NoError(err)
+	require.Empty(pi.Directories())
+	files := pi.Files()
+	require.Len(files, 2)
+	require.Equal("1.ts", files[0].Name)
+	require.Equal(int64(4096), *files[0].Size)
+	require.NotEmpty(files[0].ETag)
+	require.Equal("2.ts", files[1].Name)
+	require.Equal(int64(10), *files[1].Size)
+
+	_, err = sess.ListFiles(context.Background(), rootCid+"/audio", "/")
+	require.ErrorIs(err, ErrNotExist)
+	_, err = sess.ListFiles(context.Background(), rootCid+"/video/hls/1.ts", "/")
+	require.ErrorContains(err, "not a directory")
+	_, err = sess.ListFiles(context.Background(), "", "/")
+	require.Error(err)
+}